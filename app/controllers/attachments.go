@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+// multipartOverhead allows for the multipart headers and boundaries around an
+// uploaded file when limiting the size of the request body.
+const multipartOverhead = 64 << 10
+
+func (controller *Controller) PostAttachments(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body,
+		models.MaxAttachmentSize+multipartOverhead)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Missing or oversized file.", 1, nil})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	defer file.Close()
+
+	attachment, err := controller.stores.Attachments.CreateAttachment(c.Request.Context(), user,
+		fileHeader.Filename, file, fileHeader.Size)
+	if errors.Is(err, models.ErrAttachmentTooLarge) {
+		c.AbortWithError(http.StatusRequestEntityTooLarge,
+			utils.AppError{"File is too large.", 2, gin.H{"maxSize": models.MaxAttachmentSize}})
+		return
+	} else if errors.Is(err, models.ErrAttachmentTypeNotAllowed) {
+		c.AbortWithError(http.StatusUnsupportedMediaType,
+			utils.AppError{"File type is not allowed.", 3, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	c.JSON(http.StatusCreated, utils.SuccessResponse(gin.H{"attachment": getAttachmentJson(attachment)}))
+}
+
+func (controller *Controller) GetAttachment(c *gin.Context) {
+	serveAttachment(c, controller.stores, false)
+}
+
+func (controller *Controller) GetAttachmentThumbnail(c *gin.Context) {
+	serveAttachment(c, controller.stores, true)
+}
+
+func serveAttachment(c *gin.Context, stores *repositories.Stores, thumbnail bool) {
+	errAttachmentNotFound := utils.AppError{"Attachment not found.", 1, nil}
+
+	user, err := repositories.GetUserFromRequest(c, stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	attachmentIdParam, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errAttachmentNotFound)
+		return
+	}
+
+	attachment, err := stores.Attachments.GetUserAttachment(user, attachmentIdParam)
+	if errors.Is(err, models.ErrAttachmentNotFound) {
+		c.AbortWithError(http.StatusNotFound, errAttachmentNotFound)
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	blob, err := attachment.Open(c.Request.Context(), thumbnail)
+	if errors.Is(err, models.ErrAttachmentNotFound) {
+		c.AbortWithError(http.StatusNotFound, errAttachmentNotFound)
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	defer blob.Close()
+
+	contentType, size := attachment.ContentType, attachment.Size
+	if thumbnail {
+		contentType, size = "image/jpeg", -1
+	}
+	c.DataFromReader(http.StatusOK, size, contentType, blob, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment",
+			map[string]string{"filename": attachment.Filename}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=86400",
+	})
+}
+
+func getAttachmentJson(attachment *models.Attachment) gin.H {
+	attachmentJson := gin.H{
+		"id":          attachment.ID,
+		"filename":    attachment.Filename,
+		"contentType": attachment.ContentType,
+		"size":        attachment.Size,
+		"url":         attachment.Url(),
+	}
+	if attachment.ThumbnailKey != "" {
+		attachmentJson["width"] = attachment.Width
+		attachmentJson["height"] = attachment.Height
+		attachmentJson["thumbnailUrl"] = attachment.ThumbnailUrl()
+	}
+	return attachmentJson
+}
+
+func getAttachmentsJson(attachments []models.Attachment) []gin.H {
+	attachmentsJson := []gin.H{}
+	for _, attachment := range attachments {
+		attachmentsJson = append(attachmentsJson, getAttachmentJson(&attachment))
+	}
+	return attachmentsJson
+}
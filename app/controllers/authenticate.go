@@ -3,18 +3,26 @@ package controllers
 import (
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator"
 
 	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
 	"github.com/nrmilstein/nchat/utils"
 )
 
-func PostAuthenticate(c *gin.Context) {
+func (controller *Controller) PostAuthenticate(c *gin.Context) {
 	invalidCredError := utils.AppError{"Invalid username/password.", 1, nil}
+	throttledErrorCodes := map[error]int{
+		models.ErrAccountLocked: 4,
+		models.ErrLoginBackoff:  5,
+		models.ErrIPLocked:      6,
+	}
 
 	var params struct {
 		Username string `json:"username" binding:"required"`
@@ -37,11 +45,19 @@ func PostAuthenticate(c *gin.Context) {
 	}
 
 	username, password := strings.ToLower(params.Username), params.Password
-	session, user, err := models.CreateSession(username, password)
+	session, user, err := controller.stores.Sessions.CreateSession(username, password,
+		c.Request.UserAgent(), utils.ClientIP(c))
 
+	var throttledErr *models.LoginThrottledError
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCred) {
 			c.AbortWithError(http.StatusUnauthorized, invalidCredError)
+		} else if errors.As(err, &throttledErr) {
+			retryAfter := int(math.Ceil(throttledErr.RetryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+			c.AbortWithError(http.StatusTooManyRequests, utils.AppError{throttledErr.Error(),
+				throttledErrorCodes[throttledErr.Err], gin.H{"retryAfter": retryAfter}})
 		} else {
 			utils.AbortErrServer(c)
 		}
@@ -58,8 +74,8 @@ func PostAuthenticate(c *gin.Context) {
 	}))
 }
 
-func GetAuthenticate(c *gin.Context) {
-	user, err := models.GetUserFromRequest(c)
+func (controller *Controller) GetAuthenticate(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
 	if err != nil {
 		utils.AbortErrForbidden(c)
 		return
@@ -75,3 +91,20 @@ func GetAuthenticate(c *gin.Context) {
 
 	c.JSON(http.StatusOK, utils.SuccessResponse(userJson))
 }
+
+func (controller *Controller) DeleteAuthenticate(c *gin.Context) {
+	session, err := repositories.GetSessionFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	err = controller.stores.Sessions.DeleteSession(session)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	controller.hub.RevokeSessions(session.UserID, []int{session.ID})
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(nil))
+}
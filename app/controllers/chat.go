@@ -2,74 +2,115 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
 	"github.com/nrmilstein/nchat/chatServer"
 	"github.com/nrmilstein/nchat/utils"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
-func GetChat(hub *chatServer.Hub) func(*gin.Context) {
-	return func(c *gin.Context) {
-		writer := c.Writer
-		request := c.Request
-
-		originPatterns := []string{}
-		if gin.IsDebugging() {
-			originPatterns = []string{"localhost:3000"}
-		}
-
-		acceptOptions := &websocket.AcceptOptions{
-			Subprotocols:   []string{"nchat"},
-			OriginPatterns: originPatterns,
-		}
-
-		connection, err := websocket.Accept(writer, request, acceptOptions)
-		if err != nil {
-			utils.AbortErrServer(c)
-			return
-		}
-		defer connection.Close(websocket.StatusInternalError, "Internal server error.")
-
-		user, err := handleAuthMessage(connection, request.Context())
-		if err != nil {
-			connection.Close(4003, "Authorization failed.")
-			return
-		}
-
-		clt := chatServer.NewClient(hub, user)
-		hub.AddClient(clt)
-		defer hub.RemoveClient(clt)
-
-		err = clt.ServeChatMessages(connection, request.Context())
-
-		log.Println(err)
-		connection.Close(websocket.StatusNormalClosure, "")
+func (controller *Controller) GetChat(c *gin.Context) {
+	writer := c.Writer
+	request := c.Request
+
+	if controller.hub.IsShuttingDown() {
+		c.AbortWithError(http.StatusServiceUnavailable,
+			utils.AppError{"Server is shutting down.", 1, nil})
+		return
+	}
+
+	originPatterns := []string{}
+	if gin.IsDebugging() {
+		originPatterns = []string{"localhost:3000"}
+	}
+
+	acceptOptions := &websocket.AcceptOptions{
+		Subprotocols:   []string{"nchat"},
+		OriginPatterns: originPatterns,
+	}
+
+	connection, err := websocket.Accept(writer, request, acceptOptions)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	defer connection.Close(websocket.StatusInternalError, "Internal server error.")
+
+	session, resumeSeq, err := handleAuthMessage(connection, controller.stores, request.Context())
+	if err != nil {
+		connection.Close(4003, "Authorization failed.")
+		return
 	}
+
+	clt := chatServer.NewClient(controller.hub, session)
+	clt.ResumeFrom(resumeSeq)
+	err = controller.hub.AddClient(clt)
+	if err != nil {
+		connection.Close(websocket.StatusGoingAway, "Server is shutting down.")
+		return
+	}
+	defer controller.hub.RemoveClient(clt)
+
+	err = clt.ServeChatMessages(connection, request.Context())
+
+	log.Println(err)
+	if errors.Is(err, chatServer.ErrSessionRevoked) {
+		connection.Close(4001, "Session revoked.")
+		return
+	} else if errors.Is(err, chatServer.ErrSlowConsumer) {
+		connection.Close(4002, "Too many unread notifications.")
+		return
+	} else if errors.Is(err, chatServer.ErrServerShuttingDown) {
+		connection.Close(websocket.StatusGoingAway, "Server is shutting down.")
+		return
+	}
+	connection.Close(websocket.StatusNormalClosure, "")
 }
 
-func handleAuthMessage(connection *websocket.Conn, ctx context.Context) (*models.User, error) {
+// handleAuthMessage authenticates the connection, and returns the sequence
+// number to replay the user's events from. That's the last event the client
+// received if it's resuming after a reconnect, and otherwise the seq it was
+// just sent, so that events between then and the client being added to the
+// hub aren't lost.
+func handleAuthMessage(connection *websocket.Conn, stores *repositories.Stores,
+	ctx context.Context) (*models.Session, int64, error) {
 	var authRequest chatServer.WsAuthRequest
 	err := wsjson.Read(ctx, connection, &authRequest)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	authKey := authRequest.Data.AuthKey
-	user, err := models.GetUserFromKey(authKey)
+	session, err := stores.Sessions.GetSessionFromKey(authKey)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	currentSeq, err := stores.Events.GetUserEventSeq(session.UserID)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	authResponse := chatServer.WsAuthSuccessResponse{
 		Id:     authRequest.Id,
 		Type:   "response",
 		Status: "success",
+		Data: chatServer.WsAuthResponseData{
+			LastSeq: currentSeq,
+		},
 	}
 
 	wsjson.Write(ctx, connection, authResponse)
-	return user, nil
+
+	lastSeq := authRequest.Data.LastSeq
+	if lastSeq == nil || *lastSeq > currentSeq {
+		return session, currentSeq, nil
+	}
+	return session, *lastSeq, nil
 }
@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/chatServer"
+)
+
+// Controller holds what the request handlers share. Each handler is a method
+// on it.
+type Controller struct {
+	stores *repositories.Stores
+	hub    *chatServer.Hub
+}
+
+func NewController(stores *repositories.Stores, hub *chatServer.Hub) *Controller {
+	return &Controller{stores: stores, hub: hub}
+}
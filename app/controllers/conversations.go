@@ -1,136 +1,420 @@
 package controllers
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
-	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
 	"github.com/nrmilstein/nchat/app/models"
-	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/chatServer"
 	"github.com/nrmilstein/nchat/utils"
-	"gorm.io/gorm"
 )
 
-func GetConversations(c *gin.Context) {
-	db := db.GetDb()
-
-	user, err := models.GetUserFromRequest(c)
+func (controller *Controller) GetConversations(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
 	if err != nil {
 		utils.AbortErrForbidden(c)
 		return
 	}
 
-	var conversations []models.Conversation
+	var params struct {
+		Cursor string `form:"cursor"`
+		Limit  int    `form:"limit"`
+	}
+	err = c.ShouldBindQuery(&params)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Invalid pagination parameters.", 1, nil})
+		return
+	}
 
-	readConversationsResult := db.Model(&user).
-		Preload("Users", "ID <> ?", user.ID).
-		Preload("Messages", func(db *gorm.DB) *gorm.DB {
-			return db.Select("DISTINCT ON (conversation_id) *").Order("conversation_id, created_at DESC")
-		}).
-		Association("Conversations").Find(&conversations)
+	page, err := controller.stores.Conversations.GetUserConversations(user, params.Cursor, params.Limit)
+	if errors.Is(err, models.ErrInvalidConversationCursor) {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Invalid conversation cursor.", 2, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
 
-	if readConversationsResult != nil {
+	conversationIDs := []int{}
+	for _, conversation := range page.Conversations {
+		conversationIDs = append(conversationIDs, conversation.ID)
+	}
+	readStates, err := controller.stores.ReadMarkers.GetReadStates(user, conversationIDs)
+	if err != nil {
 		utils.AbortErrServer(c)
 		return
 	}
 
-	sort.Slice(conversations, func(i, j int) bool {
-		if len(conversations[i].Messages) == 0 {
-			return true
-		} else if len(conversations[j].Messages) == 0 {
-			return false
+	conversationsJson := []gin.H{}
+	for _, conversation := range page.Conversations {
+		messagesJson := []gin.H{}
+		if conversation.LastMessage != nil {
+			messagesJson = append(messagesJson, getMessageJson(conversation.LastMessage))
 		}
-		return conversations[i].Messages[0].CreatedAt.After(conversations[j].Messages[0].CreatedAt)
-	})
 
-	conversationsJson := []gin.H{}
-	for _, conversation := range conversations {
-		firstMessage := conversation.Messages[0]
-		conversationPartner := conversation.Users[0]
-
-		conversationsJson = append(conversationsJson, gin.H{
-			"id":      conversation.ID,
-			"created": conversation.CreatedAt,
-			"conversationPartner": gin.H{
-				"id":       conversationPartner.ID,
-				"username": conversationPartner.Username,
-				"name":     conversationPartner.Name,
-			},
-			"messages": []gin.H{
-				{
-					"id":       firstMessage.ID,
-					"senderId": firstMessage.UserID,
-					"sent":     firstMessage.CreatedAt,
-					"body":     firstMessage.Body,
-				},
-			},
-		})
+		conversationJson := getConversationJson(&conversation, controller.hub)
+		conversationJson["messages"] = messagesJson
+		conversationJson["lastActivity"] = conversation.LastActivityAt
+		conversationJson["unreadCount"] = readStates[conversation.ID].UnreadCount
+		conversationJson["lastReadMessageId"] = nil
+		if lastReadMessageID := readStates[conversation.ID].LastReadMessageID; lastReadMessageID != 0 {
+			conversationJson["lastReadMessageId"] = lastReadMessageID
+		}
+		conversationsJson = append(conversationsJson, conversationJson)
 	}
 
-	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"conversations": conversationsJson}))
-}
+	paginationJson := gin.H{"nextCursor": nil}
+	if page.NextCursor != "" {
+		paginationJson["nextCursor"] = page.NextCursor
+	}
 
-func GetConversation(c *gin.Context) {
-	db := db.GetDb()
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{
+		"conversations": conversationsJson,
+		"pagination":    paginationJson,
+	}))
+}
 
-	user, err := models.GetUserFromRequest(c)
+func (controller *Controller) GetConversation(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
 	if err != nil {
 		utils.AbortErrForbidden(c)
 		return
 	}
 
-	conversationIdParam, err := strconv.Atoi(c.Param("id"))
+	var params struct {
+		Before int `form:"before"`
+		After  int `form:"after"`
+		Limit  int `form:"limit"`
+	}
+	err = c.ShouldBindQuery(&params)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Invalid pagination parameters.", 2, nil})
+		return
+	}
+
+	conversation, ok := getUserConversationFromParam(c, controller.stores.Conversations, user)
+	if !ok {
+		return
+	}
+
+	page, err := controller.stores.Messages.GetMessagePage(conversation.ID, params.Before, params.After, params.Limit)
+	if errors.Is(err, models.ErrInvalidPageCursor) {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Only one of before and after may be given.", 3, nil})
+		return
+	} else if errors.Is(err, models.ErrMessageNotFound) {
+		c.AbortWithError(http.StatusNotFound,
+			utils.AppError{"Cursor message not found.", 4, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	messageIDs := []int{}
+	for _, message := range page.Messages {
+		messageIDs = append(messageIDs, message.ID)
+	}
+	reactionCounts, err := controller.stores.Reactions.GetReactionCounts(user, messageIDs)
 	if err != nil {
 		utils.AbortErrServer(c)
 		return
 	}
 
-	var conversations []models.Conversation
-	err = db.Model(&user).
-		Preload("Users", "ID <> ?", user.ID).
-		Preload("Messages", func(db *gorm.DB) *gorm.DB {
-			return db.Order("messages.created_at ASC")
-		}).
-		Association("Conversations").Find(&conversations, models.Conversation{ID: conversationIdParam})
+	messagesJson := []gin.H{}
+	for _, message := range page.Messages {
+		messageJson := getMessageJson(&message)
+		messageJson["reactions"] = getReactionsJson(reactionCounts[message.ID])
+		messagesJson = append(messagesJson, messageJson)
+	}
+
+	conversationJson := getConversationJson(conversation, controller.hub)
+	conversationJson["messages"] = messagesJson
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{
+		"conversation": conversationJson,
+		"pagination":   getPaginationJson(page),
+	}))
+}
+
+func (controller *Controller) PostConversations(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	var params struct {
+		Title     string   `json:"title" binding:"required"`
+		Usernames []string `json:"usernames" binding:"required"`
+	}
+
+	err = c.ShouldBindJSON(&params)
+	switch err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"JSON syntax error.", 1, nil})
+		return
+	case validator.ValidationErrors:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Missing parameters.", 2, nil})
+		return
+	default:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Could not parse request body.", 3, nil})
+		return
+	}
+
+	title := strings.TrimSpace(params.Title)
+	if title == "" {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Title cannot be empty.", 4, nil})
+		return
+	}
 
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+	members, ok := getMembersFromUsernames(c, controller.stores.Users, params.Usernames)
+	if !ok {
+		return
+	}
+
+	conversation, err := controller.stores.Conversations.CreateGroupConversation(user, title, members)
+	if errors.Is(err, models.ErrTooManyMembers) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Too many members.", 6, nil})
+		return
+	} else if err != nil {
 		utils.AbortErrServer(c)
 		return
 	}
+	controller.hub.NotifyConversationCreated(conversation)
+
+	c.JSON(http.StatusCreated,
+		utils.SuccessResponse(gin.H{"conversation": getConversationJson(conversation, controller.hub)}))
+}
+
+func (controller *Controller) PostConversationMembers(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	conversation, ok := getUserConversationFromParam(c, controller.stores.Conversations, user)
+	if !ok {
+		return
+	}
 
-	if len(conversations) == 0 {
+	var params struct {
+		Usernames []string `json:"usernames" binding:"required"`
+	}
+
+	err = c.ShouldBindJSON(&params)
+	switch err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"JSON syntax error.", 2, nil})
+		return
+	case validator.ValidationErrors:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Missing parameters.", 3, nil})
+		return
+	default:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Could not parse request body.", 4, nil})
+		return
+	}
+
+	members, ok := getMembersFromUsernames(c, controller.stores.Users, params.Usernames)
+	if !ok {
+		return
+	}
+
+	err = controller.stores.Conversations.AddMembers(conversation, members)
+	if errors.Is(err, models.ErrNotGroupConversation) {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Conversation is not a group conversation.", 6, nil})
+		return
+	} else if errors.Is(err, models.ErrTooManyMembers) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Too many members.", 7, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	controller.hub.NotifyConversationUpdated(conversation)
+
+	c.JSON(http.StatusOK,
+		utils.SuccessResponse(gin.H{"conversation": getConversationJson(conversation, controller.hub)}))
+}
+
+// DeleteConversationMember removes a member from a group conversation. A user
+// leaves a group by removing themselves.
+func (controller *Controller) DeleteConversationMember(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	conversation, ok := getUserConversationFromParam(c, controller.stores.Conversations, user)
+	if !ok {
+		return
+	}
+
+	usernameParam := strings.ToLower(c.Param("username"))
+	var member *models.User
+	for i := range conversation.Users {
+		if conversation.Users[i].Username == usernameParam {
+			member = &conversation.Users[i]
+		}
+	}
+	if member == nil {
 		c.AbortWithError(http.StatusNotFound,
-			utils.AppError{"Conversation not found.", 1, nil})
+			utils.AppError{"User is not a member of the conversation.", 2, nil})
 		return
 	}
+	memberID := member.ID
 
-	conversation := conversations[0]
-	conversationPartner := conversation.Users[0]
+	err = controller.stores.Conversations.RemoveMember(conversation, user, member)
+	if errors.Is(err, models.ErrNotGroupConversation) {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Conversation is not a group conversation.", 3, nil})
+		return
+	} else if errors.Is(err, models.ErrNotConversationCreator) {
+		c.AbortWithError(http.StatusForbidden,
+			utils.AppError{"Only the creator of a group can remove other members.", 4, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	controller.hub.NotifyConversationUpdated(conversation, memberID)
 
-	var messagesJson []gin.H
+	c.JSON(http.StatusOK,
+		utils.SuccessResponse(gin.H{"conversation": getConversationJson(conversation, controller.hub)}))
+}
+
+// getUserConversationFromParam loads the conversation in the :id parameter
+// if user is a member. If not, the request is aborted and ok is false.
+func getUserConversationFromParam(c *gin.Context, conversations repositories.ConversationStore,
+	user *models.User) (*models.Conversation, bool) {
+	errConversationNotFound := utils.AppError{"Conversation not found.", 1, nil}
+
+	conversationIdParam, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errConversationNotFound)
+		return nil, false
+	}
+
+	conversation, err := conversations.GetUserConversation(user, conversationIdParam)
+	if errors.Is(err, models.ErrConversationNotFound) {
+		c.AbortWithError(http.StatusNotFound, errConversationNotFound)
+		return nil, false
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return nil, false
+	}
+	return conversation, true
+}
+
+// getMembersFromUsernames resolves the usernames of prospective group
+// members. If any are not registered, the request is aborted and ok is false.
+func getMembersFromUsernames(c *gin.Context, users repositories.UserStore,
+	usernames []string) ([]models.User, bool) {
+	members, err := users.GetUsersByUsernames(usernames)
+	if errors.Is(err, models.ErrUserNotFound) {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"User not found.", 5, nil})
+		return nil, false
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return nil, false
+	}
+	return members, true
+}
+
+func getConversationJson(conversation *models.Conversation, hub *chatServer.Hub) gin.H {
+	conversationType := "direct"
+	if conversation.IsGroup {
+		conversationType = "group"
+	}
 
-	for _, message := range conversation.Messages {
-		messagesJson = append(messagesJson, gin.H{
-			"id":       message.ID,
-			"senderId": message.UserID,
-			"sent":     message.CreatedAt,
-			"body":     message.Body,
+	participantsJson := []gin.H{}
+	for _, participant := range conversation.Users {
+		participantsJson = append(participantsJson, gin.H{
+			"id":       participant.ID,
+			"username": participant.Username,
+			"name":     participant.Name,
+			"presence": getPresenceJson(&participant, hub),
 		})
 	}
 
-	conversationJson := gin.H{
-		"id":      conversation.ID,
-		"created": conversation.CreatedAt,
-		"conversationPartner": gin.H{
-			"id":       conversationPartner.ID,
-			"username": conversationPartner.Username,
-			"name":     conversationPartner.Name,
-		},
-		"messages": messagesJson,
+	return gin.H{
+		"id":           conversation.ID,
+		"type":         conversationType,
+		"title":        conversation.Title,
+		"created":      conversation.CreatedAt,
+		"participants": participantsJson,
 	}
+}
 
-	c.JSON(http.StatusOK,
-		utils.SuccessResponse(gin.H{"conversation": conversationJson}))
+func getMessageJson(message *models.Message) gin.H {
+	return gin.H{
+		"id":               message.ID,
+		"senderId":         message.UserID,
+		"sent":             message.CreatedAt,
+		"body":             message.Body,
+		"edited":           message.EditedAt,
+		"deleted":          message.DeletedAt,
+		"replyToMessageId": message.ReplyToID,
+		"replyTo":          getReplyToJson(message.ReplyTo),
+		"attachments":      getAttachmentsJson(message.Attachments),
+	}
+}
+
+// getReplyToJson returns a quoted preview of the message being replied to.
+func getReplyToJson(replyTo *models.Message) gin.H {
+	if replyTo == nil {
+		return nil
+	}
+	return gin.H{
+		"id":       replyTo.ID,
+		"senderId": replyTo.UserID,
+		"body":     replyTo.Preview(),
+		"deleted":  replyTo.DeletedAt,
+	}
+}
+
+func getReactionsJson(reactionCounts []models.ReactionCount) []gin.H {
+	reactionsJson := []gin.H{}
+	for _, reactionCount := range reactionCounts {
+		reactionsJson = append(reactionsJson, gin.H{
+			"emoji":   reactionCount.Emoji,
+			"count":   reactionCount.Count,
+			"reacted": reactionCount.Reacted,
+		})
+	}
+	return reactionsJson
+}
+
+func getPaginationJson(page *models.MessagePage) gin.H {
+	paginationJson := gin.H{
+		"prevCursor": nil,
+		"nextCursor": nil,
+	}
+	if page.PrevCursor != 0 {
+		paginationJson["prevCursor"] = page.PrevCursor
+	}
+	if page.NextCursor != 0 {
+		paginationJson["nextCursor"] = page.NextCursor
+	}
+	return paginationJson
 }
@@ -9,68 +9,58 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/nrmilstein/nchat/app/models"
-	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/app/repositories"
 	"github.com/nrmilstein/nchat/utils"
 )
 
-func PostDemoUsers(c *gin.Context) {
-	db := db.GetDb()
-
-	tim, timPassword, err1 := getDemoUser("tim", "Tim Talkalot")
-	sarah, _, err2 := getDemoUser("sarah", "Sarah McSmiley")
-	nick, _, err3 := getDemoUser("nick", "Nick NewMessage")
-	victoria, _, err4 := getDemoUser("victoria", "Victoria Chatterbox")
+func (controller *Controller) PostDemoUsers(c *gin.Context) {
+	tim, timPassword, err1 := createDemoUser(controller.stores.Users, "tim", "Tim Talkalot")
+	sarah, _, err2 := createDemoUser(controller.stores.Users, "sarah", "Sarah McSmiley")
+	nick, _, err3 := createDemoUser(controller.stores.Users, "nick", "Nick NewMessage")
+	victoria, _, err4 := createDemoUser(controller.stores.Users, "victoria", "Victoria Chatterbox")
 
 	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
 		utils.AbortErrServer(c)
 		return
 	}
 
-	demoUsers := []*models.User{tim, sarah, nick, victoria}
-
-	for _, user := range demoUsers {
-		result := db.Create(user)
-		if result.Error != nil {
-			utils.AbortErrServer(c)
-			return
-		}
-	}
-
-	session, _, err := models.CreateSession(tim.Username, timPassword)
+	session, _, err := controller.stores.Sessions.CreateSession(tim.Username, timPassword,
+		c.Request.UserAgent(), utils.ClientIP(c))
 	if err != nil {
 		utils.AbortErrServer(c)
 		return
 	}
 
-	models.CreateMessage(victoria, tim, "Hey Tim! How are you?")
-	models.CreateMessage(tim, victoria, "Not too shabby Victoria. How about you?")
-	models.CreateMessage(victoria, tim, "Pretty good, pretty good.")
-	models.CreateMessage(victoria, tim, "Say, I have a question for you...")
-	models.CreateMessage(victoria, tim, "Do you ever feel like you're just a demo account in some "+
-		"web application?")
-	models.CreateMessage(tim, victoria, "Victoria, do you really think that if we were demo "+
-		"accounts, they would give us these normal names like Victoria Chatterbox?")
-	models.CreateMessage(victoria, tim, "You're right, Tim. If we were demo accounts, they'd "+
-		"probably name us something crazy like Talky McMessageFace.")
-	models.CreateMessage(tim, victoria, "Exactly. There's no way that could be us.")
-	models.CreateMessage(victoria, tim, "Gee, thanks Tim! I feel loads better already.")
-	models.CreateMessage(tim, victoria, "You're welcome! Have I ever told you about the great features "+
-		"of nchat?")
-	models.CreateMessage(victoria, tim, "You have! I just love using nchat!")
-	models.CreateMessage(tim, victoria, "Me too!")
-	models.CreateMessage(tim, victoria, "Anyways, gotta go!")
-	models.CreateMessage(victoria, tim, "Bye!")
+	messages := controller.stores.Messages
+	messages.CreateMessage(victoria, tim, "Hey Tim! How are you?", models.MessageOptions{})
+	messages.CreateMessage(tim, victoria, "Not too shabby Victoria. How about you?", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "Pretty good, pretty good.", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "Say, I have a question for you...", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "Do you ever feel like you're just a demo account in some "+
+		"web application?", models.MessageOptions{})
+	messages.CreateMessage(tim, victoria, "Victoria, do you really think that if we were demo "+
+		"accounts, they would give us these normal names like Victoria Chatterbox?", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "You're right, Tim. If we were demo accounts, they'd "+
+		"probably name us something crazy like Talky McMessageFace.", models.MessageOptions{})
+	messages.CreateMessage(tim, victoria, "Exactly. There's no way that could be us.", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "Gee, thanks Tim! I feel loads better already.", models.MessageOptions{})
+	messages.CreateMessage(tim, victoria, "You're welcome! Have I ever told you about the great features "+
+		"of nchat?", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "You have! I just love using nchat!", models.MessageOptions{})
+	messages.CreateMessage(tim, victoria, "Me too!", models.MessageOptions{})
+	messages.CreateMessage(tim, victoria, "Anyways, gotta go!", models.MessageOptions{})
+	messages.CreateMessage(victoria, tim, "Bye!", models.MessageOptions{})
 
-	models.CreateMessage(nick, tim, "Hey Tim, do you have those files I mentioned?")
-	models.CreateMessage(tim, nick, "Yes! I can get them to you by tomorrow.")
-	models.CreateMessage(nick, tim, "Awesome! Don't you just love business?")
-	models.CreateMessage(tim, nick, "Business rules!")
+	messages.CreateMessage(nick, tim, "Hey Tim, do you have those files I mentioned?", models.MessageOptions{})
+	messages.CreateMessage(tim, nick, "Yes! I can get them to you by tomorrow.", models.MessageOptions{})
+	messages.CreateMessage(nick, tim, "Awesome! Don't you just love business?", models.MessageOptions{})
+	messages.CreateMessage(tim, nick, "Business rules!", models.MessageOptions{})
 
-	models.CreateMessage(tim, sarah, "Hey Sarah! How's it going?")
-	models.CreateMessage(sarah, tim, "Great! Thanks Tim.")
-	models.CreateMessage(sarah, tim, "Don't you love using nchat?")
-	models.CreateMessage(tim, sarah, "I sure do. This conversation doesn't seem scripted at all.")
-	models.CreateMessage(sarah, tim, "I know! It's like we just said all this naturally.")
+	messages.CreateMessage(tim, sarah, "Hey Sarah! How's it going?", models.MessageOptions{})
+	messages.CreateMessage(sarah, tim, "Great! Thanks Tim.", models.MessageOptions{})
+	messages.CreateMessage(sarah, tim, "Don't you love using nchat?", models.MessageOptions{})
+	messages.CreateMessage(tim, sarah, "I sure do. This conversation doesn't seem scripted at all.", models.MessageOptions{})
+	messages.CreateMessage(sarah, tim, "I know! It's like we just said all this naturally.", models.MessageOptions{})
 
 	c.JSON(http.StatusCreated, utils.SuccessResponse(gin.H{
 		"authKey": session.Key,
@@ -82,7 +72,7 @@ func PostDemoUsers(c *gin.Context) {
 	}))
 }
 
-func getDemoUser(username string, name string) (*models.User, string, error) {
+func createDemoUser(users repositories.UserStore, username string, name string) (*models.User, string, error) {
 	randBytes := make([]byte, 18)
 	_, err := rand.Read(randBytes)
 	if err != nil {
@@ -92,10 +82,9 @@ func getDemoUser(username string, name string) (*models.User, string, error) {
 	demoUsername := strings.ToLower("demo_" + username + "_" + token)
 	demoPassword := token + "80fc201fb6ac4035ebb7ffe9ec61520522e3cc47"
 
-	demoUser := &models.User{
-		Username: demoUsername,
-		Password: models.HashPassword(demoPassword),
-		Name:     name,
+	demoUser, err := users.CreateUser(demoUsername, demoPassword, name)
+	if err != nil {
+		return nil, "", err
 	}
 	return demoUser, demoPassword, nil
 }
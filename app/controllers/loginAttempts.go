@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+// GetLoginAttempts lists recent successful and failed logins to the user's
+// account.
+func (controller *Controller) GetLoginAttempts(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	var params struct {
+		Limit int `form:"limit"`
+	}
+	err = c.ShouldBindQuery(&params)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Invalid limit.", 1, nil})
+		return
+	}
+
+	attempts, err := controller.stores.LoginAttempts.GetLoginAttempts(user, params.Limit)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	attemptsJson := []gin.H{}
+	for _, attempt := range attempts {
+		attemptsJson = append(attemptsJson, gin.H{
+			"id":        attempt.ID,
+			"success":   attempt.Success,
+			"ipAddress": attempt.IPAddress,
+			"userAgent": attempt.UserAgent,
+			"created":   attempt.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"loginAttempts": attemptsJson}))
+}
@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+func (controller *Controller) PatchMessage(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	messageId, ok := getMessageIdParam(c)
+	if !ok {
+		return
+	}
+
+	var params struct {
+		Body string `json:"body" binding:"required"`
+	}
+
+	err = c.ShouldBindJSON(&params)
+	switch err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"JSON syntax error.", 2, nil})
+		return
+	case validator.ValidationErrors:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Missing parameters.", 3, nil})
+		return
+	default:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Could not parse request body.", 4, nil})
+		return
+	}
+
+	message, conversation, err := controller.stores.Messages.EditMessage(user, messageId, params.Body)
+	if !handleMessageUpdateError(c, err) {
+		return
+	}
+	controller.hub.NotifyMessageEdited(message, conversation)
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"message": getMessageJson(message)}))
+}
+
+func (controller *Controller) DeleteMessage(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	messageId, ok := getMessageIdParam(c)
+	if !ok {
+		return
+	}
+
+	message, conversation, err := controller.stores.Messages.DeleteMessage(user, messageId)
+	if !handleMessageUpdateError(c, err) {
+		return
+	}
+	controller.hub.NotifyMessageDeleted(message, conversation)
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"message": getMessageJson(message)}))
+}
+
+func (controller *Controller) GetMessageRevisions(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	messageId, ok := getMessageIdParam(c)
+	if !ok {
+		return
+	}
+
+	revisions, err := controller.stores.Messages.GetMessageRevisions(user, messageId)
+	if !handleMessageUpdateError(c, err) {
+		return
+	}
+
+	revisionsJson := []gin.H{}
+	for _, revision := range revisions {
+		revisionsJson = append(revisionsJson, gin.H{
+			"id":       revision.ID,
+			"body":     revision.Body,
+			"replaced": revision.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"revisions": revisionsJson}))
+}
+
+// GetMessageThread returns a message along with every reply to it.
+func (controller *Controller) GetMessageThread(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	messageId, ok := getMessageIdParam(c)
+	if !ok {
+		return
+	}
+
+	message, replies, err := controller.stores.Messages.GetMessageThread(user, messageId)
+	if !handleMessageUpdateError(c, err) {
+		return
+	}
+
+	repliesJson := []gin.H{}
+	for _, reply := range replies {
+		repliesJson = append(repliesJson, getMessageJson(&reply))
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{
+		"message": getMessageJson(message),
+		"replies": repliesJson,
+	}))
+}
+
+func getMessageIdParam(c *gin.Context) (int, bool) {
+	messageIdParam, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Message not found.", 1, nil})
+		return 0, false
+	}
+	return messageIdParam, true
+}
+
+// handleMessageUpdateError aborts the request if err is non-nil, and reports
+// whether the request may continue.
+func handleMessageUpdateError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, models.ErrMessageNotFound):
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Message not found.", 1, nil})
+	case errors.Is(err, models.ErrEmptyMessageBody):
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Message body cannot be empty.", 5, nil})
+	case errors.Is(err, models.ErrNotMessageSender):
+		c.AbortWithError(http.StatusForbidden,
+			utils.AppError{"Only the sender of a message can change it.", 6, nil})
+	case errors.Is(err, models.ErrMessageDeleted):
+		c.AbortWithError(http.StatusGone, utils.AppError{"Message has been deleted.", 7, nil})
+	default:
+		utils.AbortErrServer(c)
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+func (controller *Controller) GetSearch(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	var params struct {
+		Query          string `form:"q"`
+		ConversationID int    `form:"conversationId"`
+		SenderID       int    `form:"senderId"`
+		From           string `form:"from"`
+		To             string `form:"to"`
+		Cursor         string `form:"cursor"`
+		Limit          int    `form:"limit"`
+	}
+	err = c.ShouldBindQuery(&params)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Invalid search parameters.", 1, nil})
+		return
+	}
+
+	from, fromErr := parseDateParam(params.From)
+	to, toErr := parseDateParam(params.To)
+	if fromErr != nil || toErr != nil {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Dates must be in RFC 3339 format.", 2, nil})
+		return
+	}
+
+	search := &models.MessageSearch{
+		Query:          params.Query,
+		ConversationID: params.ConversationID,
+		SenderID:       params.SenderID,
+		From:           from,
+		To:             to,
+		Cursor:         params.Cursor,
+		Limit:          params.Limit,
+	}
+
+	results, nextCursor, err := controller.stores.Messages.SearchMessages(user, search)
+	if errors.Is(err, models.ErrEmptySearchQuery) {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Search query cannot be empty.", 3, nil})
+		return
+	} else if errors.Is(err, models.ErrInvalidSearchCursor) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Invalid search cursor.", 4, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	resultsJson := []gin.H{}
+	for _, result := range results {
+		resultsJson = append(resultsJson, gin.H{
+			"message": gin.H{
+				"id":             result.ID,
+				"conversationId": result.ConversationID,
+				"senderId":       result.UserID,
+				"sent":           result.CreatedAt,
+				"body":           result.Body,
+				"edited":         result.EditedAt,
+			},
+			"rank":    result.Rank,
+			"snippet": result.Snippet,
+		})
+	}
+
+	paginationJson := gin.H{"nextCursor": nil}
+	if nextCursor != "" {
+		paginationJson["nextCursor"] = nextCursor
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{
+		"results":    resultsJson,
+		"pagination": paginationJson,
+	}))
+}
+
+func parseDateParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &date, nil
+}
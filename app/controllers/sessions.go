@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+func (controller *Controller) GetSessions(c *gin.Context) {
+	currentSession, err := repositories.GetSessionFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	sessions, err := controller.stores.Sessions.GetSessions(&currentSession.User)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	sessionsJson := []gin.H{}
+	for _, session := range sessions {
+		sessionsJson = append(sessionsJson, gin.H{
+			"id":        session.ID,
+			"created":   session.CreatedAt,
+			"accessed":  session.AccessedAt,
+			"userAgent": session.UserAgent,
+			"ipAddress": session.IPAddress,
+			"current":   session.ID == currentSession.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"sessions": sessionsJson}))
+}
+
+func (controller *Controller) DeleteSessions(c *gin.Context) {
+	currentSession, err := repositories.GetSessionFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	deletedIDs, err := controller.stores.Sessions.DeleteOtherSessions(currentSession)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	controller.hub.RevokeSessions(currentSession.UserID, deletedIDs)
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"revoked": deletedIDs}))
+}
+
+func (controller *Controller) DeleteSession(c *gin.Context) {
+	currentSession, err := repositories.GetSessionFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	sessionIdParam, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound,
+			utils.AppError{"Session not found.", 1, nil})
+		return
+	}
+
+	err = controller.stores.Sessions.DeleteUserSession(&currentSession.User, sessionIdParam)
+	if errors.Is(err, models.ErrSessionNotFound) {
+		c.AbortWithError(http.StatusNotFound,
+			utils.AppError{"Session not found.", 1, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+	controller.hub.RevokeSessions(currentSession.UserID, []int{sessionIdParam})
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(nil))
+}
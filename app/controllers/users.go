@@ -9,16 +9,15 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator"
 	"github.com/nrmilstein/nchat/app/models"
-	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/chatServer"
 	"github.com/nrmilstein/nchat/utils"
-	"gorm.io/gorm"
 )
 
-func GetUser(c *gin.Context) {
+func (controller *Controller) GetUser(c *gin.Context) {
 	errUserNotFound := utils.AppError{"User not found.", 1, nil}
-	db := db.GetDb()
 
-	_, err := models.GetUserFromRequest(c)
+	requester, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
 	if err != nil {
 		utils.AbortErrForbidden(c)
 		return
@@ -31,12 +30,17 @@ func GetUser(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	response := db.Take(&user, models.User{Username: usernameParam})
-	if errors.Is(response.Error, gorm.ErrRecordNotFound) {
+	user, err := controller.stores.Users.GetUserByUsername(usernameParam)
+	if errors.Is(err, models.ErrUserNotFound) {
 		c.AbortWithError(http.StatusNotFound, errUserNotFound)
 		return
-	} else if response.Error != nil {
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	contactIDs, err := getContactIDSet(controller.stores.Users, requester)
+	if err != nil {
 		utils.AbortErrServer(c)
 		return
 	}
@@ -45,14 +49,120 @@ func GetUser(c *gin.Context) {
 		"id":       user.ID,
 		"username": user.Username,
 		"name":     user.Name,
+		"presence": nil,
+	}
+	if contactIDs[user.ID] {
+		userJson["presence"] = getPresenceJson(user, controller.hub)
 	}
 
 	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"user": userJson}))
 }
 
-func PostUsers(c *gin.Context) {
-	db := db.GetDb()
+func (controller *Controller) GetUsers(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	var params struct {
+		Query  string `form:"q"`
+		Offset int    `form:"offset"`
+		Limit  int    `form:"limit"`
+	}
+	err = c.ShouldBindQuery(&params)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Invalid search parameters.", 1, nil})
+		return
+	}
+
+	users, hasMore, err := controller.stores.Users.SearchUsers(user, params.Query, params.Offset, params.Limit)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	contactIDs, err := getContactIDSet(controller.stores.Users, user)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	usersJson := []gin.H{}
+	for _, user := range users {
+		userJson := gin.H{
+			"id":       user.ID,
+			"username": user.Username,
+			"name":     user.Name,
+			"presence": nil,
+		}
+		if contactIDs[user.ID] {
+			userJson["presence"] = getPresenceJson(&user, controller.hub)
+		}
+		usersJson = append(usersJson, userJson)
+	}
+
+	paginationJson := gin.H{"nextOffset": nil}
+	if hasMore {
+		paginationJson["nextOffset"] = params.Offset + len(users)
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{
+		"users":      usersJson,
+		"pagination": paginationJson,
+	}))
+}
+
+// PatchUser updates the requesting user's own settings.
+func (controller *Controller) PatchUser(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	if strings.ToLower(c.Param("username")) != user.Username {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	var params struct {
+		Discoverable *bool `json:"discoverable"`
+	}
+
+	err = c.ShouldBindJSON(&params)
+	switch err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"JSON syntax error.", 1, nil})
+		return
+	default:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Could not parse request body.", 3, nil})
+		return
+	}
+
+	if params.Discoverable != nil {
+		err = controller.stores.Users.SetDiscoverable(user, *params.Discoverable)
+		if err != nil {
+			utils.AbortErrServer(c)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{
+		"user": gin.H{
+			"id":           user.ID,
+			"username":     user.Username,
+			"name":         user.Name,
+			"discoverable": user.Discoverable,
+		},
+	}))
+}
 
+func (controller *Controller) PostUsers(c *gin.Context) {
 	var params struct {
 		Username string `json:"username" binding:"required"`
 		Password string `json:"password" binding:"required"`
@@ -85,32 +195,18 @@ func PostUsers(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	readUserResult := db.Take(&user, &models.User{Username: username})
-	if readUserResult.Error != gorm.ErrRecordNotFound {
-		if readUserResult.Error == nil {
-			c.AbortWithError(http.StatusConflict,
-				utils.AppError{"Username already registered.", 6, nil})
-			return
-		} else {
-			utils.AbortErrServer(c)
-			return
-		}
-	}
-
-	hashedPassword := models.HashPassword(password)
-
-	newUser := models.User{
-		Username: username,
-		Password: hashedPassword,
-		Name:     name,
-	}
-	createUserResult := db.Create(&newUser)
-	if createUserResult.Error != nil {
+	newUser, err := controller.stores.Users.CreateUser(username, password, name)
+	if errors.Is(err, models.ErrUsernameTaken) {
+		c.AbortWithError(http.StatusConflict,
+			utils.AppError{"Username already registered.", 6, nil})
+		return
+	} else if err != nil {
 		utils.AbortErrServer(c)
 		return
 	}
 
+	controller.hub.NotifyUserRegistered(newUser)
+
 	newUserJson := gin.H{
 		"id":       newUser.ID,
 		"username": newUser.Username,
@@ -118,3 +214,25 @@ func PostUsers(c *gin.Context) {
 	}
 	c.JSON(http.StatusCreated, utils.SuccessResponse(gin.H{"user": newUserJson}))
 }
+
+// getContactIDSet returns the users who share a conversation with user. Only
+// their presence is shown to user.
+func getContactIDSet(users repositories.UserStore, user *models.User) (map[int]bool, error) {
+	contactIDs, err := users.GetContactIDs(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	contactIDSet := map[int]bool{}
+	for _, contactID := range contactIDs {
+		contactIDSet[contactID] = true
+	}
+	return contactIDSet, nil
+}
+
+func getPresenceJson(user *models.User, hub *chatServer.Hub) gin.H {
+	status, lastSeen := hub.Presence(user)
+	return gin.H{
+		"status":   status,
+		"lastSeen": lastSeen,
+	}
+}
@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+// PostWebhooks registers a webhook. The response includes the secret used to
+// sign its payloads, which isn't shown again.
+func (controller *Controller) PostWebhooks(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	var params struct {
+		URL    string   `json:"url" binding:"required"`
+		Events []string `json:"events" binding:"required"`
+	}
+
+	err = c.ShouldBindJSON(&params)
+	switch err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"JSON syntax error.", 1, nil})
+		return
+	case validator.ValidationErrors:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Missing parameters.", 2, nil})
+		return
+	default:
+		c.AbortWithError(http.StatusBadRequest,
+			utils.AppError{"Could not parse request body.", 3, nil})
+		return
+	}
+
+	webhook, err := controller.stores.Webhooks.CreateWebhook(user, params.URL, params.Events)
+	if errors.Is(err, models.ErrInvalidWebhookURL) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{err.Error(), 4, nil})
+		return
+	} else if errors.Is(err, models.ErrNoWebhookEvents) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{err.Error(), 5, nil})
+		return
+	} else if errors.Is(err, models.ErrInvalidWebhookEvent) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{err.Error(), 6, nil})
+		return
+	} else if errors.Is(err, models.ErrWebhookEventNotAllowed) {
+		c.AbortWithError(http.StatusForbidden, utils.AppError{err.Error(), 7, nil})
+		return
+	} else if errors.Is(err, models.ErrTooManyWebhooks) {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{err.Error(), 8, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	webhookJson := getWebhookJson(webhook)
+	webhookJson["secret"] = webhook.Secret
+	c.JSON(http.StatusCreated, utils.SuccessResponse(gin.H{"webhook": webhookJson}))
+}
+
+func (controller *Controller) GetWebhooks(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	webhooks, err := controller.stores.Webhooks.GetWebhooks(user)
+	if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	webhooksJson := []gin.H{}
+	for _, webhook := range webhooks {
+		webhooksJson = append(webhooksJson, getWebhookJson(&webhook))
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"webhooks": webhooksJson}))
+}
+
+func (controller *Controller) DeleteWebhook(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	webhookId, ok := getWebhookIdParam(c)
+	if !ok {
+		return
+	}
+
+	err = controller.stores.Webhooks.DeleteWebhook(user, webhookId)
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Webhook not found.", 1, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{}))
+}
+
+// GetWebhookDeliveries lists a webhook's recent deliveries, optionally only
+// those with a given status.
+func (controller *Controller) GetWebhookDeliveries(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	webhookId, ok := getWebhookIdParam(c)
+	if !ok {
+		return
+	}
+
+	var params struct {
+		Status string `form:"status"`
+		Limit  int    `form:"limit"`
+	}
+	err = c.ShouldBindQuery(&params)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Invalid limit.", 2, nil})
+		return
+	}
+	switch params.Status {
+	case "", models.WebhookDeliveryPending, models.WebhookDeliverySucceeded, models.WebhookDeliveryDead:
+	default:
+		c.AbortWithError(http.StatusBadRequest, utils.AppError{"Invalid status.", 3, nil})
+		return
+	}
+
+	deliveries, err := controller.stores.Webhooks.GetWebhookDeliveries(user, webhookId, params.Status, params.Limit)
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Webhook not found.", 1, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	deliveriesJson := []gin.H{}
+	for _, delivery := range deliveries {
+		deliveriesJson = append(deliveriesJson, getWebhookDeliveryJson(&delivery))
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"deliveries": deliveriesJson}))
+}
+
+// PostWebhookRedelivery sends a delivery again, including one that is dead.
+func (controller *Controller) PostWebhookRedelivery(c *gin.Context) {
+	user, err := repositories.GetUserFromRequest(c, controller.stores.Sessions)
+	if err != nil {
+		utils.AbortErrForbidden(c)
+		return
+	}
+
+	webhookId, ok := getWebhookIdParam(c)
+	if !ok {
+		return
+	}
+
+	deliveryId, err := strconv.ParseInt(c.Param("deliveryId"), 10, 64)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Webhook delivery not found.", 2, nil})
+		return
+	}
+
+	delivery, err := controller.stores.Webhooks.RedeliverWebhookDelivery(user, webhookId, deliveryId)
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Webhook not found.", 1, nil})
+		return
+	} else if errors.Is(err, models.ErrWebhookDeliveryNotFound) {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Webhook delivery not found.", 2, nil})
+		return
+	} else if err != nil {
+		utils.AbortErrServer(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, utils.SuccessResponse(gin.H{"delivery": getWebhookDeliveryJson(delivery)}))
+}
+
+func getWebhookIdParam(c *gin.Context) (int, bool) {
+	webhookId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, utils.AppError{"Webhook not found.", 1, nil})
+		return 0, false
+	}
+	return webhookId, true
+}
+
+func getWebhookJson(webhook *models.Webhook) gin.H {
+	return gin.H{
+		"id":      webhook.ID,
+		"url":     webhook.URL,
+		"events":  webhook.Events,
+		"created": webhook.CreatedAt,
+	}
+}
+
+func getWebhookDeliveryJson(delivery *models.WebhookDelivery) gin.H {
+	return gin.H{
+		"id":             delivery.ID,
+		"event":          delivery.Event,
+		"payload":        json.RawMessage(delivery.Payload),
+		"status":         delivery.Status,
+		"attempts":       delivery.Attempts,
+		"nextAttempt":    delivery.NextAttemptAt,
+		"lastAttempt":    delivery.LastAttemptAt,
+		"responseStatus": delivery.ResponseStatus,
+		"lastError":      delivery.LastError,
+		"created":        delivery.CreatedAt,
+	}
+}
@@ -0,0 +1,46 @@
+package middlewares
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/nrmilstein/nchat/app/repositories"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+// RateLimitByIP limits how often each IP address may make requests.
+func RateLimitByIP(limiter *utils.RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowRequest(c, limiter, "ip:"+utils.ClientIP(c))
+	}
+}
+
+// RateLimitByUser limits how often each authenticated user may make requests,
+// across all of their sessions. Unauthenticated requests are limited by IP
+// address instead.
+func RateLimitByUser(limiter *utils.RateLimiter, sessions repositories.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := "ip:" + utils.ClientIP(c)
+		if c.GetHeader("X-API-Key") != "" {
+			user, err := repositories.GetUserFromRequest(c, sessions)
+			if err == nil {
+				key = "user:" + strconv.Itoa(user.ID)
+			}
+		}
+		allowRequest(c, limiter, key)
+	}
+}
+
+func allowRequest(c *gin.Context, limiter *utils.RateLimiter, key string) {
+	allowed, retryAfter := limiter.Allow(key)
+	if allowed {
+		c.Next()
+		return
+	}
+
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+	utils.AbortErrTooManyRequests(c)
+}
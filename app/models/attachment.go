@@ -0,0 +1,293 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/storage"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+)
+
+var ErrAttachmentNotFound = errors.New("Attachment not found.")
+var ErrAttachmentTooLarge = errors.New("Attachment is too large.")
+var ErrAttachmentTypeNotAllowed = errors.New("Attachment type is not allowed.")
+
+// MaxAttachmentSize is the largest file, in bytes, that may be uploaded.
+var MaxAttachmentSize int64 = 10 << 20
+
+// AllowedAttachmentTypes are the MIME types that may be uploaded, as detected
+// from the file contents rather than trusted from the client.
+var AllowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+}
+
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// UnattachedAttachmentTTL is how long an upload may go without being sent in
+// a message before it is deleted.
+const UnattachedAttachmentTTL = 24 * time.Hour
+
+type Attachment struct {
+	ID           int       `gorm:"primaryKey"`
+	UserID       int       `gorm:"not null;index"`
+	MessageID    *int      `gorm:"index"`
+	Key          string    `gorm:"not null"`
+	ThumbnailKey string    `gorm:"not null;default:''"`
+	Filename     string    `gorm:"not null"`
+	ContentType  string    `gorm:"not null"`
+	Size         int64     `gorm:"not null"`
+	Width        int       `gorm:"not null;default:0"`
+	Height       int       `gorm:"not null;default:0"`
+	CreatedAt    time.Time `gorm:"not null"`
+}
+
+// CreateAttachment stores an uploaded file, along with a thumbnail if it is
+// an image. The attachment belongs to user until it is sent in a message.
+func CreateAttachment(ctx context.Context, user *User, filename string, file io.ReadSeeker,
+	size int64) (*Attachment, error) {
+	attachment, err := UploadAttachment(ctx, user, filename, file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	db := db.GetDb()
+	result := db.Create(attachment)
+	if result.Error != nil {
+		DeleteAttachmentBlobs(ctx, attachment)
+		return nil, utils.NewGormError(result.Error)
+	}
+	return attachment, nil
+}
+
+// UploadAttachment checks an uploaded file and puts it in the blob store,
+// along with a thumbnail if it is an image. The returned attachment hasn't
+// been saved.
+func UploadAttachment(ctx context.Context, user *User, filename string, file io.ReadSeeker,
+	size int64) (*Attachment, error) {
+	if size > MaxAttachmentSize {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	contentType, err := detectContentType(file)
+	if err != nil {
+		return nil, err
+	}
+	if !AllowedAttachmentTypes[contentType] {
+		return nil, ErrAttachmentTypeNotAllowed
+	}
+
+	randBytes := make([]byte, 16)
+	_, err = rand.Read(randBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating attachment key: %w", err)
+	}
+
+	attachment := &Attachment{
+		UserID:      user.ID,
+		Key:         "attachments/" + hex.EncodeToString(randBytes),
+		Filename:    filepath.Base(filename),
+		ContentType: contentType,
+		Size:        size,
+	}
+
+	store := storage.GetStore()
+	err = store.Put(ctx, attachment.Key, io.LimitReader(file, size), size, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if thumbnailTypes[contentType] {
+		err = createThumbnail(ctx, attachment, file)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return attachment, nil
+}
+
+func detectContentType(file io.ReadSeeker) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(header[:n]))
+	if err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+func createThumbnail(ctx context.Context, attachment *Attachment, file io.ReadSeeker) error {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	thumbnail, width, height, err := makeThumbnail(file)
+	if err != nil {
+		return err
+	}
+
+	thumbnailKey := attachment.Key + "_thumbnail"
+	err = storage.GetStore().Put(ctx, thumbnailKey, bytes.NewReader(thumbnail),
+		int64(len(thumbnail)), "image/jpeg")
+	if err != nil {
+		return err
+	}
+
+	attachment.ThumbnailKey = thumbnailKey
+	attachment.Width = width
+	attachment.Height = height
+	return nil
+}
+
+// DeleteAttachmentBlobs deletes an attachment's file and thumbnail from the
+// blob store.
+func DeleteAttachmentBlobs(ctx context.Context, attachment *Attachment) {
+	store := storage.GetStore()
+
+	err := store.Delete(ctx, attachment.Key)
+	if err != nil {
+		log.Println(err)
+	}
+	if attachment.ThumbnailKey != "" {
+		err = store.Delete(ctx, attachment.ThumbnailKey)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// attachToMessage links attachments uploaded by sender to a new message. Each
+// attachment may only be sent once.
+func attachToMessage(tx *gorm.DB, sender *User, message *Message, attachmentIDs []int) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+
+	uniqueIDs := map[int]bool{}
+	for _, attachmentID := range attachmentIDs {
+		uniqueIDs[attachmentID] = true
+	}
+
+	result := tx.Model(&Attachment{}).
+		Where("id IN ? AND user_id = ? AND message_id IS NULL", attachmentIDs, sender.ID).
+		Update("message_id", message.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if int(result.RowsAffected) != len(uniqueIDs) {
+		return ErrAttachmentNotFound
+	}
+
+	result = tx.Where("message_id = ?", message.ID).Order("id ASC").Find(&message.Attachments)
+	return result.Error
+}
+
+// GetUserAttachment returns an attachment if user may download it: either
+// user uploaded it, or it was sent in a conversation that user belongs to.
+// Attachments of deleted messages can't be downloaded by anyone.
+func GetUserAttachment(user *User, attachmentID int) (*Attachment, error) {
+	db := db.GetDb()
+
+	var attachment Attachment
+	result := db.
+		Joins("LEFT JOIN messages ON messages.id = attachments.message_id").
+		Joins("LEFT JOIN conversation_users ON conversation_users.conversation_id = messages.conversation_id "+
+			"AND conversation_users.user_id = ?", user.ID).
+		Where("attachments.id = ?", attachmentID).
+		Where("attachments.user_id = ? OR conversation_users.user_id IS NOT NULL", user.ID).
+		Where("messages.deleted_at IS NULL").
+		Take(&attachment)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrAttachmentNotFound
+	} else if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return &attachment, nil
+}
+
+func (attachment *Attachment) Url() string {
+	return fmt.Sprintf("/api/v1/attachments/%d", attachment.ID)
+}
+
+// ThumbnailUrl returns the URL of the attachment's thumbnail, or "" if it has
+// none.
+func (attachment *Attachment) ThumbnailUrl() string {
+	if attachment.ThumbnailKey == "" {
+		return ""
+	}
+	return attachment.Url() + "/thumbnail"
+}
+
+// Open returns the attachment's contents, or its thumbnail if thumbnail is
+// set.
+func (attachment *Attachment) Open(ctx context.Context, thumbnail bool) (io.ReadCloser, error) {
+	key := attachment.Key
+	if thumbnail {
+		if attachment.ThumbnailKey == "" {
+			return nil, ErrAttachmentNotFound
+		}
+		key = attachment.ThumbnailKey
+	}
+
+	blob, err := storage.GetStore().Get(ctx, key)
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		return nil, ErrAttachmentNotFound
+	}
+	return blob, err
+}
+
+// PruneUnattachedAttachments deletes uploads that were never sent in a
+// message.
+func PruneUnattachedAttachments(ctx context.Context) error {
+	db := db.GetDb()
+
+	var attachments []Attachment
+	result := db.Where("message_id IS NULL AND created_at < ?", time.Now().Add(-UnattachedAttachmentTTL)).
+		Find(&attachments)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+
+	for _, attachment := range attachments {
+		// The attachment may have been sent since it was selected.
+		result := db.Where("message_id IS NULL").Delete(&Attachment{}, attachment.ID)
+		if result.Error != nil {
+			return utils.NewGormError(result.Error)
+		}
+		if result.RowsAffected == 1 {
+			DeleteAttachmentBlobs(ctx, &attachment)
+		}
+	}
+	return nil
+}
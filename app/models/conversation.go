@@ -1,37 +1,369 @@
 package models
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/nrmilstein/nchat/db"
 	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var ErrConversationNotFound = errors.New("Conversation not found.")
+var ErrNotGroupConversation = errors.New("Conversation is not a group conversation.")
+var ErrNotConversationMember = errors.New("User is not a member of the conversation.")
+var ErrNotConversationCreator = errors.New("Only the creator of a group can remove other members.")
+var ErrTooManyMembers = errors.New("Too many members in group conversation.")
+var ErrInvalidConversationCursor = errors.New("Invalid conversation cursor.")
 
+const MaxGroupMembers = 100
+const DefaultConversationPageSize = 50
+const MaxConversationPageSize = 100
+
+// Conversation is either a group conversation or a direct conversation
+// between two users. Direct conversations are keyed by the IDs of their two
+// members, lowest first, so that each pair of users has only one.
+// LastMessageID and LastActivityAt are updated whenever a message is sent, so
+// that conversations can be listed without looking at their messages. Created
+// is only set on a conversation returned by the call that created it.
 type Conversation struct {
-	ID        int    `gorm:"primaryKey,not null"`
-	Users     []User `gorm:"many2many:conversation_users;"`
-	Messages  []Message
-	CreatedAt time.Time `gorm:"not null"`
+	ID             int    `gorm:"primaryKey,not null"`
+	Title          string `gorm:"not null;default:''"`
+	IsGroup        bool   `gorm:"not null;default:false"`
+	CreatorID      int    `gorm:"not null;default:0"`
+	LowUserID      *int   `gorm:"uniqueIndex:idx_conversations_direct,priority:1"`
+	HighUserID     *int   `gorm:"uniqueIndex:idx_conversations_direct,priority:2"`
+	Users          []User `gorm:"many2many:conversation_users;"`
+	Messages       []Message
+	LastMessageID  *int
+	LastMessage    *Message  `gorm:"foreignKey:LastMessageID"`
+	LastActivityAt time.Time `gorm:"not null;default:now()"`
+	CreatedAt      time.Time `gorm:"not null"`
+	Created        bool      `gorm:"-"`
+}
+
+// ConversationPage is a page of a user's conversations, most recently active
+// first. NextCursor fetches the following page, or is "" if there are no more
+// conversations.
+type ConversationPage struct {
+	Conversations []Conversation
+	NextCursor    string
+}
+
+func (conversation *Conversation) HasMember(user *User) bool {
+	for _, member := range conversation.Users {
+		if member.ID == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (conversation *Conversation) MemberIDs() []int {
+	memberIDs := []int{}
+	for _, member := range conversation.Users {
+		memberIDs = append(memberIDs, member.ID)
+	}
+	return memberIDs
 }
 
-func GetConversation(sender *User, recipient *User) (*Conversation, error) {
+// GetUserConversations returns a page of the conversations that user belongs
+// to, with their members and last message preloaded. Conversations without
+// messages are ordered by when they were created. If cursor is not "", the
+// page starts after the conversation it was returned for.
+func GetUserConversations(user *User, cursor string, limit int) (*ConversationPage, error) {
+	if limit <= 0 {
+		limit = DefaultConversationPageSize
+	} else if limit > MaxConversationPageSize {
+		limit = MaxConversationPageSize
+	}
+
 	db := db.GetDb()
 
-	var senderConversations []Conversation
-	err := db.Model(&sender).Preload("Users", "ID = ?", recipient.ID).
-		Association("Conversations").Find(&senderConversations)
+	query := db.
+		Joins("JOIN conversation_users ON conversation_users.conversation_id = conversations.id "+
+			"AND conversation_users.user_id = ?", user.ID).
+		Preload("Users").
+		Preload("LastMessage").
+		Preload("LastMessage.Attachments", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id ASC")
+		}).
+		Preload("LastMessage.ReplyTo").
+		Order("conversations.last_activity_at DESC, conversations.id DESC").
+		Limit(limit + 1)
+
+	if cursor != "" {
+		lastActivityAt, id, err := DecodeConversationCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("(conversations.last_activity_at, conversations.id) < (?, ?)",
+			lastActivityAt, id)
+	}
+
+	conversations := []Conversation{}
+	result := query.Find(&conversations)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	page := &ConversationPage{Conversations: conversations}
+	if len(conversations) > limit {
+		page.Conversations = conversations[:limit]
+		page.NextCursor = EncodeConversationCursor(&page.Conversations[limit-1])
+	}
+	return page, nil
+}
+
+// EncodeConversationCursor returns the cursor for the page of conversations
+// following conversation.
+func EncodeConversationCursor(conversation *Conversation) string {
+	cursor := strconv.FormatInt(conversation.LastActivityAt.UnixNano(), 10) + ":" +
+		strconv.Itoa(conversation.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func DecodeConversationCursor(cursor string) (time.Time, int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
+		return time.Time{}, 0, ErrInvalidConversationCursor
+	}
+
+	var lastActivityAt int64
+	var id int
+	_, err = fmt.Sscanf(string(decoded), "%d:%d", &lastActivityAt, &id)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidConversationCursor
+	}
+	return time.Unix(0, lastActivityAt), id, nil
+}
+
+// GetDirectConversation returns the one-to-one conversation between sender
+// and recipient, with both users preloaded.
+func GetDirectConversation(sender *User, recipient *User) (*Conversation, error) {
+	db := db.GetDb()
+
+	conversation, err := getDirectConversation(db, sender, recipient)
+	if errors.Is(err, ErrConversationNotFound) {
+		return nil, err
+	} else if err != nil {
+		return nil, utils.NewGormError(err)
+	}
+	return conversation, nil
+}
+
+// DirectConversationKey returns the IDs of the members of a direct
+// conversation in the order they are stored in LowUserID and HighUserID.
+func DirectConversationKey(userID int, otherUserID int) (int, int) {
+	if userID < otherUserID {
+		return userID, otherUserID
+	}
+	return otherUserID, userID
+}
+
+func getDirectConversation(tx *gorm.DB, sender *User, recipient *User) (*Conversation, error) {
+	lowUserID, highUserID := DirectConversationKey(sender.ID, recipient.ID)
+
+	var conversation Conversation
+	err := tx.Where(&Conversation{LowUserID: &lowUserID, HighUserID: &highUserID}).
+		Preload("Users").
+		Take(&conversation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrConversationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// findOrCreateDirectConversation returns the direct conversation between
+// sender and recipient, creating it if it doesn't exist. If two transactions
+// try to create the same conversation at once, the unique key makes one wait
+// for the other and then use the conversation it created.
+func findOrCreateDirectConversation(tx *gorm.DB, sender *User, recipient *User) (*Conversation, error) {
+	lowUserID, highUserID := DirectConversationKey(sender.ID, recipient.ID)
+
+	conversation := &Conversation{
+		LowUserID:      &lowUserID,
+		HighUserID:     &highUserID,
+		LastActivityAt: time.Now(),
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(conversation)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return getDirectConversation(tx, sender, recipient)
+	}
+
+	result = tx.Exec("INSERT INTO conversation_users (conversation_id, user_id) VALUES (?, ?), (?, ?)",
+		conversation.ID, sender.ID, conversation.ID, recipient.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	conversation.Users = []User{*sender, *recipient}
+	conversation.Created = true
+	return conversation, nil
+}
+
+// GetUserConversation returns the conversation with the given ID, with its
+// members preloaded, if user is one of its members.
+func GetUserConversation(user *User, conversationID int) (*Conversation, error) {
+	db := db.GetDb()
+
+	var conversation Conversation
+	err := db.
+		Joins("JOIN conversation_users ON conversation_users.conversation_id = conversations.id").
+		Where("conversation_users.user_id = ? AND conversations.id = ?", user.ID, conversationID).
+		Preload("Users").
+		Take(&conversation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrConversationNotFound
+	} else if err != nil {
 		return nil, utils.NewGormError(err)
 	}
+	return &conversation, nil
+}
+
+// CreateGroupConversation creates a group conversation owned by creator. The
+// creator is always a member, even if not included in members.
+func CreateGroupConversation(creator *User, title string, members []User) (*Conversation, error) {
+	db := db.GetDb()
 
-	for _, conversation := range senderConversations {
-		if len(conversation.Users) == 1 {
-			return &conversation, nil
+	conversation := &Conversation{
+		Title:          title,
+		IsGroup:        true,
+		CreatorID:      creator.ID,
+		Users:          []User{*creator},
+		LastActivityAt: time.Now(),
+	}
+	for _, member := range members {
+		if !conversation.HasMember(&member) {
+			conversation.Users = append(conversation.Users, member)
 		}
 	}
+	if len(conversation.Users) > MaxGroupMembers {
+		return nil, ErrTooManyMembers
+	}
+
+	result := db.Omit("Users.*").Create(conversation)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	conversation.Created = true
+	return conversation, nil
+}
+
+// AddMembers adds users to a group conversation. Users that are already
+// members are ignored.
+func (conversation *Conversation) AddMembers(members []User) error {
+	if !conversation.IsGroup {
+		return ErrNotGroupConversation
+	}
+	db := db.GetDb()
+
+	// The members are read from the database with the conversation locked,
+	// so that concurrent additions can't each pass the size check against
+	// the members before the other's.
+	newMembers := []User{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var locked Conversation
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(&locked, conversation.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var memberIDs []int
+		result = tx.Raw("SELECT user_id FROM conversation_users WHERE conversation_id = ?",
+			conversation.ID).Scan(&memberIDs)
+		if result.Error != nil {
+			return result.Error
+		}
+		isMember := map[int]bool{}
+		for _, memberID := range memberIDs {
+			isMember[memberID] = true
+		}
 
-	return nil, ErrConversationNotFound
+		for _, member := range members {
+			if !isMember[member.ID] {
+				isMember[member.ID] = true
+				newMembers = append(newMembers, member)
+			}
+		}
+		if len(newMembers) == 0 {
+			return nil
+		}
+		if len(memberIDs)+len(newMembers) > MaxGroupMembers {
+			return ErrTooManyMembers
+		}
+
+		return tx.Model(conversation).Omit("Users.*").Association("Users").Append(newMembers)
+	})
+	if errors.Is(err, ErrTooManyMembers) {
+		return err
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrConversationNotFound
+	} else if err != nil {
+		return utils.NewGormError(err)
+	}
+	return nil
+}
+
+// RemoveMember removes member from a group conversation on behalf of actor.
+// Any member may remove themselves, but only the group's creator may remove
+// someone else. When the creator leaves, the member who has been in the group
+// the longest becomes its creator. When the last member leaves, the group is
+// left without a creator.
+func (conversation *Conversation) RemoveMember(actor *User, member *User) error {
+	if !conversation.IsGroup {
+		return ErrNotGroupConversation
+	}
+	if !conversation.HasMember(member) {
+		return ErrNotConversationMember
+	}
+	if actor.ID != member.ID && actor.ID != conversation.CreatorID {
+		return ErrNotConversationCreator
+	}
+	db := db.GetDb()
+
+	creatorID := conversation.CreatorID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM conversation_users WHERE conversation_id = ? AND user_id = ?",
+			conversation.ID, member.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if member.ID != conversation.CreatorID {
+			return nil
+		}
+
+		var newCreatorIDs []int
+		result = tx.Raw(`SELECT user_id FROM conversation_users WHERE conversation_id = ?
+			ORDER BY joined_at, user_id LIMIT 1`, conversation.ID).Scan(&newCreatorIDs)
+		if result.Error != nil {
+			return result.Error
+		}
+		creatorID = 0
+		if len(newCreatorIDs) > 0 {
+			creatorID = newCreatorIDs[0]
+		}
+		return tx.Model(conversation).Update("creator_id", creatorID).Error
+	})
+	if err != nil {
+		return utils.NewGormError(err)
+	}
+
+	users := []User{}
+	for _, user := range conversation.Users {
+		if user.ID != member.ID {
+			users = append(users, user)
+		}
+	}
+	conversation.Users = users
+	conversation.CreatorID = creatorID
+	return nil
 }
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+)
+
+// LoginAttempt records an attempt to log in, whether or not it succeeded.
+// Attempts are used to slow down password guessing, and users can review the
+// attempts made on their account.
+type LoginAttempt struct {
+	ID        int       `gorm:"primaryKey"`
+	Username  string    `gorm:"not null;index:idx_login_attempts_username,priority:1"`
+	UserID    *int      `gorm:"index"`
+	IPAddress string    `gorm:"not null;default:'';index:idx_login_attempts_ip_address,priority:1"`
+	UserAgent string    `gorm:"not null;default:''"`
+	Success   bool      `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index:idx_login_attempts_username,priority:2;index:idx_login_attempts_ip_address,priority:2"`
+}
+
+var ErrLoginBackoff = errors.New("Too many failed login attempts. Wait before trying again.")
+var ErrAccountLocked = errors.New("Account temporarily locked after too many failed login attempts.")
+var ErrIPLocked = errors.New("Too many failed login attempts from this IP address. Wait before trying again.")
+
+// LoginThrottledError is returned instead of checking the password when
+// there have been too many failed login attempts. Err is ErrLoginBackoff,
+// ErrAccountLocked or ErrIPLocked.
+type LoginThrottledError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (err *LoginThrottledError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *LoginThrottledError) Unwrap() error {
+	return err.Err
+}
+
+// After LoginBackoffThreshold consecutive failed attempts on a username,
+// each further attempt must wait twice as long as the last, up to
+// MaxLoginBackoff. After LoginLockoutThreshold failures the username is
+// locked for LoginLockoutDuration. IP addresses are locked after
+// LoginIPLockoutThreshold failures across all usernames. Only failures within
+// LoginAttemptWindow count.
+var LoginBackoffThreshold = 3
+var LoginLockoutThreshold = 10
+var LoginIPLockoutThreshold = 30
+var LoginAttemptWindow = 15 * time.Minute
+var LoginLockoutDuration = 15 * time.Minute
+var MaxLoginBackoff = 5 * time.Minute
+
+// LoginAttemptRetention is how long login attempts are kept.
+var LoginAttemptRetention = 90 * 24 * time.Hour
+
+const MaxLoginAttemptsPageSize = 100
+
+// Login attempts are serialized with Postgres advisory locks on the username
+// and the IP address, in separate key spaces.
+const (
+	loginUsernameLockSpace = 4328702
+	loginIPLockSpace       = 4328703
+)
+
+// LoginFailures counts recent failed login attempts.
+type LoginFailures struct {
+	Failures    int
+	LastFailure *time.Time
+}
+
+// lockLoginAttempts waits for other login attempts on the username or from
+// the IP address to finish. The locks are held until tx ends. They are always
+// taken in the same order, so two attempts can't deadlock.
+func lockLoginAttempts(tx *gorm.DB, username string, ipAddress string) error {
+	result := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", loginUsernameLockSpace, username)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	result = tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", loginIPLockSpace, ipAddress)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
+}
+
+// checkLoginThrottle returns a LoginThrottledError if a login attempt for
+// username from ipAddress must not be checked yet.
+func checkLoginThrottle(db *gorm.DB, username string, ipAddress string) error {
+	now := time.Now()
+	windowStart := now.Add(-LoginAttemptWindow)
+
+	var ipFailures LoginFailures
+	result := db.Raw(`
+		SELECT COUNT(*) AS failures, MAX(created_at) AS last_failure
+		FROM login_attempts
+		WHERE ip_address = ? AND NOT success AND created_at > ?`,
+		ipAddress, windowStart).Scan(&ipFailures)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+
+	// Failures before the last successful login don't count.
+	var usernameFailures LoginFailures
+	result = db.Raw(`
+		SELECT COUNT(*) AS failures, MAX(created_at) AS last_failure
+		FROM login_attempts
+		WHERE username = ? AND NOT success AND created_at > ?
+			AND created_at > COALESCE(
+				(SELECT MAX(created_at) FROM login_attempts WHERE username = ? AND success),
+				'-infinity')`,
+		username, windowStart, username).Scan(&usernameFailures)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return ThrottleLogin(ipFailures, usernameFailures, now)
+}
+
+// ThrottleLogin returns a LoginThrottledError if, given the recent failures
+// from an IP address and for a username, a login attempt must not be checked
+// yet.
+func ThrottleLogin(ipFailures LoginFailures, usernameFailures LoginFailures, now time.Time) error {
+	if ipFailures.LastFailure != nil && ipFailures.Failures >= LoginIPLockoutThreshold {
+		return newLoginThrottledError(ErrIPLocked, ipFailures.LastFailure.Add(LoginLockoutDuration), now)
+	}
+
+	failures := usernameFailures.Failures
+	if usernameFailures.LastFailure == nil {
+		return nil
+	}
+	if failures >= LoginLockoutThreshold {
+		return newLoginThrottledError(ErrAccountLocked, usernameFailures.LastFailure.Add(LoginLockoutDuration), now)
+	}
+	if failures >= LoginBackoffThreshold {
+		backoff := MaxLoginBackoff
+		if shift := failures - LoginBackoffThreshold; shift < 32 {
+			backoff = time.Second << uint(shift)
+			if backoff > MaxLoginBackoff {
+				backoff = MaxLoginBackoff
+			}
+		}
+		return newLoginThrottledError(ErrLoginBackoff, usernameFailures.LastFailure.Add(backoff), now)
+	}
+	return nil
+}
+
+// newLoginThrottledError returns an error if until is still in the future.
+func newLoginThrottledError(err error, until time.Time, now time.Time) error {
+	if !until.After(now) {
+		return nil
+	}
+	return &LoginThrottledError{Err: err, RetryAfter: until.Sub(now)}
+}
+
+func recordLoginAttempt(db *gorm.DB, username string, user *User, ipAddress string, userAgent string,
+	success bool) error {
+	attempt := &LoginAttempt{
+		Username:  username,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		Success:   success,
+	}
+	if user != nil {
+		attempt.UserID = &user.ID
+	}
+	result := db.Create(attempt)
+	if result.Error != nil {
+		return fmt.Errorf("Error recording login attempt: %w", utils.NewGormError(result.Error))
+	}
+	return nil
+}
+
+// GetLoginAttempts returns the most recent login attempts on a user's
+// account, newest first.
+func GetLoginAttempts(user *User, limit int) ([]LoginAttempt, error) {
+	if limit <= 0 || limit > MaxLoginAttemptsPageSize {
+		limit = MaxLoginAttemptsPageSize
+	}
+	db := db.GetDb()
+
+	attempts := []LoginAttempt{}
+	result := db.Where(&LoginAttempt{UserID: &user.ID}).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&attempts)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return attempts, nil
+}
+
+// PruneLoginAttempts deletes login attempts older than the retention period.
+func PruneLoginAttempts() error {
+	db := db.GetDb()
+
+	result := db.Where("created_at < ?", time.Now().Add(-LoginAttemptRetention)).Delete(&LoginAttempt{})
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
+}
@@ -2,63 +2,422 @@ package models
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/nrmilstein/nchat/db"
 	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Message struct {
-	ID             int       `gorm:"primaryKey,not null"`
+	ID             int       `gorm:"primaryKey,not null;index:idx_messages_history,priority:3"`
 	UserID         int       `gorm:"not null"`
-	ConversationID int       `gorm:"not null"`
+	ConversationID int       `gorm:"not null;index:idx_messages_history,priority:1"`
 	Body           string    `gorm:"not null"`
-	CreatedAt      time.Time `gorm:"not null"`
+	CreatedAt      time.Time `gorm:"not null;index:idx_messages_history,priority:2"`
+	EditedAt       *time.Time
+	DeletedAt      *time.Time
+	ReplyToID      *int     `gorm:"index"`
+	ReplyTo        *Message `gorm:"foreignKey:ReplyToID"`
+	Revisions      []MessageRevision
+	Attachments    []Attachment
+}
+
+// MessageRevision keeps the previous body of a message each time it is
+// edited or deleted.
+type MessageRevision struct {
+	ID        int       `gorm:"primaryKey"`
+	MessageID int       `gorm:"not null;index"`
+	Body      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
 }
 
-var ErrTooManyConversations = errors.New("Too many conversations found between given users.")
 var ErrSameUser = errors.New("Cannot send message to self.")
+var ErrMessageNotFound = errors.New("Message not found.")
+var ErrInvalidPageCursor = errors.New("Only one of before and after may be given.")
+var ErrNotMessageSender = errors.New("Only the sender of a message can change it.")
+var ErrMessageDeleted = errors.New("Message has been deleted.")
+var ErrEmptyMessageBody = errors.New("Message body cannot be empty.")
+var ErrInvalidReply = errors.New("Can only reply to a message in the same conversation.")
+
+const DefaultMessagePageSize = 50
+const MaxMessagePageSize = 200
+const MaxThreadSize = 500
+
+// messagePreviewLength is the number of characters of a message's body that
+// are quoted when it is replied to.
+const messagePreviewLength = 100
+
+// MessagePage is a window of a conversation's messages, oldest first.
+// PrevCursor and NextCursor are the message IDs to pass as before and after
+// to fetch the adjacent pages, or 0 if there are no more messages in that
+// direction.
+type MessagePage struct {
+	Messages   []Message
+	PrevCursor int
+	NextCursor int
+}
+
+// MessageOptions are the optional parts of a new message. If ReplyToID is not
+// 0, the message is a reply to that message, which must be in the same
+// conversation. Any attachments must have been uploaded by the sender and not
+// yet sent.
+type MessageOptions struct {
+	ReplyToID     int
+	AttachmentIDs []int
+}
 
-func CreateMessage(sender *User, recipient *User, body string) (*Message, *Conversation, error) {
+// CreateMessage sends a message from sender to recipient in their direct
+// conversation, creating the conversation in the same transaction if it
+// doesn't exist yet.
+func CreateMessage(sender *User, recipient *User, body string,
+	options MessageOptions) (*Message, *Conversation, error) {
 	if sender.ID == recipient.ID {
 		return nil, nil, ErrSameUser
 	}
 
 	db := db.GetDb()
 
-	conversation, err := GetConversation(sender, recipient)
-	if !errors.Is(err, ErrConversationNotFound) && err != nil {
+	newMessage := &Message{
+		UserID: sender.ID,
+		Body:   body,
+	}
+	if options.ReplyToID != 0 {
+		newMessage.ReplyToID = &options.ReplyToID
+	}
+
+	var conversation *Conversation
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		conversation, err = findOrCreateDirectConversation(tx, sender, recipient)
+		if err != nil {
+			return err
+		}
+
+		newMessage.ConversationID = conversation.ID
+		return createMessage(tx, sender, newMessage, options.AttachmentIDs)
+	})
+	if errors.Is(err, ErrAttachmentNotFound) || errors.Is(err, ErrInvalidReply) {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, utils.NewGormError(err)
+	}
+	return newMessage, conversation, nil
+}
+
+// CreateConversationMessage sends a message from sender to an existing
+// conversation that sender is a member of.
+func CreateConversationMessage(sender *User, conversationID int, body string,
+	options MessageOptions) (*Message, *Conversation, error) {
+	db := db.GetDb()
+
+	conversation, err := GetUserConversation(sender, conversationID)
+	if err != nil {
 		return nil, nil, err
 	}
 
 	newMessage := &Message{
-		UserID: sender.ID,
-		Body:   body,
+		UserID:         sender.ID,
+		ConversationID: conversation.ID,
+		Body:           body,
 	}
+	if options.ReplyToID != 0 {
+		newMessage.ReplyToID = &options.ReplyToID
+	}
+	err = createMessage(db, sender, newMessage, options.AttachmentIDs)
+	if errors.Is(err, ErrAttachmentNotFound) || errors.Is(err, ErrInvalidReply) {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, utils.NewGormError(err)
+	}
+	return newMessage, conversation, nil
+}
 
-	if errors.Is(err, ErrConversationNotFound) {
-		newConversation := &Conversation{
-			Users: []User{
-				*sender,
-				*recipient,
-			},
-			Messages: []Message{
-				*newMessage,
-			},
+func createMessage(db *gorm.DB, sender *User, message *Message, attachmentIDs []int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var replyTo *Message
+		if message.ReplyToID != nil {
+			replyTo = &Message{}
+			result := tx.Take(replyTo, &Message{ID: *message.ReplyToID, ConversationID: message.ConversationID})
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				return ErrInvalidReply
+			} else if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		result := tx.Create(message)
+		if result.Error != nil {
+			return result.Error
 		}
+		message.ReplyTo = replyTo
 
-		result := db.Omit("Users.*").Create(newConversation)
+		result = tx.Model(&Conversation{ID: message.ConversationID}).
+			Where("last_activity_at <= ?", message.CreatedAt).
+			Updates(map[string]interface{}{
+				"last_message_id":  message.ID,
+				"last_activity_at": message.CreatedAt,
+			})
 		if result.Error != nil {
-			return nil, nil, utils.NewGormError(result.Error)
+			return result.Error
+		}
+		return attachToMessage(tx, sender, message, attachmentIDs)
+	})
+}
+
+// Preview returns the start of the message's body, for quoting it in replies.
+func (message *Message) Preview() string {
+	body := []rune(message.Body)
+	if len(body) <= messagePreviewLength {
+		return message.Body
+	}
+	return strings.TrimSpace(string(body[:messagePreviewLength])) + "…"
+}
+
+// GetMessagePage returns up to limit messages from a conversation. If
+// beforeID is given, the messages immediately preceding that message are
+// returned; if afterID is given, the messages immediately following it.
+// Otherwise, the most recent messages are returned.
+func GetMessagePage(conversationID int, beforeID int, afterID int, limit int) (*MessagePage, error) {
+	if beforeID != 0 && afterID != 0 {
+		return nil, ErrInvalidPageCursor
+	}
+	if limit <= 0 {
+		limit = DefaultMessagePageSize
+	} else if limit > MaxMessagePageSize {
+		limit = MaxMessagePageSize
+	}
+
+	db := db.GetDb()
+
+	query := db.Where("conversation_id = ?", conversationID).
+		Preload("Attachments", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id ASC")
+		}).
+		Preload("ReplyTo").
+		Limit(limit + 1)
+
+	cursorID := beforeID
+	if afterID != 0 {
+		cursorID = afterID
+	}
+	if cursorID != 0 {
+		var cursor Message
+		result := db.Take(&cursor, &Message{ID: cursorID, ConversationID: conversationID})
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		} else if result.Error != nil {
+			return nil, utils.NewGormError(result.Error)
+		}
+
+		if afterID != 0 {
+			query = query.Where("(created_at, id) > (?, ?)", cursor.CreatedAt, cursor.ID)
+		} else {
+			query = query.Where("(created_at, id) < (?, ?)", cursor.CreatedAt, cursor.ID)
 		}
+	}
 
-		conversation = newConversation
-		newMessage = &newConversation.Messages[0]
+	if afterID != 0 {
+		query = query.Order("created_at ASC, id ASC")
 	} else {
-		err := db.Model(conversation).Association("Messages").Append(newMessage)
-		if err != nil {
-			return nil, nil, utils.NewGormError(err)
+		query = query.Order("created_at DESC, id DESC")
+	}
+
+	var messages []Message
+	result := query.Find(&messages)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if afterID == 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
 		}
 	}
-	return newMessage, conversation, nil
+
+	page := &MessagePage{Messages: messages}
+	if len(messages) == 0 {
+		return page, nil
+	}
+	oldestID, newestID := messages[0].ID, messages[len(messages)-1].ID
+	if afterID != 0 {
+		page.PrevCursor = oldestID
+		if hasMore {
+			page.NextCursor = newestID
+		}
+	} else {
+		if hasMore {
+			page.PrevCursor = oldestID
+		}
+		if beforeID != 0 {
+			page.NextCursor = newestID
+		}
+	}
+	return page, nil
+}
+
+// GetUserMessage returns the message with the given ID, along with its
+// conversation, if user is a member of that conversation.
+func GetUserMessage(user *User, messageID int) (*Message, *Conversation, error) {
+	db := db.GetDb()
+
+	var message Message
+	result := db.Preload("ReplyTo").Take(&message, messageID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrMessageNotFound
+	} else if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+
+	conversation, err := GetUserConversation(user, message.ConversationID)
+	if errors.Is(err, ErrConversationNotFound) {
+		return nil, nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return &message, conversation, nil
+}
+
+// EditMessage replaces the body of a message sent by user, keeping the
+// previous body as a revision.
+func EditMessage(user *User, messageID int, body string) (*Message, *Conversation, error) {
+	if strings.TrimSpace(body) == "" {
+		return nil, nil, ErrEmptyMessageBody
+	}
+
+	now := time.Now()
+	message, conversation, err := reviseMessage(user, messageID, map[string]interface{}{
+		"body":      body,
+		"edited_at": now,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message.Body = body
+	message.EditedAt = &now
+	return message, conversation, nil
+}
+
+// DeleteMessage blanks the body of a message sent by user and marks it as
+// deleted, keeping the previous body as a revision.
+func DeleteMessage(user *User, messageID int) (*Message, *Conversation, error) {
+	now := time.Now()
+	message, conversation, err := reviseMessage(user, messageID, map[string]interface{}{
+		"body":       "",
+		"deleted_at": now,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message.Body = ""
+	message.DeletedAt = &now
+	return message, conversation, nil
+}
+
+// reviseMessage applies updates to a message that user sent and hasn't
+// deleted, recording its previous body as a revision. The message is locked
+// while it is checked and updated, so that concurrent edits each record the
+// body they replaced, and an edit can't bring back a deleted message.
+func reviseMessage(user *User, messageID int, updates map[string]interface{}) (*Message, *Conversation, error) {
+	message, conversation, err := GetUserMessage(user, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db := db.GetDb()
+
+	var errRevision error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var locked Message
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(&locked, message.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if locked.UserID != user.ID {
+			errRevision = ErrNotMessageSender
+			return errRevision
+		}
+		if locked.DeletedAt != nil {
+			errRevision = ErrMessageDeleted
+			return errRevision
+		}
+
+		revision := &MessageRevision{
+			MessageID: locked.ID,
+			Body:      locked.Body,
+		}
+		result = tx.Create(revision)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Model(&Message{ID: locked.ID}).Where("deleted_at IS NULL").Updates(updates)
+		return result.Error
+	})
+	if errRevision != nil {
+		return nil, nil, errRevision
+	} else if err != nil {
+		return nil, nil, utils.NewGormError(err)
+	}
+	return message, conversation, nil
+}
+
+// GetMessageRevisions returns the previous bodies of a message sent by user,
+// oldest first.
+func GetMessageRevisions(user *User, messageID int) ([]MessageRevision, error) {
+	db := db.GetDb()
+
+	message, _, err := GetUserMessage(user, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserID != user.ID {
+		return nil, ErrNotMessageSender
+	}
+
+	revisions := []MessageRevision{}
+	result := db.Where(&MessageRevision{MessageID: message.ID}).Order("created_at ASC").Find(&revisions)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return revisions, nil
+}
+
+// GetMessageThread returns a message along with its replies, oldest first, if
+// user is a member of the message's conversation.
+func GetMessageThread(user *User, messageID int) (*Message, []Message, error) {
+	db := db.GetDb()
+
+	message, _, err := GetUserMessage(user, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := db.Where(&Attachment{MessageID: &message.ID}).Order("id ASC").Find(&message.Attachments)
+	if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+
+	replies := []Message{}
+	result = db.Where(&Message{ReplyToID: &message.ID}).
+		Preload("Attachments", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id ASC")
+		}).
+		Order("created_at ASC, id ASC").
+		Limit(MaxThreadSize).
+		Find(&replies)
+	if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+	for i := range replies {
+		replies[i].ReplyTo = message
+	}
+	return message, replies, nil
 }
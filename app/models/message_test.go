@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrmilstein/nchat/db"
+)
+
+// initTestDb connects to the database in TEST_DATABASE_URL and migrates it,
+// or skips the test if it isn't set.
+func initTestDb(t *testing.T) {
+	databaseUrl := os.Getenv("TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("TEST_DATABASE_URL is not set.")
+	}
+	if db.GetDb() == nil {
+		db.InitDb(databaseUrl)
+	}
+	_, err := db.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentFirstMessagesShareConversation(t *testing.T) {
+	initTestDb(t)
+
+	suffix := time.Now().UnixNano()
+	alice, err := CreateUser(fmt.Sprintf("alice_%d", suffix), "password", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := CreateUser(fmt.Sprintf("bob_%d", suffix), "password", "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const senders = 20
+	start := make(chan struct{})
+	errs := make(chan error, senders)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sender, recipient := alice, bob
+		if i%2 == 1 {
+			sender, recipient = bob, alice
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, _, err := CreateMessage(sender, recipient, fmt.Sprintf("message %d", i), MessageOptions{})
+			errs <- err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	lowUserID, highUserID := DirectConversationKey(alice.ID, bob.ID)
+	var conversationIDs []int
+	result := db.GetDb().Raw(`SELECT id FROM conversations WHERE low_user_id = ? AND high_user_id = ?`,
+		lowUserID, highUserID).Scan(&conversationIDs)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if len(conversationIDs) != 1 {
+		t.Fatalf("Found %d conversations between the users, want 1", len(conversationIDs))
+	}
+
+	var messageCount int64
+	result = db.GetDb().Model(&Message{}).Where("conversation_id = ?", conversationIDs[0]).Count(&messageCount)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if messageCount != senders {
+		t.Errorf("Found %d messages in the conversation, want %d", messageCount, senders)
+	}
+}
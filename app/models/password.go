@@ -0,0 +1,219 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("Unknown password hash format.")
+
+// PasswordHasher hashes and verifies passwords stored in a self-describing
+// format, so the algorithm and its parameters can change over time.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, hash string) (bool, error)
+	// Identifies reports whether hash was produced by this hasher.
+	Identifies(hash string) bool
+	// NeedsRehash reports whether hash was produced with weaker parameters
+	// than the hasher currently uses.
+	NeedsRehash(hash string) bool
+}
+
+// DefaultHasher is used for all newly hashed passwords.
+var DefaultHasher PasswordHasher = NewArgon2idHasher()
+
+// passwordHashers are tried in order when verifying a stored hash.
+var passwordHashers = []PasswordHasher{
+	DefaultHasher,
+	NewBcryptHasher(),
+	sha256Hasher{},
+}
+
+func HashPassword(password string) (string, error) {
+	return DefaultHasher.Hash(password)
+}
+
+// VerifyPassword checks password against a stored hash in constant time. If
+// the password matches but the hash should be upgraded to DefaultHasher,
+// needsRehash is true. A hash that can't be read never matches, so that one
+// bad row can't stop the user from getting an invalid credentials error.
+func VerifyPassword(password string, hash string) (ok bool, needsRehash bool) {
+	for _, hasher := range passwordHashers {
+		if !hasher.Identifies(hash) {
+			continue
+		}
+		ok, err := hasher.Verify(password, hash)
+		if err != nil {
+			log.Println("Error verifying password:", err)
+			return false, false
+		}
+		if !ok {
+			return false, false
+		}
+		needsRehash := hasher != DefaultHasher || hasher.NeedsRehash(hash)
+		return true, needsRehash
+	}
+	log.Println("Error verifying password:", ErrUnknownHashFormat)
+	return false, false
+}
+
+// dummyPasswordHash is verified against when no user exists, so that failed
+// logins take the same time whether or not the username is registered.
+var dummyPasswordHash, _ = HashPassword("nchat-dummy-password")
+
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    1,
+		Memory:  64 * 1024,
+		Threads: 4,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("Error generating password salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(password string, hash string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+	otherKey := argon2.IDKey([]byte(password), salt,
+		params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (h *Argon2idHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time < h.Time || params.Memory < h.Memory || params.Threads < h.Threads ||
+		uint32(len(salt)) < h.SaltLen || uint32(len(key)) < h.KeyLen
+}
+
+func decodeArgon2idHash(hash string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	params := &Argon2idHasher{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	encoding := base64.RawStdEncoding
+	salt, err := encoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := encoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+	return params, salt, key, nil
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: 12}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(password string, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.Cost
+}
+
+// sha256Hasher verifies the unsalted hex SHA-256 hashes created before
+// passwords were salted. It is never used to hash new passwords.
+type sha256Hasher struct{}
+
+func (sha256Hasher) Hash(password string) (string, error) {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(password))), nil
+}
+
+func (h sha256Hasher) Verify(password string, hash string) (bool, error) {
+	otherHash, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(otherHash)) == 1, nil
+}
+
+func (sha256Hasher) Identifies(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range hash {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sha256Hasher) NeedsRehash(hash string) bool {
+	return true
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm/clause"
+)
+
+// Reaction is an emoji that a user has reacted to a message with. A user may
+// react to the same message with several different emoji, but only once with
+// each.
+type Reaction struct {
+	MessageID int       `gorm:"primaryKey;autoIncrement:false"`
+	UserID    int       `gorm:"primaryKey;autoIncrement:false"`
+	Emoji     string    `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// ReactionCount is the number of users that reacted to a message with an
+// emoji. Reacted is whether the user the counts were loaded for is one of
+// them.
+type ReactionCount struct {
+	MessageID int
+	Emoji     string
+	Count     int
+	Reacted   bool
+}
+
+var ErrInvalidEmoji = errors.New("Reaction must be a single emoji.")
+var ErrDuplicateReaction = errors.New("User has already reacted with this emoji.")
+var ErrReactionNotFound = errors.New("Reaction not found.")
+
+const maxEmojiBytes = 64
+
+// ValidEmoji loosely checks that a reaction is an emoji: it must contain a
+// symbol and no letters, whitespace or control characters. Emoji made up of
+// several code points, like flags and skin tone variants, are allowed.
+func ValidEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	hasSymbol := false
+	for _, r := range emoji {
+		if unicode.IsLetter(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		if unicode.Is(unicode.So, r) {
+			hasSymbol = true
+		}
+	}
+	return hasSymbol
+}
+
+// AddReaction reacts to a message on behalf of user, who must be a member of
+// the message's conversation.
+func AddReaction(user *User, messageID int, emoji string) (*Reaction, *Conversation, error) {
+	if !ValidEmoji(emoji) {
+		return nil, nil, ErrInvalidEmoji
+	}
+	db := db.GetDb()
+
+	message, conversation, err := GetUserMessage(user, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if message.DeletedAt != nil {
+		return nil, nil, ErrMessageDeleted
+	}
+
+	reaction := &Reaction{
+		MessageID: message.ID,
+		UserID:    user.ID,
+		Emoji:     emoji,
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(reaction)
+	if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil, ErrDuplicateReaction
+	}
+	return reaction, conversation, nil
+}
+
+// RemoveReaction undoes one of user's reactions to a message.
+func RemoveReaction(user *User, messageID int, emoji string) (*Reaction, *Conversation, error) {
+	db := db.GetDb()
+
+	message, conversation, err := GetUserMessage(user, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reaction := &Reaction{
+		MessageID: message.ID,
+		UserID:    user.ID,
+		Emoji:     emoji,
+	}
+	result := db.Where(reaction).Delete(&Reaction{})
+	if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil, ErrReactionNotFound
+	}
+	return reaction, conversation, nil
+}
+
+// GetReactionCounts returns the reaction counts for the given messages, keyed
+// by message ID. Each message's counts are ordered by when the emoji was
+// first used.
+func GetReactionCounts(user *User, messageIDs []int) (map[int][]ReactionCount, error) {
+	reactionCounts := make(map[int][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return reactionCounts, nil
+	}
+	db := db.GetDb()
+
+	var counts []ReactionCount
+	result := db.Raw(`
+		SELECT message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS reacted
+		FROM reactions
+		WHERE message_id IN ?
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji`, user.ID, messageIDs).Scan(&counts)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	for _, count := range counts {
+		reactionCounts[count.MessageID] = append(reactionCounts[count.MessageID], count)
+	}
+	return reactionCounts, nil
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReadMarker records the last message in a conversation that a user has
+// read.
+type ReadMarker struct {
+	UserID            int       `gorm:"primaryKey;autoIncrement:false"`
+	ConversationID    int       `gorm:"primaryKey;autoIncrement:false"`
+	LastReadMessageID int       `gorm:"not null"`
+	UpdatedAt         time.Time `gorm:"not null"`
+}
+
+type ConversationReadState struct {
+	ConversationID    int
+	LastReadMessageID int
+	UnreadCount       int
+}
+
+// MarkRead moves the user's read marker in a conversation forward to the
+// given message. Markers never move backwards, so the returned marker may
+// point to a later message than the one given.
+func MarkRead(user *User, conversationID int, messageID int) (*ReadMarker, *Conversation, error) {
+	db := db.GetDb()
+
+	conversation, err := GetUserConversation(user, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var message Message
+	result := db.Take(&message, &Message{ID: messageID, ConversationID: conversation.ID})
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrMessageNotFound
+	} else if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+
+	marker := &ReadMarker{
+		UserID:            user.ID,
+		ConversationID:    conversation.ID,
+		LastReadMessageID: message.ID,
+	}
+	result = db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "conversation_id"}},
+		DoUpdates: clause.Set{
+			{
+				Column: clause.Column{Name: "last_read_message_id"},
+				Value: gorm.Expr("GREATEST(read_markers.last_read_message_id, " +
+					"excluded.last_read_message_id)"),
+			},
+			{
+				Column: clause.Column{Name: "updated_at"},
+				Value:  gorm.Expr("excluded.updated_at"),
+			},
+		},
+	}).Create(marker)
+	if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+
+	result = db.Take(marker, &ReadMarker{UserID: user.ID, ConversationID: conversation.ID})
+	if result.Error != nil {
+		return nil, nil, utils.NewGormError(result.Error)
+	}
+	return marker, conversation, nil
+}
+
+// GetReadStates returns the user's read marker and number of unread messages
+// from other users for each of the given conversations the user belongs to,
+// keyed by conversation ID.
+func GetReadStates(user *User, conversationIDs []int) (map[int]ConversationReadState, error) {
+	db := db.GetDb()
+
+	var readStates []ConversationReadState
+	result := db.Raw(`
+		SELECT cu.conversation_id,
+			COALESCE(rm.last_read_message_id, 0) AS last_read_message_id,
+			(SELECT COUNT(*) FROM messages AS m
+				WHERE m.conversation_id = cu.conversation_id
+				AND m.user_id <> cu.user_id
+				AND m.id > COALESCE(rm.last_read_message_id, 0)) AS unread_count
+		FROM conversation_users AS cu
+		LEFT JOIN read_markers AS rm
+			ON rm.conversation_id = cu.conversation_id AND rm.user_id = cu.user_id
+		WHERE cu.user_id = ? AND cu.conversation_id IN ?`, user.ID, conversationIDs).Scan(&readStates)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	readStatesMap := make(map[int]ConversationReadState)
+	for _, readState := range readStates {
+		readStatesMap[readState.ConversationID] = readState
+	}
+	return readStatesMap, nil
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
+)
+
+var ErrEmptySearchQuery = errors.New("Search query cannot be empty.")
+var ErrInvalidSearchCursor = errors.New("Invalid search cursor.")
+
+const DefaultSearchPageSize = 20
+const MaxSearchPageSize = 100
+
+// searchConfig is the Postgres text search configuration used to query
+// message bodies. It must match the one the search_vector column is
+// generated with.
+const searchConfig = "english"
+
+type MessageSearch struct {
+	Query          string
+	ConversationID int
+	SenderID       int
+	From           *time.Time
+	To             *time.Time
+	Cursor         string
+	Limit          int
+}
+
+type MessageSearchResult struct {
+	ID             int
+	ConversationID int
+	UserID         int
+	Body           string
+	CreatedAt      time.Time
+	EditedAt       *time.Time
+	Rank           float32
+	Snippet        string
+}
+
+// SearchMessages searches the messages in every conversation that user
+// belongs to, best matches first. If there are more results, the cursor to
+// pass to get the next page is also returned.
+func SearchMessages(user *User, search *MessageSearch) ([]MessageSearchResult, string, error) {
+	query := strings.TrimSpace(search.Query)
+	if query == "" {
+		return nil, "", ErrEmptySearchQuery
+	}
+	limit := search.Limit
+	if limit <= 0 {
+		limit = DefaultSearchPageSize
+	} else if limit > MaxSearchPageSize {
+		limit = MaxSearchPageSize
+	}
+
+	db := db.GetDb()
+
+	conditions := []string{
+		"m.search_vector @@ q.query",
+		"m.deleted_at IS NULL",
+	}
+	args := []interface{}{query, user.ID}
+	if search.ConversationID != 0 {
+		conditions = append(conditions, "m.conversation_id = ?")
+		args = append(args, search.ConversationID)
+	}
+	if search.SenderID != 0 {
+		conditions = append(conditions, "m.user_id = ?")
+		args = append(args, search.SenderID)
+	}
+	if search.From != nil {
+		conditions = append(conditions, "m.created_at >= ?")
+		args = append(args, *search.From)
+	}
+	if search.To != nil {
+		conditions = append(conditions, "m.created_at < ?")
+		args = append(args, *search.To)
+	}
+
+	cursorCondition := "TRUE"
+	if search.Cursor != "" {
+		cursorRank, cursorID, err := DecodeSearchCursor(search.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		cursorCondition = "(ranked.rank < ?::real OR (ranked.rank = ?::real AND ranked.id < ?))"
+		args = append(args, cursorRank, cursorRank, cursorID)
+	}
+	args = append(args, limit+1)
+
+	// Snippets are HTML, so the body is escaped before the matches are wrapped
+	// in <mark> tags. The text search parser reads the escapes as entities,
+	// which it never splits or highlights.
+	sql := `
+		SELECT ranked.*,
+			ts_headline('` + searchConfig + `',
+				replace(replace(replace(ranked.body, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+				plainto_tsquery('` + searchConfig + `', ?),
+				'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5') AS snippet
+		FROM (
+			SELECT * FROM (
+				SELECT m.id, m.conversation_id, m.user_id, m.body, m.created_at, m.edited_at,
+					ts_rank(m.search_vector, q.query) AS rank
+				FROM messages AS m
+				JOIN conversation_users AS cu ON cu.conversation_id = m.conversation_id,
+					plainto_tsquery('` + searchConfig + `', ?) AS q(query)
+				WHERE cu.user_id = ? AND ` + strings.Join(conditions, " AND ") + `
+			) AS ranked
+			WHERE ` + cursorCondition + `
+			ORDER BY ranked.rank DESC, ranked.id DESC
+			LIMIT ?
+		) AS ranked
+		ORDER BY ranked.rank DESC, ranked.id DESC`
+
+	var results []MessageSearchResult
+	err := db.Raw(sql, append([]interface{}{query}, args...)...).Scan(&results).Error
+	if err != nil {
+		return nil, "", utils.NewGormError(err)
+	}
+
+	nextCursor := ""
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[len(results)-1]
+		nextCursor = EncodeSearchCursor(last.Rank, last.ID)
+	}
+	return results, nextCursor, nil
+}
+
+// EncodeSearchCursor returns the cursor for the page of results after the
+// one with the given rank and ID.
+func EncodeSearchCursor(rank float32, id int) string {
+	cursor := strconv.FormatFloat(float64(rank), 'g', -1, 32) + ":" + strconv.Itoa(id)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func DecodeSearchCursor(cursor string) (float32, int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, ErrInvalidSearchCursor
+	}
+
+	var rank float32
+	var id int
+	_, err = fmt.Sscanf(string(decoded), "%g:%d", &rank, &id)
+	if err != nil {
+		return 0, 0, ErrInvalidSearchCursor
+	}
+	return rank, id, nil
+}
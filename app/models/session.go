@@ -13,41 +13,92 @@ import (
 )
 
 type Session struct {
-	ID        int    `gorm:"primaryKey"`
-	Key       string `gorm:"not null"`
-	User      User
-	UserID    int       `gorm:"not null"`
-	CreatedAt time.Time `gorm:"not null"`
-	// AccessedAt time.Time
+	ID         int    `gorm:"primaryKey"`
+	Key        string `gorm:"not null;uniqueIndex"`
+	User       User
+	UserID     int       `gorm:"not null;index"`
+	UserAgent  string    `gorm:"not null;default:''"`
+	IPAddress  string    `gorm:"not null;default:''"`
+	CreatedAt  time.Time `gorm:"not null"`
+	AccessedAt time.Time `gorm:"not null;default:now()"`
 }
 
 var ErrInvalidCred = errors.New("Invalid username/password.")
+var ErrSessionNotFound = errors.New("Session not found.")
 
-func CreateSession(username string, password string) (*Session, *User, error) {
+// SessionTTL is the maximum lifetime of a session, and SessionIdleTTL is how
+// long a session may go unused before it expires. A zero value disables the
+// corresponding check.
+var SessionTTL = 30 * 24 * time.Hour
+var SessionIdleTTL = 7 * 24 * time.Hour
+
+// sessionRefreshInterval limits how often AccessedAt is written back to the
+// database, so that every authenticated request doesn't cause an UPDATE.
+const sessionRefreshInterval = time.Minute
+
+func (session *Session) IsExpired(now time.Time) bool {
+	if SessionTTL > 0 && now.Sub(session.CreatedAt) > SessionTTL {
+		return true
+	}
+	if SessionIdleTTL > 0 && now.Sub(session.AccessedAt) > SessionIdleTTL {
+		return true
+	}
+	return false
+}
+
+// CreateSession logs a user in. Every attempt is recorded, and once there
+// have been too many failures for the username or IP address, a
+// LoginThrottledError is returned without checking the password.
+func CreateSession(username string, password string, userAgent string, ipAddress string) (*Session, *User, error) {
 	db := db.GetDb()
 
-	hashedPassword := HashPassword(password)
+	// The throttle is checked, the password verified and the attempt recorded
+	// in one transaction holding locks on the username and IP address, so
+	// that concurrent attempts can't all pass the check before any of them
+	// is recorded.
+	var user *User
+	var loginErr error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := lockLoginAttempts(tx, username, ipAddress)
+		if err != nil {
+			return err
+		}
 
-	var user User
-	readUserResult := db.Take(&user, &User{Username: username, Password: hashedPassword})
+		err = checkLoginThrottle(tx, username, ipAddress)
+		var throttledErr *LoginThrottledError
+		if errors.As(err, &throttledErr) {
+			loginErr = err
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-	if readUserResult.Error != nil {
-		if errors.Is(readUserResult.Error, gorm.ErrRecordNotFound) {
-			return nil, nil, ErrInvalidCred
+		user, loginErr, err = verifyLogin(tx, username, password)
+		if err != nil {
+			return err
 		}
-		return nil, nil, utils.NewGormError(readUserResult.Error)
+		return recordLoginAttempt(tx, username, user, ipAddress, userAgent, loginErr == nil)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if loginErr != nil {
+		return nil, nil, loginErr
 	}
 
 	randBytes := make([]byte, 18)
-	_, err := rand.Read(randBytes)
+	_, err = rand.Read(randBytes)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error generating session key: %w", err)
 	}
 	authKey := base64.URLEncoding.EncodeToString(randBytes)
 
 	session := Session{
-		Key:    authKey,
-		UserID: user.ID,
+		Key:        authKey,
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		AccessedAt: time.Now(),
 	}
 	createUserResult := db.Create(&session)
 
@@ -59,5 +110,173 @@ func CreateSession(username string, password string) (*Session, *User, error) {
 		return nil, nil, errors.New("Could not create session.")
 	}
 
-	return &session, &user, nil
+	return &session, user, nil
+}
+
+// verifyLogin checks a username and password. If they don't match, the user,
+// if there is one, is returned along with ErrInvalidCred.
+func verifyLogin(tx *gorm.DB, username string, password string) (*User, error, error) {
+	var user User
+	readUserResult := tx.Take(&user, &User{Username: username})
+	if errors.Is(readUserResult.Error, gorm.ErrRecordNotFound) {
+		_, loginErr := CheckLoginPassword(nil, password)
+		return nil, loginErr, nil
+	} else if readUserResult.Error != nil {
+		return nil, nil, utils.NewGormError(readUserResult.Error)
+	}
+
+	newHash, err := CheckLoginPassword(&user, password)
+	if errors.Is(err, ErrInvalidCred) {
+		return &user, err, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if newHash != "" {
+		updateUserResult := tx.Model(&user).Update("password", newHash)
+		if updateUserResult.Error != nil {
+			return nil, nil, utils.NewGormError(updateUserResult.Error)
+		}
+	}
+	return &user, nil, nil
+}
+
+// CheckLoginPassword verifies password for a login as user, returning
+// ErrInvalidCred if it doesn't match. If user is nil, the password is checked
+// against a dummy hash anyway, so that failed logins take the same time
+// whether or not the username is registered. If the password matches but its
+// hash is outdated, a new hash to store is returned.
+func CheckLoginPassword(user *User, password string) (string, error) {
+	if user == nil {
+		VerifyPassword(password, dummyPasswordHash)
+		return "", ErrInvalidCred
+	}
+
+	passwordOk, needsRehash := VerifyPassword(password, user.Password)
+	if !passwordOk {
+		return "", ErrInvalidCred
+	}
+	if !needsRehash {
+		return "", nil
+	}
+	return HashPassword(password)
+}
+
+// GetSessionFromKey returns the session with the given key along with its
+// user. Expired sessions are deleted and reported as not found. Otherwise,
+// the session's idle timeout is pushed back.
+func GetSessionFromKey(key string) (*Session, error) {
+	if key == "" {
+		return nil, ErrSessionNotFound
+	}
+	db := db.GetDb()
+
+	var session Session
+	readSession := db.Joins("User").Take(&session, &Session{Key: key}) // TODO: exclude password
+	if errors.Is(readSession.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	} else if readSession.Error != nil {
+		return nil, utils.NewGormError(readSession.Error)
+	}
+
+	err := session.Touch()
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Touch marks the session as used now. If the session has expired, it is
+// deleted and ErrSessionNotFound is returned.
+func (session *Session) Touch() error {
+	db := db.GetDb()
+
+	now := time.Now()
+	if session.IsExpired(now) {
+		err := session.Delete()
+		if err != nil {
+			return err
+		}
+		return ErrSessionNotFound
+	}
+
+	if now.Sub(session.AccessedAt) > sessionRefreshInterval {
+		result := db.Model(session).UpdateColumn("accessed_at", now)
+		if result.Error != nil {
+			return utils.NewGormError(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrSessionNotFound
+		}
+		session.AccessedAt = now
+	}
+	return nil
+}
+
+func (session *Session) Delete() error {
+	db := db.GetDb()
+
+	result := db.Delete(&Session{}, session.ID)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
+}
+
+// GetSessions returns all of a user's unexpired sessions, most recently used
+// first.
+func GetSessions(user *User) ([]Session, error) {
+	db := db.GetDb()
+
+	var sessions []Session
+	result := db.Where(&Session{UserID: user.ID}).Order("accessed_at DESC").Find(&sessions)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	now := time.Now()
+	validSessions := []Session{}
+	for _, session := range sessions {
+		if !session.IsExpired(now) {
+			validSessions = append(validSessions, session)
+		}
+	}
+	return validSessions, nil
+}
+
+func DeleteUserSession(user *User, sessionID int) error {
+	db := db.GetDb()
+
+	result := db.Where(&Session{UserID: user.ID}).Delete(&Session{}, sessionID)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// DeleteOtherSessions deletes every session belonging to the given session's
+// user except the session itself, and returns the IDs of the deleted
+// sessions.
+func DeleteOtherSessions(session *Session) ([]int, error) {
+	db := db.GetDb()
+
+	deletedIDs := []int{}
+	err := db.Model(&Session{}).
+		Where("user_id = ? AND id <> ?", session.UserID, session.ID).
+		Pluck("id", &deletedIDs).Error
+	if err != nil {
+		return nil, utils.NewGormError(err)
+	}
+	if len(deletedIDs) == 0 {
+		return deletedIDs, nil
+	}
+
+	result := db.Delete(&Session{}, deletedIDs)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return deletedIDs, nil
 }
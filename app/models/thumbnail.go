@@ -0,0 +1,109 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// ThumbnailSize is the maximum width and height of generated thumbnails.
+const ThumbnailSize = 256
+
+// maxThumbnailSourcePixels guards against decompression bombs, whose small
+// files decode into huge images. A decoded image takes up to 4 bytes per
+// pixel, and at most maxThumbnailDecodes are decoded at once, which bounds the
+// memory used for thumbnails to about 128MB.
+const maxThumbnailSourcePixels = 16 * 1000 * 1000
+const maxThumbnailDecodes = 2
+
+var thumbnailDecodeSlots = make(chan struct{}, maxThumbnailDecodes)
+
+// makeThumbnail decodes an image and returns a JPEG scaled down to fit within
+// ThumbnailSize, along with the original image's dimensions.
+func makeThumbnail(reader io.ReadSeeker) (thumbnail []byte, width int, height int, err error) {
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, 0, 0, image.ErrFormat
+	}
+
+	_, err = reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	thumbnailDecodeSlots <- struct{}{}
+	defer func() { <-thumbnailDecodeSlots }()
+
+	source, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var buffer bytes.Buffer
+	err = jpeg.Encode(&buffer, scaleImage(source, ThumbnailSize), &jpeg.Options{Quality: 80})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return buffer.Bytes(), config.Width, config.Height, nil
+}
+
+// scaleImage shrinks an image to fit within a maxSize square, preserving its
+// aspect ratio, by averaging the source pixels covered by each output pixel.
+// The result is opaque.
+func scaleImage(source image.Image, maxSize int) image.Image {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	scaledWidth, scaledHeight := width, height
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			scaledWidth, scaledHeight = maxSize, height*maxSize/width
+		} else {
+			scaledWidth, scaledHeight = width*maxSize/height, maxSize
+		}
+	}
+	if scaledWidth < 1 {
+		scaledWidth = 1
+	}
+	if scaledHeight < 1 {
+		scaledHeight = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+	for y := 0; y < scaledHeight; y++ {
+		y0 := bounds.Min.Y + y*height/scaledHeight
+		y1 := bounds.Min.Y + (y+1)*height/scaledHeight
+		for x := 0; x < scaledWidth; x++ {
+			x0 := bounds.Min.X + x*width/scaledWidth
+			x1 := bounds.Min.X + (x+1)*width/scaledWidth
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := source.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			// JPEG has no alpha channel, so flatten onto a white background.
+			background := 0xffff - a/count
+			scaled.Set(x, y, color.RGBA64{
+				R: uint16(r/count + background),
+				G: uint16(g/count + background),
+				B: uint16(b/count + background),
+				A: 0xffff,
+			})
+		}
+	}
+	return scaled
+}
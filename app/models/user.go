@@ -1,51 +1,194 @@
 package models
 
 import (
-	"crypto/sha256"
 	"errors"
-	"fmt"
+	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var ErrUserNotFound = errors.New("No user found.")
+var ErrUsernameTaken = errors.New("Username already registered.")
 
 type User struct {
 	ID            int            `gorm:"primaryKey,not null"`
-	Username      string         `gorm:"not null"`
+	Username      string         `gorm:"not null;uniqueIndex:idx_users_username"`
 	Password      string         `gorm:"not null"`
 	Name          string         `gorm:"not null"`
 	Conversations []Conversation `gorm:"many2many:conversation_users;"`
 	Messages      []Message
 	CreatedAt     time.Time `gorm:"not null"`
+	LastSeenAt    *time.Time
+	EventSeq      int64 `gorm:"not null;default:0"`
+	Discoverable  bool  `gorm:"not null;default:true"`
 }
 
-func CreateUser(username string, password string) { // TODO: implement this
+// CreateUser registers a new user. The username is stored in lower case.
+func CreateUser(username string, password string, name string) (*User, error) {
+	db := db.GetDb()
+
+	username = strings.ToLower(username)
+	var existingUser User
+	result := db.Take(&existingUser, &User{Username: username})
+	if result.Error == nil {
+		return nil, ErrUsernameTaken
+	} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, utils.NewGormError(result.Error)
+	}
 
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Username: username,
+		Password: hashedPassword,
+		Name:     name,
+	}
+	// The check above only saves hashing the password. Two signups for the
+	// same username can both get past it, and then the unique index lets only
+	// one of them in.
+	result = db.Clauses(clause.OnConflict{DoNothing: true}).Create(user)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrUsernameTaken
+	}
+	return user, nil
 }
 
-func GetUserFromKey(key string) (*User, error) {
-	if key == "" {
+func GetUserByUsername(username string) (*User, error) {
+	db := db.GetDb()
+
+	var user User
+	result := db.Take(&user, &User{Username: strings.ToLower(username)})
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 		return nil, ErrUserNotFound
+	} else if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
 	}
+	return &user, nil
+}
+
+// GetUsersByUsernames looks up users by username. If any username isn't
+// registered, ErrUserNotFound is returned.
+func GetUsersByUsernames(usernames []string) ([]User, error) {
 	db := db.GetDb()
-	var session Session
-	readSession := db.Joins("User").Take(&session, &Session{Key: key}) // TODO: exclude password
-	if errors.Is(readSession.Error, gorm.ErrRecordNotFound) {
+
+	uniqueUsernames := map[string]bool{}
+	for _, username := range usernames {
+		uniqueUsernames[strings.ToLower(username)] = true
+	}
+	lowerUsernames := []string{}
+	for username := range uniqueUsernames {
+		lowerUsernames = append(lowerUsernames, username)
+	}
+
+	var users []User
+	result := db.Where("username IN ?", lowerUsernames).Find(&users)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	if len(users) != len(lowerUsernames) {
 		return nil, ErrUserNotFound
-	} else if readSession.Error != nil {
-		return nil, readSession.Error
 	}
-	return &session.User, nil
+	return users, nil
 }
 
-func GetUserFromRequest(c *gin.Context) (*User, error) {
-	return GetUserFromKey(c.GetHeader("X-API-Key"))
+func UpdateLastSeen(userID int, lastSeen time.Time) error {
+	db := db.GetDb()
+
+	result := db.Model(&User{ID: userID}).UpdateColumn("last_seen_at", lastSeen)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
 }
 
-func HashPassword(str string) string {
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(str)))
+// GetContactIDs returns the IDs of every user who shares at least one
+// conversation with the given user.
+func GetContactIDs(userID int) ([]int, error) {
+	db := db.GetDb()
+
+	contactIDs := []int{}
+	result := db.Raw(`
+		SELECT DISTINCT other_cu.user_id
+		FROM conversation_users AS user_cu
+		JOIN conversation_users AS other_cu ON other_cu.conversation_id = user_cu.conversation_id
+		WHERE user_cu.user_id = ? AND other_cu.user_id <> ?`, userID, userID).Scan(&contactIDs)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return contactIDs, nil
+}
+
+const DefaultUserSearchPageSize = 20
+const MaxUserSearchPageSize = 50
+
+// SearchUsers finds discoverable users whose username or name matches query,
+// either by prefix or approximately. Prefix matches are listed first. Demo
+// users and searcher are never included. hasMore reports whether there are
+// further results after this page.
+func SearchUsers(searcher *User, query string, offset int, limit int) (users []User, hasMore bool, err error) {
+	if limit <= 0 {
+		limit = DefaultUserSearchPageSize
+	} else if limit > MaxUserSearchPageSize {
+		limit = MaxUserSearchPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	db := db.GetDb()
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	usersQuery := db.Select("id, username, name, last_seen_at").
+		Where("discoverable AND username NOT LIKE 'demo\\_%' AND id <> ?", searcher.ID)
+
+	if query != "" {
+		prefix := likeEscaper.Replace(query) + "%"
+		usersQuery = usersQuery.
+			Where("username LIKE ? OR lower(name) LIKE ? OR lower(name) LIKE ? OR "+
+				"username % ? OR lower(name) % ?",
+				prefix, prefix, "% "+prefix, query, query).
+			Clauses(clause.OrderBy{Expression: clause.Expr{
+				SQL: "(username LIKE ? OR lower(name) LIKE ?) DESC, " +
+					"GREATEST(similarity(username, ?), similarity(lower(name), ?)) DESC, " +
+					"username ASC",
+				Vars: []interface{}{prefix, prefix, query, query},
+			}})
+	} else {
+		usersQuery = usersQuery.Order("username ASC")
+	}
+
+	users = []User{}
+	result := usersQuery.Offset(offset).Limit(limit + 1).Find(&users)
+	if result.Error != nil {
+		return nil, false, utils.NewGormError(result.Error)
+	}
+
+	hasMore = len(users) > limit
+	if hasMore {
+		users = users[:limit]
+	}
+	return users, hasMore, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func SetDiscoverable(user *User, discoverable bool) error {
+	db := db.GetDb()
+
+	result := db.Model(user).Update("discoverable", discoverable)
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	user.Discoverable = discoverable
+	return nil
 }
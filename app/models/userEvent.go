@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+)
+
+// UserEvent is a notification delivered to a user, kept so that clients which
+// reconnect can replay the notifications they missed. Seq increases by one
+// for each of a user's events.
+type UserEvent struct {
+	ID        int64     `gorm:"primaryKey"`
+	UserID    int       `gorm:"not null;uniqueIndex:idx_user_events_seq,priority:1"`
+	Seq       int64     `gorm:"not null;uniqueIndex:idx_user_events_seq,priority:2"`
+	Method    string    `gorm:"not null"`
+	Data      string    `gorm:"type:jsonb;not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// UserEventRetention is how long events are kept for replay.
+var UserEventRetention = 7 * 24 * time.Hour
+
+// AppendUserEvents records an event for each of the given users, and returns
+// the sequence number assigned to each user's event.
+func AppendUserEvents(userIDs []int, method string, data interface{}) (map[int]int64, error) {
+	db := db.GetDb()
+
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock user rows in a consistent order so that concurrent appends can't
+	// deadlock.
+	sortedUserIDs := append([]int{}, userIDs...)
+	sort.Ints(sortedUserIDs)
+
+	seqs := make(map[int]int64)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, userID := range sortedUserIDs {
+			if _, ok := seqs[userID]; ok {
+				continue
+			}
+
+			var seq int64
+			result := tx.Raw("UPDATE users SET event_seq = event_seq + 1 WHERE id = ? RETURNING event_seq",
+				userID).Scan(&seq)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			event := &UserEvent{
+				UserID: userID,
+				Seq:    seq,
+				Method: method,
+				Data:   string(encodedData),
+			}
+			result = tx.Create(event)
+			if result.Error != nil {
+				return result.Error
+			}
+			seqs[userID] = seq
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, utils.NewGormError(err)
+	}
+	return seqs, nil
+}
+
+// GetUserEventsSince returns up to limit of the user's events with sequence
+// numbers greater than seq, oldest first.
+func GetUserEventsSince(userID int, seq int64, limit int) ([]UserEvent, error) {
+	db := db.GetDb()
+
+	events := []UserEvent{}
+	result := db.Where("user_id = ? AND seq > ?", userID, seq).
+		Order("seq ASC").Limit(limit).Find(&events)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return events, nil
+}
+
+// GetUserEventSeq returns the sequence number of the user's latest event.
+func GetUserEventSeq(userID int) (int64, error) {
+	db := db.GetDb()
+
+	var user User
+	result := db.Select("event_seq").Take(&user, userID)
+	if result.Error != nil {
+		return 0, utils.NewGormError(result.Error)
+	}
+	return user.EventSeq, nil
+}
+
+func PruneUserEvents() error {
+	db := db.GetDb()
+
+	result := db.Where("created_at < ?", time.Now().Add(-UserEventRetention)).Delete(&UserEvent{})
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,446 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+)
+
+const WebhookEventMessageCreated = "message.created"
+const WebhookEventMessageEdited = "message.edited"
+const WebhookEventConversationCreated = "conversation.created"
+const WebhookEventUserRegistered = "user.registered"
+
+var webhookEvents = map[string]bool{
+	WebhookEventMessageCreated:      true,
+	WebhookEventMessageEdited:       true,
+	WebhookEventConversationCreated: true,
+	WebhookEventUserRegistered:      true,
+}
+
+// A delivery is pending until it succeeds, or until it has failed
+// MaxWebhookAttempts times, when it is dead.
+const WebhookDeliveryPending = "pending"
+const WebhookDeliverySucceeded = "succeeded"
+const WebhookDeliveryDead = "dead"
+
+var ErrWebhookNotFound = errors.New("Webhook not found.")
+var ErrWebhookDeliveryNotFound = errors.New("Webhook delivery not found.")
+var ErrInvalidWebhookURL = errors.New("Webhook URL must be an absolute http or https URL.")
+var ErrInvalidWebhookEvent = errors.New("Unknown webhook event.")
+var ErrNoWebhookEvents = errors.New("Webhook must subscribe to at least one event.")
+var ErrWebhookEventNotAllowed = errors.New("Only admins can subscribe to user.registered.")
+var ErrTooManyWebhooks = errors.New("Too many webhooks.")
+
+// WebhookAdminUsernames are the users whose webhooks may subscribe to
+// user.registered, which concerns users they share no conversation with.
+var WebhookAdminUsernames = []string{}
+
+// Failed deliveries are retried after WebhookRetryDelay, doubling after each
+// further failure up to MaxWebhookRetryDelay.
+var MaxWebhookAttempts = 8
+var WebhookRetryDelay = 30 * time.Second
+var MaxWebhookRetryDelay = time.Hour
+
+// WebhookDeliveryRetention is how long finished deliveries are kept in the
+// delivery log.
+var WebhookDeliveryRetention = 30 * 24 * time.Hour
+
+const MaxWebhooksPerUser = 10
+const DefaultWebhookDeliveriesPageSize = 50
+const MaxWebhookDeliveriesPageSize = 100
+
+// Webhook is an endpoint that is sent the events it subscribes to. Users'
+// webhooks receive events from the conversations they belong to. Payloads are
+// signed with Secret.
+type Webhook struct {
+	ID        int            `gorm:"primaryKey"`
+	UserID    int            `gorm:"not null;index"`
+	URL       string         `gorm:"not null"`
+	Secret    string         `gorm:"not null"`
+	Events    pq.StringArray `gorm:"type:text[];not null"`
+	CreatedAt time.Time      `gorm:"not null"`
+}
+
+// WebhookDelivery is one event queued for sending to one webhook.
+type WebhookDelivery struct {
+	ID             int64     `gorm:"primaryKey"`
+	WebhookID      int       `gorm:"not null;index"`
+	Webhook        *Webhook  `gorm:"foreignKey:WebhookID"`
+	Event          string    `gorm:"not null"`
+	Payload        string    `gorm:"not null"`
+	Status         string    `gorm:"not null;default:'pending'"`
+	Attempts       int       `gorm:"not null;default:0"`
+	NextAttemptAt  time.Time `gorm:"not null"`
+	LastAttemptAt  *time.Time
+	ResponseStatus int       `gorm:"not null;default:0"`
+	LastError      string    `gorm:"not null;default:''"`
+	CreatedAt      time.Time `gorm:"not null"`
+}
+
+type webhookPayload struct {
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+// CreateWebhook registers a webhook for user, with a new random secret.
+func CreateWebhook(user *User, webhookURL string, events []string) (*Webhook, error) {
+	webhook, err := NewWebhook(user, webhookURL, events)
+	if err != nil {
+		return nil, err
+	}
+
+	db := db.GetDb()
+
+	var webhookCount int64
+	result := db.Model(&Webhook{}).Where(&Webhook{UserID: user.ID}).Count(&webhookCount)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	if webhookCount >= MaxWebhooksPerUser {
+		return nil, ErrTooManyWebhooks
+	}
+
+	result = db.Create(webhook)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return webhook, nil
+}
+
+// NewWebhook validates a webhook for user and generates its secret, without
+// saving it.
+func NewWebhook(user *User, webhookURL string, events []string) (*Webhook, error) {
+	parsedURL, err := url.Parse(webhookURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+
+	if len(events) == 0 {
+		return nil, ErrNoWebhookEvents
+	}
+	uniqueEvents := pq.StringArray{}
+	for _, event := range events {
+		if !webhookEvents[event] {
+			return nil, ErrInvalidWebhookEvent
+		}
+		if event == WebhookEventUserRegistered && !IsWebhookAdmin(user) {
+			return nil, ErrWebhookEventNotAllowed
+		}
+		if !containsString(uniqueEvents, event) {
+			uniqueEvents = append(uniqueEvents, event)
+		}
+	}
+
+	secretBytes := make([]byte, 32)
+	_, err = rand.Read(secretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating webhook secret: %w", err)
+	}
+
+	webhook := &Webhook{
+		UserID: user.ID,
+		URL:    parsedURL.String(),
+		Secret: hex.EncodeToString(secretBytes),
+		Events: uniqueEvents,
+	}
+	return webhook, nil
+}
+
+// IsSubscribed reports whether the webhook is sent event.
+func (webhook *Webhook) IsSubscribed(event string) bool {
+	return containsString(webhook.Events, event)
+}
+
+func IsWebhookAdmin(user *User) bool {
+	return containsString(WebhookAdminUsernames, user.Username)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GetWebhooks returns user's webhooks, oldest first.
+func GetWebhooks(user *User) ([]Webhook, error) {
+	db := db.GetDb()
+
+	webhooks := []Webhook{}
+	result := db.Where(&Webhook{UserID: user.ID}).Order("id ASC").Find(&webhooks)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return webhooks, nil
+}
+
+func GetUserWebhook(user *User, webhookID int) (*Webhook, error) {
+	db := db.GetDb()
+
+	var webhook Webhook
+	result := db.Take(&webhook, &Webhook{ID: webhookID, UserID: user.ID})
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrWebhookNotFound
+	} else if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return &webhook, nil
+}
+
+// DeleteWebhook deletes one of user's webhooks, along with its deliveries.
+func DeleteWebhook(user *User, webhookID int) error {
+	db := db.GetDb()
+
+	result := db.Where("id = ? AND user_id = ?", webhookID, user.ID).Delete(&Webhook{})
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// EnqueueWebhookEvent queues an event for every webhook subscribed to it that
+// belongs to one of the given users. user.registered events go to admins'
+// webhooks instead.
+func EnqueueWebhookEvent(event string, userIDs []int, data interface{}) error {
+	payload, err := EncodeWebhookPayload(event, data)
+	if err != nil {
+		return err
+	}
+
+	db := db.GetDb()
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		SELECT webhooks.id, ?, ?, ?, now(), now()
+		FROM webhooks
+		JOIN users ON users.id = webhooks.user_id
+		WHERE ? = ANY(webhooks.events)`
+	args := []interface{}{event, payload, WebhookDeliveryPending, event}
+	if event == WebhookEventUserRegistered {
+		query += " AND users.username IN ?"
+		args = append(args, WebhookAdminUsernames)
+	} else {
+		query += " AND users.id IN ?"
+		args = append(args, userIDs)
+	}
+
+	result := db.Exec(query, args...)
+	if result.Error != nil {
+		return fmt.Errorf("Error queueing webhook event %s: %w", event, utils.NewGormError(result.Error))
+	}
+	return nil
+}
+
+// EncodeWebhookPayload returns the JSON body sent to webhooks for an event.
+func EncodeWebhookPayload(event string, data interface{}) (string, error) {
+	payload, err := json.Marshal(&webhookPayload{
+		Event:   event,
+		Created: time.Now(),
+		Data:    data,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// ClaimWebhookDeliveries returns up to limit deliveries that are due, with
+// their webhooks loaded. They won't be claimed again until lease has passed,
+// so that instances don't send the same delivery at once.
+func ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	db := db.GetDb()
+	now := time.Now()
+
+	deliveries := []WebhookDelivery{}
+	result := db.Raw(`
+		UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`,
+		now.Add(lease), WebhookDeliveryPending, now, limit).Scan(&deliveries)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	if len(deliveries) == 0 {
+		return deliveries, nil
+	}
+
+	webhookIDs := []int{}
+	for _, delivery := range deliveries {
+		webhookIDs = append(webhookIDs, delivery.WebhookID)
+	}
+	var webhooks []Webhook
+	result = db.Find(&webhooks, webhookIDs)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	webhooksByID := map[int]*Webhook{}
+	for i := range webhooks {
+		webhooksByID[webhooks[i].ID] = &webhooks[i]
+	}
+	claimed := []WebhookDelivery{}
+	for _, delivery := range deliveries {
+		if delivery.Webhook = webhooksByID[delivery.WebhookID]; delivery.Webhook != nil {
+			claimed = append(claimed, delivery)
+		}
+	}
+	return claimed, nil
+}
+
+// RecordWebhookAttempt updates a delivery after trying to send it. The
+// delivery succeeded if the webhook responded with a 2xx status. Otherwise it
+// is retried later, or marked dead after MaxWebhookAttempts.
+func RecordWebhookAttempt(delivery *WebhookDelivery, responseStatus int, deliveryErr error) error {
+	delivery.RecordAttempt(responseStatus, deliveryErr, time.Now())
+
+	db := db.GetDb()
+
+	result := db.Model(&WebhookDelivery{ID: delivery.ID}).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"last_attempt_at": delivery.LastAttemptAt,
+		"response_status": delivery.ResponseStatus,
+		"last_error":      delivery.LastError,
+	})
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
+}
+
+// RecordAttempt updates the delivery, without saving it, after an attempt to
+// send it at now.
+func (delivery *WebhookDelivery) RecordAttempt(responseStatus int, deliveryErr error, now time.Time) {
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.ResponseStatus = responseStatus
+	delivery.LastError = ""
+
+	if deliveryErr == nil && responseStatus >= 200 && responseStatus < 300 {
+		delivery.Status = WebhookDeliverySucceeded
+		return
+	}
+
+	if deliveryErr != nil {
+		delivery.LastError = deliveryErr.Error()
+	} else {
+		delivery.LastError = fmt.Sprintf("Webhook responded with status %d.", responseStatus)
+	}
+	if delivery.Attempts >= MaxWebhookAttempts {
+		delivery.Status = WebhookDeliveryDead
+	} else {
+		delivery.NextAttemptAt = now.Add(webhookRetryDelay(delivery.Attempts))
+	}
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := WebhookRetryDelay
+	for i := 1; i < attempts && delay < MaxWebhookRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxWebhookRetryDelay {
+		delay = MaxWebhookRetryDelay
+	}
+	return delay
+}
+
+// GetWebhookDeliveries returns the most recent deliveries to one of user's
+// webhooks, newest first. If status is not "", only deliveries with that
+// status are returned.
+func GetWebhookDeliveries(user *User, webhookID int, status string, limit int) ([]WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = DefaultWebhookDeliveriesPageSize
+	} else if limit > MaxWebhookDeliveriesPageSize {
+		limit = MaxWebhookDeliveriesPageSize
+	}
+
+	webhook, err := GetUserWebhook(user, webhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := db.GetDb()
+
+	deliveries := []WebhookDelivery{}
+	result := db.Where(&WebhookDelivery{WebhookID: webhook.ID, Status: status}).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&deliveries)
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhookDelivery queues a delivery to be sent again right away, with
+// a fresh set of attempts. This is how dead deliveries are retried.
+func RedeliverWebhookDelivery(user *User, webhookID int, deliveryID int64) (*WebhookDelivery, error) {
+	webhook, err := GetUserWebhook(user, webhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	db := db.GetDb()
+
+	var delivery WebhookDelivery
+	result := db.Take(&delivery, &WebhookDelivery{ID: deliveryID, WebhookID: webhook.ID})
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrWebhookDeliveryNotFound
+	} else if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+
+	delivery.Redeliver(time.Now())
+	result = db.Model(&delivery).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+	})
+	if result.Error != nil {
+		return nil, utils.NewGormError(result.Error)
+	}
+	return &delivery, nil
+}
+
+// Redeliver queues the delivery, without saving it, to be sent again at now.
+func (delivery *WebhookDelivery) Redeliver(now time.Time) {
+	delivery.Status = WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = now
+}
+
+// PruneWebhookDeliveries deletes finished deliveries older than the retention
+// period.
+func PruneWebhookDeliveries() error {
+	db := db.GetDb()
+
+	result := db.Where("status <> ? AND created_at < ?",
+		WebhookDeliveryPending, time.Now().Add(-WebhookDeliveryRetention)).
+		Delete(&WebhookDelivery{})
+	if result.Error != nil {
+		return utils.NewGormError(result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	want := []time.Duration{
+		30 * time.Second,
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		16 * time.Minute,
+		32 * time.Minute,
+		time.Hour,
+		time.Hour,
+	}
+	for i, delay := range want {
+		attempts := i + 1
+		if got := webhookRetryDelay(attempts); got != delay {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", attempts, got, delay)
+		}
+	}
+	if got := webhookRetryDelay(1000); got != MaxWebhookRetryDelay {
+		t.Errorf("webhookRetryDelay(1000) = %v, want %v", got, MaxWebhookRetryDelay)
+	}
+}
+
+func TestRecordAttempt(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	delivery := &WebhookDelivery{Status: WebhookDeliveryPending}
+
+	for attempts := 1; attempts <= MaxWebhookAttempts; attempts++ {
+		delivery.RecordAttempt(0, errors.New("Could not connect to webhook."), now)
+
+		if delivery.Attempts != attempts || delivery.LastError != "Could not connect to webhook." {
+			t.Errorf("After attempt %d, delivery = %+v", attempts, delivery)
+		}
+		if attempts < MaxWebhookAttempts {
+			if delivery.Status != WebhookDeliveryPending {
+				t.Errorf("After attempt %d, status = %q, want pending", attempts, delivery.Status)
+			}
+			if want := now.Add(webhookRetryDelay(attempts)); !delivery.NextAttemptAt.Equal(want) {
+				t.Errorf("After attempt %d, next attempt at %v, want %v", attempts, delivery.NextAttemptAt, want)
+			}
+		} else if delivery.Status != WebhookDeliveryDead {
+			t.Errorf("After attempt %d, status = %q, want dead", attempts, delivery.Status)
+		}
+	}
+
+	delivery.Redeliver(now)
+	delivery.RecordAttempt(201, nil, now)
+	if delivery.Status != WebhookDeliverySucceeded || delivery.Attempts != 1 || delivery.LastError != "" {
+		t.Errorf("After redelivering, delivery = %+v, want one successful attempt", delivery)
+	}
+}
+
+func TestConcurrentClaimsDontOverlap(t *testing.T) {
+	initTestDb(t)
+
+	user, err := CreateUser(fmt.Sprintf("webhooks_%d", time.Now().UnixNano()), "password", "Webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook, err := CreateWebhook(user, "https://example.com/hook", []string{WebhookEventMessageCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const deliveryCount = 10
+	for i := 0; i < deliveryCount; i++ {
+		err = EnqueueWebhookEvent(WebhookEventMessageCreated, []int{user.ID}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mutex sync.Mutex
+	claims := map[int64]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliveries, err := ClaimWebhookDeliveries(deliveryCount, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, delivery := range deliveries {
+				if delivery.WebhookID == webhook.ID {
+					claims[delivery.ID]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for deliveryID, count := range claims {
+		if count != 1 {
+			t.Errorf("Delivery %d was claimed %d times.", deliveryID, count)
+		}
+	}
+
+	// Other deliveries may be due in a shared database, so only this
+	// webhook's are checked.
+	deliveries, err := ClaimWebhookDeliveries(1000, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, delivery := range deliveries {
+		if delivery.WebhookID == webhook.ID {
+			t.Errorf("Delivery %d was claimed again during its lease.", delivery.ID)
+		}
+	}
+}
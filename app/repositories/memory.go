@@ -0,0 +1,1749 @@
+package repositories
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+)
+
+// NewMemoryStores returns stores that keep everything in memory, for tests
+// and for running without a database. Attachment files are still kept in the
+// blob store.
+func NewMemoryStores() *Stores {
+	memory := &memoryDB{
+		users:         make(map[int]models.User),
+		sessions:      make(map[int]models.Session),
+		conversations: make(map[int]memoryConversation),
+		messages:      make(map[int]models.Message),
+		readMarkers:   make(map[readMarkerKey]models.ReadMarker),
+		events:        make(map[int][]models.UserEvent),
+		webhooks:      make(map[int]models.Webhook),
+		deliveries:    make(map[int64]models.WebhookDelivery),
+		attachments:   make(map[int]models.Attachment),
+		loginLocks:    make(map[string]*loginLock),
+	}
+	return &Stores{
+		Users:         &memoryUserStore{memory},
+		Sessions:      &memorySessionStore{memory},
+		LoginAttempts: &memoryLoginAttemptStore{memory},
+		Conversations: &memoryConversationStore{memory},
+		Messages:      &memoryMessageStore{memory},
+		ReadMarkers:   &memoryReadMarkerStore{memory},
+		Reactions:     &memoryReactionStore{memory},
+		Events:        &memoryEventStore{memory},
+		Webhooks:      &memoryWebhookStore{memory},
+		Attachments:   &memoryAttachmentStore{memory},
+	}
+}
+
+// memoryDB holds the data shared by the memory stores. Records are stored
+// without their associations, which are filled in when they are read.
+type memoryDB struct {
+	mutex         sync.Mutex
+	lastID        int
+	users         map[int]models.User
+	sessions      map[int]models.Session
+	loginAttempts []models.LoginAttempt
+	conversations map[int]memoryConversation
+	messages      map[int]models.Message
+	revisions     []models.MessageRevision
+	readMarkers   map[readMarkerKey]models.ReadMarker
+	reactions     []models.Reaction
+	events        map[int][]models.UserEvent
+	webhooks      map[int]models.Webhook
+	deliveries    map[int64]models.WebhookDelivery
+	attachments   map[int]models.Attachment
+	loginLocks    map[string]*loginLock
+}
+
+// loginLock is held while a login for a username or IP address is checked
+// and recorded. It is removed once nobody holds or is waiting for it.
+type loginLock struct {
+	mutex   sync.Mutex
+	holders int
+}
+
+type readMarkerKey struct {
+	userID         int
+	conversationID int
+}
+
+type memoryConversation struct {
+	conversation models.Conversation
+	memberIDs    []int
+}
+
+func (memory *memoryDB) nextID() int {
+	memory.lastID++
+	return memory.lastID
+}
+
+func (memory *memoryDB) isMember(conversationID int, userID int) bool {
+	for _, memberID := range memory.conversations[conversationID].memberIDs {
+		if memberID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConversation returns a conversation with its members filled in.
+func (memory *memoryDB) loadConversation(conversationID int) *models.Conversation {
+	stored := memory.conversations[conversationID]
+	conversation := stored.conversation
+	conversation.Users = []models.User{}
+	for _, memberID := range stored.memberIDs {
+		conversation.Users = append(conversation.Users, memory.users[memberID])
+	}
+	return &conversation
+}
+
+// loadMessage returns a message with its attachments and the message it
+// replies to filled in.
+func (memory *memoryDB) loadMessage(messageID int) *models.Message {
+	message := memory.messages[messageID]
+	if message.ReplyToID != nil {
+		replyTo := memory.messages[*message.ReplyToID]
+		message.ReplyTo = &replyTo
+	}
+	message.Attachments = []models.Attachment{}
+	for _, attachment := range memory.attachments {
+		if attachment.MessageID != nil && *attachment.MessageID == messageID {
+			message.Attachments = append(message.Attachments, attachment)
+		}
+	}
+	sort.Slice(message.Attachments, func(i, j int) bool {
+		return message.Attachments[i].ID < message.Attachments[j].ID
+	})
+	return &message
+}
+
+type memoryUserStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryUserStore) CreateUser(username string, password string, name string) (*models.User, error) {
+	hashedPassword, err := models.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	username = strings.ToLower(username)
+	for _, user := range store.memory.users {
+		if user.Username == username {
+			return nil, models.ErrUsernameTaken
+		}
+	}
+
+	user := models.User{
+		ID:           store.memory.nextID(),
+		Username:     username,
+		Password:     hashedPassword,
+		Name:         name,
+		CreatedAt:    time.Now(),
+		Discoverable: true,
+	}
+	store.memory.users[user.ID] = user
+	return &user, nil
+}
+
+func (store *memoryUserStore) GetUserByUsername(username string) (*models.User, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	username = strings.ToLower(username)
+	for _, user := range store.memory.users {
+		if user.Username == username {
+			return &user, nil
+		}
+	}
+	return nil, models.ErrUserNotFound
+}
+
+func (store *memoryUserStore) GetUsersByUsernames(usernames []string) ([]models.User, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	uniqueUsernames := map[string]bool{}
+	for _, username := range usernames {
+		uniqueUsernames[strings.ToLower(username)] = true
+	}
+
+	users := []models.User{}
+	for _, user := range store.memory.users {
+		if uniqueUsernames[user.Username] {
+			users = append(users, user)
+		}
+	}
+	if len(users) != len(uniqueUsernames) {
+		return nil, models.ErrUserNotFound
+	}
+	return users, nil
+}
+
+// SearchUsers matches by prefix like the Postgres store, but falls back to
+// substring matches instead of trigram similarity.
+func (store *memoryUserStore) SearchUsers(searcher *models.User, query string, offset int,
+	limit int) ([]models.User, bool, error) {
+	if limit <= 0 {
+		limit = models.DefaultUserSearchPageSize
+	} else if limit > models.MaxUserSearchPageSize {
+		limit = models.MaxUserSearchPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	isPrefixMatch := func(user *models.User) bool {
+		name := strings.ToLower(user.Name)
+		return strings.HasPrefix(user.Username, query) || strings.HasPrefix(name, query) ||
+			strings.Contains(name, " "+query)
+	}
+
+	matches := []models.User{}
+	for _, user := range store.memory.users {
+		if !user.Discoverable || strings.HasPrefix(user.Username, "demo_") || user.ID == searcher.ID {
+			continue
+		}
+		if query == "" || isPrefixMatch(&user) || strings.Contains(user.Username, query) ||
+			strings.Contains(strings.ToLower(user.Name), query) {
+			user.Password = ""
+			matches = append(matches, user)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		iPrefix, jPrefix := isPrefixMatch(&matches[i]), isPrefixMatch(&matches[j])
+		if iPrefix != jPrefix {
+			return iPrefix
+		}
+		return matches[i].Username < matches[j].Username
+	})
+
+	if offset >= len(matches) {
+		return []models.User{}, false, nil
+	}
+	matches = matches[offset:]
+	hasMore := len(matches) > limit
+	if hasMore {
+		matches = matches[:limit]
+	}
+	return matches, hasMore, nil
+}
+
+func (store *memoryUserStore) SetDiscoverable(user *models.User, discoverable bool) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	storedUser, ok := store.memory.users[user.ID]
+	if !ok {
+		return models.ErrUserNotFound
+	}
+	storedUser.Discoverable = discoverable
+	store.memory.users[user.ID] = storedUser
+	user.Discoverable = discoverable
+	return nil
+}
+
+func (store *memoryUserStore) UpdateLastSeen(userID int, lastSeen time.Time) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	user, ok := store.memory.users[userID]
+	if ok {
+		user.LastSeenAt = &lastSeen
+		store.memory.users[userID] = user
+	}
+	return nil
+}
+
+func (store *memoryUserStore) GetContactIDs(userID int) ([]int, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	contacts := map[int]bool{}
+	for conversationID, stored := range store.memory.conversations {
+		if !store.memory.isMember(conversationID, userID) {
+			continue
+		}
+		for _, memberID := range stored.memberIDs {
+			if memberID != userID {
+				contacts[memberID] = true
+			}
+		}
+	}
+
+	contactIDs := []int{}
+	for contactID := range contacts {
+		contactIDs = append(contactIDs, contactID)
+	}
+	return contactIDs, nil
+}
+
+type memorySessionStore struct {
+	memory *memoryDB
+}
+
+func (store *memorySessionStore) CreateSession(username string, password string, userAgent string,
+	ipAddress string) (*models.Session, *models.User, error) {
+	unlockLogin := store.memory.lockLogin(username, ipAddress)
+	defer unlockLogin()
+
+	store.memory.mutex.Lock()
+	err := store.memory.checkLoginThrottle(username, ipAddress, time.Now())
+	var user *models.User
+	for _, storedUser := range store.memory.users {
+		if storedUser.Username == username {
+			user = &storedUser
+			break
+		}
+	}
+	store.memory.mutex.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The password is verified without holding the store's mutex, since
+	// hashing is slow.
+	newHash, loginErr := models.CheckLoginPassword(user, password)
+	if loginErr != nil && !errors.Is(loginErr, models.ErrInvalidCred) {
+		return nil, nil, loginErr
+	}
+
+	store.memory.mutex.Lock()
+	if newHash != "" {
+		storedUser := store.memory.users[user.ID]
+		storedUser.Password = newHash
+		store.memory.users[user.ID] = storedUser
+		user.Password = newHash
+	}
+	attempt := models.LoginAttempt{
+		ID:        store.memory.nextID(),
+		Username:  username,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		Success:   loginErr == nil,
+		CreatedAt: time.Now(),
+	}
+	if user != nil {
+		attempt.UserID = &user.ID
+	}
+	store.memory.loginAttempts = append(store.memory.loginAttempts, attempt)
+	store.memory.mutex.Unlock()
+
+	if loginErr != nil {
+		return nil, nil, loginErr
+	}
+
+	randBytes := make([]byte, 18)
+	_, err = rand.Read(randBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error generating session key: %w", err)
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	now := time.Now()
+	session := models.Session{
+		ID:         store.memory.nextID(),
+		Key:        base64.URLEncoding.EncodeToString(randBytes),
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		CreatedAt:  now,
+		AccessedAt: now,
+	}
+	store.memory.sessions[session.ID] = session
+
+	session.User = *user
+	return &session, user, nil
+}
+
+// lockLogin locks the username and IP address, so that concurrent attempts
+// for either can't all pass the throttle before any of them is recorded.
+// Logins for other usernames and addresses aren't held up. The username is
+// always locked first, so two logins can't each wait for the other's lock.
+func (memory *memoryDB) lockLogin(username string, ipAddress string) func() {
+	keys := []string{"username:" + username, "ip:" + ipAddress}
+	for _, key := range keys {
+		memory.mutex.Lock()
+		lock, ok := memory.loginLocks[key]
+		if !ok {
+			lock = &loginLock{}
+			memory.loginLocks[key] = lock
+		}
+		lock.holders++
+		memory.mutex.Unlock()
+
+		lock.mutex.Lock()
+	}
+
+	return func() {
+		memory.mutex.Lock()
+		defer memory.mutex.Unlock()
+
+		for _, key := range keys {
+			lock := memory.loginLocks[key]
+			lock.mutex.Unlock()
+			lock.holders--
+			if lock.holders == 0 {
+				delete(memory.loginLocks, key)
+			}
+		}
+	}
+}
+
+func (store *memorySessionStore) GetSessionFromKey(key string) (*models.Session, error) {
+	if key == "" {
+		return nil, models.ErrSessionNotFound
+	}
+
+	store.memory.mutex.Lock()
+	var session *models.Session
+	for _, storedSession := range store.memory.sessions {
+		if storedSession.Key == key {
+			storedSession.User = store.memory.users[storedSession.UserID]
+			session = &storedSession
+			break
+		}
+	}
+	store.memory.mutex.Unlock()
+
+	if session == nil {
+		return nil, models.ErrSessionNotFound
+	}
+	err := store.TouchSession(session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (store *memorySessionStore) TouchSession(session *models.Session) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	storedSession, ok := store.memory.sessions[session.ID]
+	if !ok {
+		return models.ErrSessionNotFound
+	}
+
+	now := time.Now()
+	if session.IsExpired(now) {
+		delete(store.memory.sessions, session.ID)
+		return models.ErrSessionNotFound
+	}
+	storedSession.AccessedAt = now
+	store.memory.sessions[session.ID] = storedSession
+	session.AccessedAt = now
+	return nil
+}
+
+func (store *memorySessionStore) DeleteSession(session *models.Session) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	delete(store.memory.sessions, session.ID)
+	return nil
+}
+
+func (store *memorySessionStore) GetSessions(user *models.User) ([]models.Session, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	now := time.Now()
+	sessions := []models.Session{}
+	for _, session := range store.memory.sessions {
+		if session.UserID == user.ID && !session.IsExpired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].AccessedAt.After(sessions[j].AccessedAt)
+	})
+	return sessions, nil
+}
+
+func (store *memorySessionStore) DeleteUserSession(user *models.User, sessionID int) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	session, ok := store.memory.sessions[sessionID]
+	if !ok || session.UserID != user.ID {
+		return models.ErrSessionNotFound
+	}
+	delete(store.memory.sessions, sessionID)
+	return nil
+}
+
+func (store *memorySessionStore) DeleteOtherSessions(session *models.Session) ([]int, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	deletedIDs := []int{}
+	for sessionID, storedSession := range store.memory.sessions {
+		if storedSession.UserID == session.UserID && sessionID != session.ID {
+			delete(store.memory.sessions, sessionID)
+			deletedIDs = append(deletedIDs, sessionID)
+		}
+	}
+	return deletedIDs, nil
+}
+
+// checkLoginThrottle counts failures the same way as the Postgres store.
+func (memory *memoryDB) checkLoginThrottle(username string, ipAddress string, now time.Time) error {
+	windowStart := now.Add(-models.LoginAttemptWindow)
+
+	var lastSuccess time.Time
+	for _, attempt := range memory.loginAttempts {
+		if attempt.Username == username && attempt.Success && attempt.CreatedAt.After(lastSuccess) {
+			lastSuccess = attempt.CreatedAt
+		}
+	}
+
+	var ipFailures, usernameFailures models.LoginFailures
+	for _, attempt := range memory.loginAttempts {
+		if attempt.Success || !attempt.CreatedAt.After(windowStart) {
+			continue
+		}
+		if attempt.IPAddress == ipAddress {
+			countLoginFailure(&ipFailures, attempt.CreatedAt)
+		}
+		if attempt.Username == username && attempt.CreatedAt.After(lastSuccess) {
+			countLoginFailure(&usernameFailures, attempt.CreatedAt)
+		}
+	}
+	return models.ThrottleLogin(ipFailures, usernameFailures, now)
+}
+
+func countLoginFailure(failures *models.LoginFailures, createdAt time.Time) {
+	failures.Failures++
+	if failures.LastFailure == nil || createdAt.After(*failures.LastFailure) {
+		failures.LastFailure = &createdAt
+	}
+}
+
+type memoryLoginAttemptStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryLoginAttemptStore) GetLoginAttempts(user *models.User,
+	limit int) ([]models.LoginAttempt, error) {
+	if limit <= 0 || limit > models.MaxLoginAttemptsPageSize {
+		limit = models.MaxLoginAttemptsPageSize
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	attempts := []models.LoginAttempt{}
+	for i := len(store.memory.loginAttempts) - 1; i >= 0 && len(attempts) < limit; i-- {
+		attempt := store.memory.loginAttempts[i]
+		if attempt.UserID != nil && *attempt.UserID == user.ID {
+			attempts = append(attempts, attempt)
+		}
+	}
+	return attempts, nil
+}
+
+func (store *memoryLoginAttemptStore) PruneLoginAttempts() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	cutoff := time.Now().Add(-models.LoginAttemptRetention)
+	attempts := []models.LoginAttempt{}
+	for _, attempt := range store.memory.loginAttempts {
+		if !attempt.CreatedAt.Before(cutoff) {
+			attempts = append(attempts, attempt)
+		}
+	}
+	store.memory.loginAttempts = attempts
+	return nil
+}
+
+type memoryConversationStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryConversationStore) GetUserConversations(user *models.User, cursor string,
+	limit int) (*models.ConversationPage, error) {
+	if limit <= 0 {
+		limit = models.DefaultConversationPageSize
+	} else if limit > models.MaxConversationPageSize {
+		limit = models.MaxConversationPageSize
+	}
+
+	var cursorActivityAt time.Time
+	var cursorID int
+	if cursor != "" {
+		var err error
+		cursorActivityAt, cursorID, err = models.DecodeConversationCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	conversations := []models.Conversation{}
+	for conversationID, stored := range store.memory.conversations {
+		if !store.memory.isMember(conversationID, user.ID) {
+			continue
+		}
+		if cursor != "" && !conversationBefore(&stored.conversation, cursorActivityAt, cursorID) {
+			continue
+		}
+
+		conversation := store.memory.loadConversation(conversationID)
+		if conversation.LastMessageID != nil {
+			conversation.LastMessage = store.memory.loadMessage(*conversation.LastMessageID)
+		}
+		conversations = append(conversations, *conversation)
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return !conversationBefore(&conversations[i], conversations[j].LastActivityAt, conversations[j].ID)
+	})
+
+	page := &models.ConversationPage{Conversations: conversations}
+	if len(conversations) > limit {
+		page.Conversations = conversations[:limit]
+		page.NextCursor = models.EncodeConversationCursor(&page.Conversations[limit-1])
+	}
+	return page, nil
+}
+
+// conversationBefore reports whether conversation was last active before the
+// given time, using IDs to break ties like the Postgres store.
+func conversationBefore(conversation *models.Conversation, lastActivityAt time.Time, id int) bool {
+	if !conversation.LastActivityAt.Equal(lastActivityAt) {
+		return conversation.LastActivityAt.Before(lastActivityAt)
+	}
+	return conversation.ID < id
+}
+
+func (store *memoryConversationStore) GetDirectConversation(sender *models.User,
+	recipient *models.User) (*models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.memory.getDirectConversation(sender.ID, recipient.ID)
+}
+
+func (memory *memoryDB) getDirectConversation(senderID int, recipientID int) (*models.Conversation, error) {
+	lowUserID, highUserID := models.DirectConversationKey(senderID, recipientID)
+	for conversationID, stored := range memory.conversations {
+		conversation := &stored.conversation
+		if conversation.LowUserID != nil && *conversation.LowUserID == lowUserID &&
+			*conversation.HighUserID == highUserID {
+			return memory.loadConversation(conversationID), nil
+		}
+	}
+	return nil, models.ErrConversationNotFound
+}
+
+func (store *memoryConversationStore) GetUserConversation(user *models.User,
+	conversationID int) (*models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.memory.getUserConversation(user.ID, conversationID)
+}
+
+func (memory *memoryDB) getUserConversation(userID int, conversationID int) (*models.Conversation, error) {
+	if !memory.isMember(conversationID, userID) {
+		return nil, models.ErrConversationNotFound
+	}
+	return memory.loadConversation(conversationID), nil
+}
+
+func (store *memoryConversationStore) CreateGroupConversation(creator *models.User, title string,
+	members []models.User) (*models.Conversation, error) {
+	conversation := &models.Conversation{
+		Title:     title,
+		IsGroup:   true,
+		CreatorID: creator.ID,
+		Users:     []models.User{*creator},
+	}
+	for _, member := range members {
+		if !conversation.HasMember(&member) {
+			conversation.Users = append(conversation.Users, member)
+		}
+	}
+	if len(conversation.Users) > models.MaxGroupMembers {
+		return nil, models.ErrTooManyMembers
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	conversation.ID = store.memory.nextID()
+	conversation.CreatedAt = time.Now()
+	conversation.LastActivityAt = conversation.CreatedAt
+	store.memory.conversations[conversation.ID] = memoryConversation{
+		conversation: models.Conversation{
+			ID:             conversation.ID,
+			Title:          conversation.Title,
+			IsGroup:        conversation.IsGroup,
+			CreatorID:      conversation.CreatorID,
+			LastActivityAt: conversation.LastActivityAt,
+			CreatedAt:      conversation.CreatedAt,
+		},
+		memberIDs: conversation.MemberIDs(),
+	}
+	conversation.Created = true
+	return conversation, nil
+}
+
+func (store *memoryConversationStore) AddMembers(conversation *models.Conversation, members []models.User) error {
+	if !conversation.IsGroup {
+		return models.ErrNotGroupConversation
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	stored, ok := store.memory.conversations[conversation.ID]
+	if !ok {
+		return models.ErrConversationNotFound
+	}
+	isMember := map[int]bool{}
+	for _, memberID := range stored.memberIDs {
+		isMember[memberID] = true
+	}
+	newMembers := []models.User{}
+	for _, member := range members {
+		if !isMember[member.ID] {
+			isMember[member.ID] = true
+			stored.memberIDs = append(stored.memberIDs, member.ID)
+			newMembers = append(newMembers, member)
+		}
+	}
+	if len(newMembers) == 0 {
+		return nil
+	}
+	if len(stored.memberIDs) > models.MaxGroupMembers {
+		return models.ErrTooManyMembers
+	}
+	store.memory.conversations[conversation.ID] = stored
+	conversation.Users = append(conversation.Users, newMembers...)
+	return nil
+}
+
+func (store *memoryConversationStore) RemoveMember(conversation *models.Conversation, actor *models.User,
+	member *models.User) error {
+	if !conversation.IsGroup {
+		return models.ErrNotGroupConversation
+	}
+	if !conversation.HasMember(member) {
+		return models.ErrNotConversationMember
+	}
+	if actor.ID != member.ID && actor.ID != conversation.CreatorID {
+		return models.ErrNotConversationCreator
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	stored, ok := store.memory.conversations[conversation.ID]
+	if !ok {
+		return models.ErrConversationNotFound
+	}
+	memberIDs := []int{}
+	for _, memberID := range stored.memberIDs {
+		if memberID != member.ID {
+			memberIDs = append(memberIDs, memberID)
+		}
+	}
+	stored.memberIDs = memberIDs
+	// memberIDs are in the order members joined.
+	if member.ID == stored.conversation.CreatorID {
+		stored.conversation.CreatorID = 0
+		if len(memberIDs) > 0 {
+			stored.conversation.CreatorID = memberIDs[0]
+		}
+	}
+	store.memory.conversations[conversation.ID] = stored
+
+	users := []models.User{}
+	for _, user := range conversation.Users {
+		if user.ID != member.ID {
+			users = append(users, user)
+		}
+	}
+	conversation.Users = users
+	conversation.CreatorID = stored.conversation.CreatorID
+	return nil
+}
+
+type memoryMessageStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryMessageStore) CreateMessage(sender *models.User, recipient *models.User, body string,
+	options models.MessageOptions) (*models.Message, *models.Conversation, error) {
+	if sender.ID == recipient.ID {
+		return nil, nil, models.ErrSameUser
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	conversation, err := store.memory.getDirectConversation(sender.ID, recipient.ID)
+	if err == models.ErrConversationNotFound {
+		if options.ReplyToID != 0 {
+			return nil, nil, models.ErrInvalidReply
+		}
+		err := store.memory.checkAttachments(sender.ID, options.AttachmentIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lowUserID, highUserID := models.DirectConversationKey(sender.ID, recipient.ID)
+		conversationID := store.memory.nextID()
+		store.memory.conversations[conversationID] = memoryConversation{
+			conversation: models.Conversation{
+				ID:             conversationID,
+				LowUserID:      &lowUserID,
+				HighUserID:     &highUserID,
+				LastActivityAt: time.Now(),
+				CreatedAt:      time.Now(),
+			},
+			memberIDs: []int{sender.ID, recipient.ID},
+		}
+		conversation = store.memory.loadConversation(conversationID)
+		conversation.Created = true
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	message, err := store.memory.createMessage(sender, conversation.ID, body, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, conversation, nil
+}
+
+func (store *memoryMessageStore) CreateConversationMessage(sender *models.User, conversationID int,
+	body string, options models.MessageOptions) (*models.Message, *models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	conversation, err := store.memory.getUserConversation(sender.ID, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message, err := store.memory.createMessage(sender, conversation.ID, body, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return message, conversation, nil
+}
+
+func (memory *memoryDB) createMessage(sender *models.User, conversationID int, body string,
+	options models.MessageOptions) (*models.Message, error) {
+	replyToID := options.ReplyToID
+
+	message := models.Message{
+		UserID:         sender.ID,
+		ConversationID: conversationID,
+		Body:           body,
+		CreatedAt:      time.Now(),
+	}
+	if replyToID != 0 {
+		replyTo, ok := memory.messages[replyToID]
+		if !ok || replyTo.ConversationID != conversationID {
+			return nil, models.ErrInvalidReply
+		}
+		message.ReplyToID = &replyToID
+	}
+	err := memory.checkAttachments(sender.ID, options.AttachmentIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	message.ID = memory.nextID()
+	memory.messages[message.ID] = message
+	for _, attachmentID := range options.AttachmentIDs {
+		attachment := memory.attachments[attachmentID]
+		attachment.MessageID = &message.ID
+		memory.attachments[attachmentID] = attachment
+	}
+
+	stored := memory.conversations[conversationID]
+	stored.conversation.LastMessageID = &message.ID
+	stored.conversation.LastActivityAt = message.CreatedAt
+	memory.conversations[conversationID] = stored
+	return memory.loadMessage(message.ID), nil
+}
+
+func (store *memoryMessageStore) GetMessagePage(conversationID int, beforeID int, afterID int,
+	limit int) (*models.MessagePage, error) {
+	if beforeID != 0 && afterID != 0 {
+		return nil, models.ErrInvalidPageCursor
+	}
+	if limit <= 0 {
+		limit = models.DefaultMessagePageSize
+	} else if limit > models.MaxMessagePageSize {
+		limit = models.MaxMessagePageSize
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	messages := []models.Message{}
+	for messageID, message := range store.memory.messages {
+		if message.ConversationID == conversationID {
+			messages = append(messages, *store.memory.loadMessage(messageID))
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messageBefore(&messages[i], &messages[j])
+	})
+
+	cursorID := beforeID
+	if afterID != 0 {
+		cursorID = afterID
+	}
+	if cursorID != 0 {
+		cursor, ok := store.memory.messages[cursorID]
+		if !ok || cursor.ConversationID != conversationID {
+			return nil, models.ErrMessageNotFound
+		}
+
+		window := []models.Message{}
+		for _, message := range messages {
+			if afterID != 0 && messageBefore(&cursor, &message) ||
+				beforeID != 0 && messageBefore(&message, &cursor) {
+				window = append(window, message)
+			}
+		}
+		messages = window
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		if afterID != 0 {
+			messages = messages[:limit]
+		} else {
+			messages = messages[len(messages)-limit:]
+		}
+	}
+
+	page := &models.MessagePage{Messages: messages}
+	if len(messages) == 0 {
+		return page, nil
+	}
+	oldestID, newestID := messages[0].ID, messages[len(messages)-1].ID
+	if afterID != 0 {
+		page.PrevCursor = oldestID
+		if hasMore {
+			page.NextCursor = newestID
+		}
+	} else {
+		if hasMore {
+			page.PrevCursor = oldestID
+		}
+		if beforeID != 0 {
+			page.NextCursor = newestID
+		}
+	}
+	return page, nil
+}
+
+// messageBefore orders messages the same way as the Postgres store, by
+// creation time and then ID.
+func messageBefore(a *models.Message, b *models.Message) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+func (store *memoryMessageStore) GetUserMessage(user *models.User,
+	messageID int) (*models.Message, *models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	return store.memory.getUserMessage(user.ID, messageID)
+}
+
+func (memory *memoryDB) getUserMessage(userID int, messageID int) (*models.Message, *models.Conversation, error) {
+	message, ok := memory.messages[messageID]
+	if !ok || !memory.isMember(message.ConversationID, userID) {
+		return nil, nil, models.ErrMessageNotFound
+	}
+	return memory.loadMessage(messageID), memory.loadConversation(message.ConversationID), nil
+}
+
+// getSenderMessage is like getUserMessage, but also requires that the user
+// sent the message and that it hasn't been deleted.
+func (memory *memoryDB) getSenderMessage(userID int, messageID int) (*models.Message, *models.Conversation, error) {
+	message, conversation, err := memory.getUserMessage(userID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if message.UserID != userID {
+		return nil, nil, models.ErrNotMessageSender
+	}
+	if message.DeletedAt != nil {
+		return nil, nil, models.ErrMessageDeleted
+	}
+	return message, conversation, nil
+}
+
+// reviseMessage keeps the message's current body as a revision, then
+// applies update to it.
+func (memory *memoryDB) reviseMessage(message *models.Message, update func(message *models.Message)) {
+	memory.revisions = append(memory.revisions, models.MessageRevision{
+		ID:        memory.nextID(),
+		MessageID: message.ID,
+		Body:      message.Body,
+		CreatedAt: time.Now(),
+	})
+
+	update(message)
+	stored := memory.messages[message.ID]
+	update(&stored)
+	memory.messages[message.ID] = stored
+}
+
+func (store *memoryMessageStore) EditMessage(user *models.User, messageID int,
+	body string) (*models.Message, *models.Conversation, error) {
+	if strings.TrimSpace(body) == "" {
+		return nil, nil, models.ErrEmptyMessageBody
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	message, conversation, err := store.memory.getSenderMessage(user.ID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	store.memory.reviseMessage(message, func(message *models.Message) {
+		message.Body = body
+		message.EditedAt = &now
+	})
+	return message, conversation, nil
+}
+
+func (store *memoryMessageStore) DeleteMessage(user *models.User,
+	messageID int) (*models.Message, *models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	message, conversation, err := store.memory.getSenderMessage(user.ID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	store.memory.reviseMessage(message, func(message *models.Message) {
+		message.Body = ""
+		message.DeletedAt = &now
+	})
+	return message, conversation, nil
+}
+
+func (store *memoryMessageStore) GetMessageRevisions(user *models.User,
+	messageID int) ([]models.MessageRevision, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	message, _, err := store.memory.getUserMessage(user.ID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.UserID != user.ID {
+		return nil, models.ErrNotMessageSender
+	}
+
+	revisions := []models.MessageRevision{}
+	for _, revision := range store.memory.revisions {
+		if revision.MessageID == message.ID {
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions, nil
+}
+
+func (store *memoryMessageStore) GetMessageThread(user *models.User,
+	messageID int) (*models.Message, []models.Message, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	message, _, err := store.memory.getUserMessage(user.ID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replies := []models.Message{}
+	for _, reply := range store.memory.messages {
+		if reply.ReplyToID != nil && *reply.ReplyToID == message.ID {
+			reply.ReplyTo = message
+			replies = append(replies, reply)
+		}
+	}
+	sort.Slice(replies, func(i, j int) bool {
+		return messageBefore(&replies[i], &replies[j])
+	})
+	if len(replies) > models.MaxThreadSize {
+		replies = replies[:models.MaxThreadSize]
+	}
+	return message, replies, nil
+}
+
+// SearchMessages matches messages that contain every word of the query,
+// ranked by how often the words appear, instead of using Postgres text
+// search.
+func (store *memoryMessageStore) SearchMessages(user *models.User,
+	search *models.MessageSearch) ([]models.MessageSearchResult, string, error) {
+	terms := strings.Fields(strings.ToLower(search.Query))
+	if len(terms) == 0 {
+		return nil, "", models.ErrEmptySearchQuery
+	}
+	limit := search.Limit
+	if limit <= 0 {
+		limit = models.DefaultSearchPageSize
+	} else if limit > models.MaxSearchPageSize {
+		limit = models.MaxSearchPageSize
+	}
+
+	var cursorRank float32
+	var cursorID int
+	if search.Cursor != "" {
+		var err error
+		cursorRank, cursorID, err = models.DecodeSearchCursor(search.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	results := []models.MessageSearchResult{}
+	for _, message := range store.memory.messages {
+		if message.DeletedAt != nil || !store.memory.isMember(message.ConversationID, user.ID) ||
+			(search.ConversationID != 0 && message.ConversationID != search.ConversationID) ||
+			(search.SenderID != 0 && message.UserID != search.SenderID) ||
+			(search.From != nil && message.CreatedAt.Before(*search.From)) ||
+			(search.To != nil && !message.CreatedAt.Before(*search.To)) {
+			continue
+		}
+
+		body := strings.ToLower(message.Body)
+		matches := 0
+		for _, term := range terms {
+			count := strings.Count(body, term)
+			if count == 0 {
+				matches = 0
+				break
+			}
+			matches += count
+		}
+		if matches == 0 {
+			continue
+		}
+
+		rank := float32(matches) / float32(len(strings.Fields(body)))
+		if search.Cursor != "" && !(rank < cursorRank || (rank == cursorRank && message.ID < cursorID)) {
+			continue
+		}
+		results = append(results, models.MessageSearchResult{
+			ID:             message.ID,
+			ConversationID: message.ConversationID,
+			UserID:         message.UserID,
+			Body:           message.Body,
+			CreatedAt:      message.CreatedAt,
+			EditedAt:       message.EditedAt,
+			Rank:           rank,
+			Snippet:        searchSnippet(message.Body, terms),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID > results[j].ID
+	})
+
+	nextCursor := ""
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[len(results)-1]
+		nextCursor = models.EncodeSearchCursor(last.Rank, last.ID)
+	}
+	return results, nextCursor, nil
+}
+
+// searchSnippet escapes body as HTML and wraps the terms in <mark> tags, like
+// the Postgres store's snippets.
+func searchSnippet(body string, terms []string) string {
+	patterns := []string{}
+	for _, term := range terms {
+		patterns = append(patterns, regexp.QuoteMeta(html.EscapeString(term)))
+	}
+	termRegexp := regexp.MustCompile("(?i)" + strings.Join(patterns, "|"))
+	return termRegexp.ReplaceAllString(html.EscapeString(body), "<mark>$0</mark>")
+}
+
+type memoryReadMarkerStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryReadMarkerStore) MarkRead(user *models.User, conversationID int,
+	messageID int) (*models.ReadMarker, *models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	conversation, err := store.memory.getUserConversation(user.ID, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	message, ok := store.memory.messages[messageID]
+	if !ok || message.ConversationID != conversation.ID {
+		return nil, nil, models.ErrMessageNotFound
+	}
+
+	key := readMarkerKey{userID: user.ID, conversationID: conversation.ID}
+	marker := store.memory.readMarkers[key]
+	marker.UserID = user.ID
+	marker.ConversationID = conversation.ID
+	if message.ID > marker.LastReadMessageID {
+		marker.LastReadMessageID = message.ID
+	}
+	marker.UpdatedAt = time.Now()
+	store.memory.readMarkers[key] = marker
+	return &marker, conversation, nil
+}
+
+func (store *memoryReadMarkerStore) GetReadStates(user *models.User,
+	conversationIDs []int) (map[int]models.ConversationReadState, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	readStates := make(map[int]models.ConversationReadState)
+	for _, conversationID := range conversationIDs {
+		if !store.memory.isMember(conversationID, user.ID) {
+			continue
+		}
+
+		marker := store.memory.readMarkers[readMarkerKey{userID: user.ID, conversationID: conversationID}]
+		readState := models.ConversationReadState{
+			ConversationID:    conversationID,
+			LastReadMessageID: marker.LastReadMessageID,
+		}
+		for _, message := range store.memory.messages {
+			if message.ConversationID == conversationID && message.UserID != user.ID &&
+				message.ID > marker.LastReadMessageID {
+				readState.UnreadCount++
+			}
+		}
+		readStates[conversationID] = readState
+	}
+	return readStates, nil
+}
+
+type memoryReactionStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryReactionStore) AddReaction(user *models.User, messageID int,
+	emoji string) (*models.Reaction, *models.Conversation, error) {
+	if !models.ValidEmoji(emoji) {
+		return nil, nil, models.ErrInvalidEmoji
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	message, conversation, err := store.memory.getUserMessage(user.ID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if message.DeletedAt != nil {
+		return nil, nil, models.ErrMessageDeleted
+	}
+	if store.memory.findReaction(message.ID, user.ID, emoji) >= 0 {
+		return nil, nil, models.ErrDuplicateReaction
+	}
+
+	reaction := models.Reaction{
+		MessageID: message.ID,
+		UserID:    user.ID,
+		Emoji:     emoji,
+		CreatedAt: time.Now(),
+	}
+	store.memory.reactions = append(store.memory.reactions, reaction)
+	return &reaction, conversation, nil
+}
+
+func (store *memoryReactionStore) RemoveReaction(user *models.User, messageID int,
+	emoji string) (*models.Reaction, *models.Conversation, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	message, conversation, err := store.memory.getUserMessage(user.ID, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	i := store.memory.findReaction(message.ID, user.ID, emoji)
+	if i < 0 {
+		return nil, nil, models.ErrReactionNotFound
+	}
+
+	reaction := store.memory.reactions[i]
+	store.memory.reactions = append(store.memory.reactions[:i], store.memory.reactions[i+1:]...)
+	return &reaction, conversation, nil
+}
+
+func (memory *memoryDB) findReaction(messageID int, userID int, emoji string) int {
+	for i, reaction := range memory.reactions {
+		if reaction.MessageID == messageID && reaction.UserID == userID && reaction.Emoji == emoji {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetReactionCounts orders each message's counts by when the emoji was first
+// used, like the Postgres store. Reactions are kept in the order they were
+// added, so that is the order in which their emoji are first seen.
+func (store *memoryReactionStore) GetReactionCounts(user *models.User,
+	messageIDs []int) (map[int][]models.ReactionCount, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	isRequested := map[int]bool{}
+	for _, messageID := range messageIDs {
+		isRequested[messageID] = true
+	}
+
+	reactionCounts := make(map[int][]models.ReactionCount)
+	for _, reaction := range store.memory.reactions {
+		if !isRequested[reaction.MessageID] {
+			continue
+		}
+
+		counts := reactionCounts[reaction.MessageID]
+		i := 0
+		for i < len(counts) && counts[i].Emoji != reaction.Emoji {
+			i++
+		}
+		if i == len(counts) {
+			counts = append(counts, models.ReactionCount{MessageID: reaction.MessageID, Emoji: reaction.Emoji})
+		}
+		counts[i].Count++
+		counts[i].Reacted = counts[i].Reacted || reaction.UserID == user.ID
+		reactionCounts[reaction.MessageID] = counts
+	}
+	return reactionCounts, nil
+}
+
+type memoryEventStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryEventStore) AppendUserEvents(userIDs []int, method string,
+	data interface{}) (map[int]int64, error) {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	seqs := make(map[int]int64)
+	for _, userID := range userIDs {
+		if _, ok := seqs[userID]; ok {
+			continue
+		}
+		user, ok := store.memory.users[userID]
+		if !ok {
+			continue
+		}
+
+		user.EventSeq++
+		store.memory.users[userID] = user
+		event := models.UserEvent{
+			ID:        int64(store.memory.nextID()),
+			UserID:    userID,
+			Seq:       user.EventSeq,
+			Method:    method,
+			Data:      string(encodedData),
+			CreatedAt: time.Now(),
+		}
+		store.memory.events[userID] = append(store.memory.events[userID], event)
+		seqs[userID] = event.Seq
+	}
+	return seqs, nil
+}
+
+func (store *memoryEventStore) GetUserEventsSince(userID int, seq int64,
+	limit int) ([]models.UserEvent, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	events := []models.UserEvent{}
+	for _, event := range store.memory.events[userID] {
+		if event.Seq > seq && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (store *memoryEventStore) GetUserEventSeq(userID int) (int64, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	user, ok := store.memory.users[userID]
+	if !ok {
+		return 0, models.ErrUserNotFound
+	}
+	return user.EventSeq, nil
+}
+
+func (store *memoryEventStore) PruneUserEvents() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	cutoff := time.Now().Add(-models.UserEventRetention)
+	for userID, userEvents := range store.memory.events {
+		events := []models.UserEvent{}
+		for _, event := range userEvents {
+			if !event.CreatedAt.Before(cutoff) {
+				events = append(events, event)
+			}
+		}
+		store.memory.events[userID] = events
+	}
+	return nil
+}
+
+type memoryWebhookStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryWebhookStore) CreateWebhook(user *models.User, webhookURL string,
+	events []string) (*models.Webhook, error) {
+	webhook, err := models.NewWebhook(user, webhookURL, events)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	webhookCount := 0
+	for _, storedWebhook := range store.memory.webhooks {
+		if storedWebhook.UserID == user.ID {
+			webhookCount++
+		}
+	}
+	if webhookCount >= models.MaxWebhooksPerUser {
+		return nil, models.ErrTooManyWebhooks
+	}
+
+	webhook.ID = store.memory.nextID()
+	webhook.CreatedAt = time.Now()
+	store.memory.webhooks[webhook.ID] = *webhook
+	return webhook, nil
+}
+
+func (store *memoryWebhookStore) GetWebhooks(user *models.User) ([]models.Webhook, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	webhooks := []models.Webhook{}
+	for _, webhook := range store.memory.webhooks {
+		if webhook.UserID == user.ID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks, nil
+}
+
+func (memory *memoryDB) getUserWebhook(userID int, webhookID int) (*models.Webhook, error) {
+	webhook, ok := memory.webhooks[webhookID]
+	if !ok || webhook.UserID != userID {
+		return nil, models.ErrWebhookNotFound
+	}
+	return &webhook, nil
+}
+
+func (store *memoryWebhookStore) DeleteWebhook(user *models.User, webhookID int) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	_, err := store.memory.getUserWebhook(user.ID, webhookID)
+	if err != nil {
+		return err
+	}
+	delete(store.memory.webhooks, webhookID)
+	for deliveryID, delivery := range store.memory.deliveries {
+		if delivery.WebhookID == webhookID {
+			delete(store.memory.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (store *memoryWebhookStore) EnqueueWebhookEvent(event string, userIDs []int, data interface{}) error {
+	payload, err := models.EncodeWebhookPayload(event, data)
+	if err != nil {
+		return err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	isRecipient := map[int]bool{}
+	for _, userID := range userIDs {
+		isRecipient[userID] = true
+	}
+
+	now := time.Now()
+	for _, webhook := range store.memory.webhooks {
+		if !webhook.IsSubscribed(event) {
+			continue
+		}
+		owner := store.memory.users[webhook.UserID]
+		if event == models.WebhookEventUserRegistered {
+			if !models.IsWebhookAdmin(&owner) {
+				continue
+			}
+		} else if !isRecipient[webhook.UserID] {
+			continue
+		}
+
+		delivery := models.WebhookDelivery{
+			ID:            int64(store.memory.nextID()),
+			WebhookID:     webhook.ID,
+			Event:         event,
+			Payload:       payload,
+			Status:        models.WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		store.memory.deliveries[delivery.ID] = delivery
+	}
+	return nil
+}
+
+func (store *memoryWebhookStore) ClaimWebhookDeliveries(limit int,
+	lease time.Duration) ([]models.WebhookDelivery, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	now := time.Now()
+	due := []models.WebhookDelivery{}
+	for _, delivery := range store.memory.deliveries {
+		if delivery.Status == models.WebhookDeliveryPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i := range due {
+		due[i].NextAttemptAt = now.Add(lease)
+		store.memory.deliveries[due[i].ID] = due[i]
+
+		webhook := store.memory.webhooks[due[i].WebhookID]
+		due[i].Webhook = &webhook
+	}
+	return due, nil
+}
+
+func (store *memoryWebhookStore) RecordWebhookAttempt(delivery *models.WebhookDelivery, responseStatus int,
+	deliveryErr error) error {
+	delivery.RecordAttempt(responseStatus, deliveryErr, time.Now())
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	if _, ok := store.memory.deliveries[delivery.ID]; ok {
+		stored := *delivery
+		stored.Webhook = nil
+		store.memory.deliveries[delivery.ID] = stored
+	}
+	return nil
+}
+
+func (store *memoryWebhookStore) GetWebhookDeliveries(user *models.User, webhookID int, status string,
+	limit int) ([]models.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = models.DefaultWebhookDeliveriesPageSize
+	} else if limit > models.MaxWebhookDeliveriesPageSize {
+		limit = models.MaxWebhookDeliveriesPageSize
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	webhook, err := store.memory.getUserWebhook(user.ID, webhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	for _, delivery := range store.memory.deliveries {
+		if delivery.WebhookID == webhook.ID && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+		}
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (store *memoryWebhookStore) RedeliverWebhookDelivery(user *models.User, webhookID int,
+	deliveryID int64) (*models.WebhookDelivery, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	webhook, err := store.memory.getUserWebhook(user.ID, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	delivery, ok := store.memory.deliveries[deliveryID]
+	if !ok || delivery.WebhookID != webhook.ID {
+		return nil, models.ErrWebhookDeliveryNotFound
+	}
+
+	delivery.Redeliver(time.Now())
+	store.memory.deliveries[deliveryID] = delivery
+	return &delivery, nil
+}
+
+func (store *memoryWebhookStore) PruneWebhookDeliveries() error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	cutoff := time.Now().Add(-models.WebhookDeliveryRetention)
+	for deliveryID, delivery := range store.memory.deliveries {
+		if delivery.Status != models.WebhookDeliveryPending && delivery.CreatedAt.Before(cutoff) {
+			delete(store.memory.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+type memoryAttachmentStore struct {
+	memory *memoryDB
+}
+
+func (store *memoryAttachmentStore) CreateAttachment(ctx context.Context, user *models.User,
+	filename string, file io.ReadSeeker, size int64) (*models.Attachment, error) {
+	attachment, err := models.UploadAttachment(ctx, user, filename, file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	attachment.ID = store.memory.nextID()
+	attachment.CreatedAt = time.Now()
+	store.memory.attachments[attachment.ID] = *attachment
+	return attachment, nil
+}
+
+func (store *memoryAttachmentStore) GetUserAttachment(user *models.User,
+	attachmentID int) (*models.Attachment, error) {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	attachment, ok := store.memory.attachments[attachmentID]
+	if !ok {
+		return nil, models.ErrAttachmentNotFound
+	}
+	if attachment.MessageID == nil {
+		if attachment.UserID != user.ID {
+			return nil, models.ErrAttachmentNotFound
+		}
+		return &attachment, nil
+	}
+
+	message := store.memory.messages[*attachment.MessageID]
+	if message.DeletedAt != nil {
+		return nil, models.ErrAttachmentNotFound
+	}
+	if attachment.UserID != user.ID && !store.memory.isMember(message.ConversationID, user.ID) {
+		return nil, models.ErrAttachmentNotFound
+	}
+	return &attachment, nil
+}
+
+func (store *memoryAttachmentStore) PruneUnattachedAttachments(ctx context.Context) error {
+	store.memory.mutex.Lock()
+	pruned := []models.Attachment{}
+	cutoff := time.Now().Add(-models.UnattachedAttachmentTTL)
+	for attachmentID, attachment := range store.memory.attachments {
+		if attachment.MessageID == nil && attachment.CreatedAt.Before(cutoff) {
+			delete(store.memory.attachments, attachmentID)
+			pruned = append(pruned, attachment)
+		}
+	}
+	store.memory.mutex.Unlock()
+
+	for _, attachment := range pruned {
+		models.DeleteAttachmentBlobs(ctx, &attachment)
+	}
+	return nil
+}
+
+// checkAttachments returns ErrAttachmentNotFound unless every attachment was
+// uploaded by sender and hasn't been sent yet.
+func (memory *memoryDB) checkAttachments(senderID int, attachmentIDs []int) error {
+	for _, attachmentID := range attachmentIDs {
+		attachment, ok := memory.attachments[attachmentID]
+		if !ok || attachment.UserID != senderID || attachment.MessageID != nil {
+			return models.ErrAttachmentNotFound
+		}
+	}
+	return nil
+}
@@ -0,0 +1,505 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/storage"
+)
+
+func newTestUser(t *testing.T, stores *Stores, username string) *models.User {
+	user, err := stores.Users.CreateUser(username, "password", username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func newTestMessage(t *testing.T, stores *Stores, sender *models.User, recipient *models.User,
+	body string) *models.Message {
+	message, _, err := stores.Messages.CreateMessage(sender, recipient, body, models.MessageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestMemoryDirectConversationIsShared(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+
+	first, conversation, err := stores.Messages.CreateMessage(alice, bob, "hi", models.MessageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conversation.Created {
+		t.Error("The first message did not create the conversation.")
+	}
+	_, reply, err := stores.Messages.CreateMessage(bob, alice, "hello", models.MessageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != conversation.ID || reply.Created {
+		t.Errorf("Reply went to conversation %d (created %v), want %d", reply.ID, reply.Created, conversation.ID)
+	}
+
+	_, _, err = stores.Messages.CreateMessage(alice, bob, "see attached",
+		models.MessageOptions{AttachmentIDs: []int{1}})
+	if !errors.Is(err, models.ErrAttachmentNotFound) {
+		t.Errorf("CreateMessage with an unknown attachment returned %v, want ErrAttachmentNotFound", err)
+	}
+
+	page, err := stores.Messages.GetMessagePage(conversation.ID, 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].ID != first.ID {
+		t.Errorf("GetMessagePage returned %d messages", len(page.Messages))
+	}
+}
+
+func TestMemoryConcurrentFirstMessagesShareConversation(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+
+	const senders = 20
+	start := make(chan struct{})
+	conversationIDs := make(chan int, senders)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sender, recipient := alice, bob
+		if i%2 == 1 {
+			sender, recipient = bob, alice
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, conversation, err := stores.Messages.CreateMessage(sender, recipient,
+				fmt.Sprintf("message %d", i), models.MessageOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conversationIDs <- conversation.ID
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(conversationIDs)
+
+	conversationID := 0
+	for id := range conversationIDs {
+		if conversationID == 0 {
+			conversationID = id
+		} else if id != conversationID {
+			t.Fatalf("Messages went to conversations %d and %d, want one", conversationID, id)
+		}
+	}
+
+	page, err := stores.Messages.GetMessagePage(conversationID, 0, 0, senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != senders {
+		t.Errorf("Conversation has %d messages, want %d", len(page.Messages), senders)
+	}
+}
+
+func TestMemoryGroupMembers(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+
+	group, err := stores.Conversations.CreateGroupConversation(alice, "team", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *group
+
+	members := []models.User{}
+	for i := 1; i < models.MaxGroupMembers; i++ {
+		members = append(members, models.User{ID: 1000 + i})
+	}
+	err = stores.Conversations.AddMembers(group, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Conversations.AddMembers(&stale, []models.User{{ID: 2000}})
+	if !errors.Is(err, models.ErrTooManyMembers) {
+		t.Errorf("AddMembers to a stale full group returned %v, want ErrTooManyMembers", err)
+	}
+
+	solo, err := stores.Conversations.CreateGroupConversation(alice, "solo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Conversations.RemoveMember(solo, alice, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if solo.CreatorID != 0 {
+		t.Errorf("CreatorID = %d after the last member left, want 0", solo.CreatorID)
+	}
+}
+
+func TestMemoryAttachments(t *testing.T) {
+	localStore, err := storage.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.InitStore(localStore)
+
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+	carol := newTestUser(t, stores, "carol")
+
+	attachment, err := stores.Attachments.CreateAttachment(context.Background(), alice, "notes.txt",
+		strings.NewReader("some notes"), int64(len("some notes")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.ContentType != "text/plain" {
+		t.Errorf("ContentType = %q, want text/plain", attachment.ContentType)
+	}
+	_, err = stores.Attachments.GetUserAttachment(bob, attachment.ID)
+	if !errors.Is(err, models.ErrAttachmentNotFound) {
+		t.Errorf("GetUserAttachment of an unsent upload returned %v, want ErrAttachmentNotFound", err)
+	}
+
+	_, _, err = stores.Messages.CreateMessage(bob, alice, "mine now",
+		models.MessageOptions{AttachmentIDs: []int{attachment.ID}})
+	if !errors.Is(err, models.ErrAttachmentNotFound) {
+		t.Errorf("Sending another user's upload returned %v, want ErrAttachmentNotFound", err)
+	}
+	message, _, err := stores.Messages.CreateMessage(alice, bob, "see attached",
+		models.MessageOptions{AttachmentIDs: []int{attachment.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Attachments) != 1 || message.Attachments[0].ID != attachment.ID {
+		t.Errorf("Message has attachments %+v, want the upload", message.Attachments)
+	}
+	_, _, err = stores.Messages.CreateMessage(alice, bob, "again",
+		models.MessageOptions{AttachmentIDs: []int{attachment.ID}})
+	if !errors.Is(err, models.ErrAttachmentNotFound) {
+		t.Errorf("Sending an upload twice returned %v, want ErrAttachmentNotFound", err)
+	}
+
+	_, err = stores.Attachments.GetUserAttachment(bob, attachment.ID)
+	if err != nil {
+		t.Errorf("GetUserAttachment by the recipient returned %v", err)
+	}
+	_, err = stores.Attachments.GetUserAttachment(carol, attachment.ID)
+	if !errors.Is(err, models.ErrAttachmentNotFound) {
+		t.Errorf("GetUserAttachment by a non-member returned %v, want ErrAttachmentNotFound", err)
+	}
+}
+
+func TestMemoryLoginThrottle(t *testing.T) {
+	defer func(threshold int) { models.LoginLockoutThreshold = threshold }(models.LoginLockoutThreshold)
+	models.LoginLockoutThreshold = 2
+
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+
+	for i := 0; i < 2; i++ {
+		_, _, err := stores.Sessions.CreateSession("alice", "wrong", "test", "10.0.0.1")
+		if !errors.Is(err, models.ErrInvalidCred) {
+			t.Fatalf("Attempt %d returned %v, want ErrInvalidCred", i, err)
+		}
+	}
+	_, _, err := stores.Sessions.CreateSession("alice", "password", "test", "10.0.0.1")
+	var throttledErr *models.LoginThrottledError
+	if !errors.As(err, &throttledErr) || !errors.Is(err, models.ErrAccountLocked) {
+		t.Fatalf("Login after lockout returned %v, want ErrAccountLocked", err)
+	}
+
+	attempts, err := stores.LoginAttempts.GetLoginAttempts(alice, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[0].Success {
+		t.Errorf("GetLoginAttempts returned %+v, want the two failures", attempts)
+	}
+}
+
+func TestMemoryLoginRehashesPassword(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+
+	memory := stores.Users.(*memoryUserStore).memory
+	legacyHash, err := models.NewBcryptHasher().Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedUser := memory.users[alice.ID]
+	storedUser.Password = legacyHash
+	memory.users[alice.ID] = storedUser
+
+	_, _, err = stores.Sessions.CreateSession("alice", "password", "test", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !models.DefaultHasher.Identifies(memory.users[alice.ID].Password) {
+		t.Error("The legacy password hash was not upgraded.")
+	}
+	if len(memory.loginLocks) != 0 {
+		t.Errorf("%d login locks were left behind", len(memory.loginLocks))
+	}
+}
+
+func TestMemoryReadStates(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+
+	first := newTestMessage(t, stores, bob, alice, "one")
+	newTestMessage(t, stores, bob, alice, "two")
+	newTestMessage(t, stores, alice, bob, "mine")
+	conversationID := first.ConversationID
+
+	readStates, err := stores.ReadMarkers.GetReadStates(alice, []int{conversationID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readStates[conversationID].UnreadCount != 2 {
+		t.Errorf("UnreadCount = %d, want 2", readStates[conversationID].UnreadCount)
+	}
+
+	marker, _, err := stores.ReadMarkers.MarkRead(alice, conversationID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker.LastReadMessageID != first.ID {
+		t.Errorf("LastReadMessageID = %d, want %d", marker.LastReadMessageID, first.ID)
+	}
+	readStates, err = stores.ReadMarkers.GetReadStates(alice, []int{conversationID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readStates[conversationID].UnreadCount != 1 {
+		t.Errorf("UnreadCount = %d, want 1", readStates[conversationID].UnreadCount)
+	}
+
+	carol := newTestUser(t, stores, "carol")
+	_, _, err = stores.ReadMarkers.MarkRead(carol, conversationID, first.ID)
+	if !errors.Is(err, models.ErrConversationNotFound) {
+		t.Errorf("MarkRead by a non-member returned %v, want ErrConversationNotFound", err)
+	}
+}
+
+func TestMemoryReadMarkerNeverMovesBack(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+	first := newTestMessage(t, stores, bob, alice, "one")
+	second := newTestMessage(t, stores, bob, alice, "two")
+
+	_, _, err := stores.ReadMarkers.MarkRead(alice, first.ConversationID, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker, _, err := stores.ReadMarkers.MarkRead(alice, first.ConversationID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker.LastReadMessageID != second.ID {
+		t.Errorf("LastReadMessageID = %d, want %d", marker.LastReadMessageID, second.ID)
+	}
+}
+
+func TestMemoryReactions(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+	message := newTestMessage(t, stores, alice, bob, "hi")
+
+	for _, reaction := range []struct {
+		user  *models.User
+		emoji string
+	}{{alice, "👍"}, {bob, "🎉"}, {bob, "👍"}} {
+		_, _, err := stores.Reactions.AddReaction(reaction.user, message.ID, reaction.emoji)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err := stores.Reactions.AddReaction(alice, message.ID, "👍")
+	if !errors.Is(err, models.ErrDuplicateReaction) {
+		t.Errorf("Duplicate AddReaction returned %v, want ErrDuplicateReaction", err)
+	}
+	_, _, err = stores.Reactions.AddReaction(alice, message.ID, "ok")
+	if !errors.Is(err, models.ErrInvalidEmoji) {
+		t.Errorf("AddReaction with text returned %v, want ErrInvalidEmoji", err)
+	}
+
+	counts, err := stores.Reactions.GetReactionCounts(alice, []int{message.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ReactionCount{
+		{MessageID: message.ID, Emoji: "👍", Count: 2, Reacted: true},
+		{MessageID: message.ID, Emoji: "🎉", Count: 1, Reacted: false},
+	}
+	if len(counts[message.ID]) != len(want) {
+		t.Fatalf("GetReactionCounts returned %+v, want %+v", counts[message.ID], want)
+	}
+	for i := range want {
+		if counts[message.ID][i] != want[i] {
+			t.Errorf("Count %d = %+v, want %+v", i, counts[message.ID][i], want[i])
+		}
+	}
+
+	_, _, err = stores.Reactions.RemoveReaction(alice, message.ID, "👍")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = stores.Reactions.RemoveReaction(alice, message.ID, "👍")
+	if !errors.Is(err, models.ErrReactionNotFound) {
+		t.Errorf("Second RemoveReaction returned %v, want ErrReactionNotFound", err)
+	}
+}
+
+func TestMemoryEvents(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+
+	for i := 0; i < 3; i++ {
+		seqs, err := stores.Events.AppendUserEvents([]int{alice.ID, bob.ID, alice.ID}, "test", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seqs[alice.ID] != int64(i+1) || seqs[bob.ID] != int64(i+1) {
+			t.Errorf("AppendUserEvents returned %v, want seq %d for both users", seqs, i+1)
+		}
+	}
+
+	events, err := stores.Events.GetUserEventsSince(alice.ID, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Seq != 2 || events[0].Data != "1" {
+		t.Errorf("GetUserEventsSince returned %+v", events)
+	}
+	seq, err := stores.Events.GetUserEventSeq(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 3 {
+		t.Errorf("GetUserEventSeq = %d, want 3", seq)
+	}
+}
+
+func TestMemorySearchMessages(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+	carol := newTestUser(t, stores, "carol")
+
+	newTestMessage(t, stores, alice, bob, "lunch at <b>noon</b>?")
+	newTestMessage(t, stores, bob, alice, "lunch lunch")
+	newTestMessage(t, stores, bob, alice, "dinner")
+	newTestMessage(t, stores, carol, bob, "lunch with carol")
+
+	results, nextCursor, err := stores.Messages.SearchMessages(alice,
+		&models.MessageSearch{Query: "Lunch", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Body != "lunch lunch" || nextCursor == "" {
+		t.Fatalf("First page = %+v, cursor %q", results, nextCursor)
+	}
+
+	results, nextCursor, err = stores.Messages.SearchMessages(alice,
+		&models.MessageSearch{Query: "Lunch", Cursor: nextCursor, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || nextCursor != "" {
+		t.Fatalf("Second page = %+v, cursor %q", results, nextCursor)
+	}
+	wantSnippet := "<mark>lunch</mark> at &lt;b&gt;noon&lt;/b&gt;?"
+	if results[0].Snippet != wantSnippet {
+		t.Errorf("Snippet = %q, want %q", results[0].Snippet, wantSnippet)
+	}
+
+	_, _, err = stores.Messages.SearchMessages(alice, &models.MessageSearch{Query: " "})
+	if !errors.Is(err, models.ErrEmptySearchQuery) {
+		t.Errorf("Empty search returned %v, want ErrEmptySearchQuery", err)
+	}
+	_, _, err = stores.Messages.SearchMessages(alice, &models.MessageSearch{Query: "lunch", Cursor: "!"})
+	if !errors.Is(err, models.ErrInvalidSearchCursor) {
+		t.Errorf("Search with a bad cursor returned %v, want ErrInvalidSearchCursor", err)
+	}
+}
+
+func TestMemoryWebhookDeliveries(t *testing.T) {
+	stores := NewMemoryStores()
+	alice := newTestUser(t, stores, "alice")
+	bob := newTestUser(t, stores, "bob")
+
+	webhook, err := stores.Webhooks.CreateWebhook(alice, "https://example.com/hook",
+		[]string{models.WebhookEventMessageCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stores.Webhooks.CreateWebhook(alice, "https://example.com/hook",
+		[]string{models.WebhookEventUserRegistered})
+	if !errors.Is(err, models.ErrWebhookEventNotAllowed) {
+		t.Errorf("CreateWebhook for user.registered returned %v, want ErrWebhookEventNotAllowed", err)
+	}
+
+	err = stores.Webhooks.EnqueueWebhookEvent(models.WebhookEventMessageCreated, []int{alice.ID, bob.ID}, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Webhooks.EnqueueWebhookEvent(models.WebhookEventMessageEdited, []int{alice.ID}, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stores.Webhooks.EnqueueWebhookEvent(models.WebhookEventMessageCreated, []int{bob.ID}, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err := stores.Webhooks.ClaimWebhookDeliveries(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Webhook.Secret != webhook.Secret {
+		t.Fatalf("ClaimWebhookDeliveries returned %+v, want one delivery to the webhook", deliveries)
+	}
+	claimedAgain, err := stores.Webhooks.ClaimWebhookDeliveries(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimedAgain) != 0 {
+		t.Errorf("A leased delivery was claimed again.")
+	}
+
+	err = stores.Webhooks.RecordWebhookAttempt(&deliveries[0], 200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, err := stores.Webhooks.GetWebhookDeliveries(alice, webhook.ID, models.WebhookDeliverySucceeded, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 1 || logged[0].Attempts != 1 {
+		t.Errorf("GetWebhookDeliveries returned %+v, want one succeeded delivery", logged)
+	}
+
+	_, err = stores.Webhooks.GetWebhookDeliveries(bob, webhook.ID, "", 0)
+	if !errors.Is(err, models.ErrWebhookNotFound) {
+		t.Errorf("GetWebhookDeliveries by another user returned %v, want ErrWebhookNotFound", err)
+	}
+}
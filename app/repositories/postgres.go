@@ -0,0 +1,281 @@
+package repositories
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+)
+
+// NewPostgresStores returns stores backed by the application database.
+func NewPostgresStores() *Stores {
+	return &Stores{
+		Users:         postgresUserStore{},
+		Sessions:      postgresSessionStore{},
+		LoginAttempts: postgresLoginAttemptStore{},
+		Conversations: postgresConversationStore{},
+		Messages:      postgresMessageStore{},
+		ReadMarkers:   postgresReadMarkerStore{},
+		Reactions:     postgresReactionStore{},
+		Events:        postgresEventStore{},
+		Webhooks:      postgresWebhookStore{},
+		Attachments:   postgresAttachmentStore{},
+	}
+}
+
+type postgresUserStore struct{}
+
+func (postgresUserStore) CreateUser(username string, password string, name string) (*models.User, error) {
+	return models.CreateUser(username, password, name)
+}
+
+func (postgresUserStore) GetUserByUsername(username string) (*models.User, error) {
+	return models.GetUserByUsername(username)
+}
+
+func (postgresUserStore) GetUsersByUsernames(usernames []string) ([]models.User, error) {
+	return models.GetUsersByUsernames(usernames)
+}
+
+func (postgresUserStore) SearchUsers(searcher *models.User, query string, offset int,
+	limit int) ([]models.User, bool, error) {
+	return models.SearchUsers(searcher, query, offset, limit)
+}
+
+func (postgresUserStore) SetDiscoverable(user *models.User, discoverable bool) error {
+	return models.SetDiscoverable(user, discoverable)
+}
+
+func (postgresUserStore) UpdateLastSeen(userID int, lastSeen time.Time) error {
+	return models.UpdateLastSeen(userID, lastSeen)
+}
+
+func (postgresUserStore) GetContactIDs(userID int) ([]int, error) {
+	return models.GetContactIDs(userID)
+}
+
+type postgresSessionStore struct{}
+
+func (postgresSessionStore) CreateSession(username string, password string, userAgent string,
+	ipAddress string) (*models.Session, *models.User, error) {
+	return models.CreateSession(username, password, userAgent, ipAddress)
+}
+
+func (postgresSessionStore) GetSessionFromKey(key string) (*models.Session, error) {
+	return models.GetSessionFromKey(key)
+}
+
+func (postgresSessionStore) TouchSession(session *models.Session) error {
+	return session.Touch()
+}
+
+func (postgresSessionStore) DeleteSession(session *models.Session) error {
+	return session.Delete()
+}
+
+func (postgresSessionStore) GetSessions(user *models.User) ([]models.Session, error) {
+	return models.GetSessions(user)
+}
+
+func (postgresSessionStore) DeleteUserSession(user *models.User, sessionID int) error {
+	return models.DeleteUserSession(user, sessionID)
+}
+
+func (postgresSessionStore) DeleteOtherSessions(session *models.Session) ([]int, error) {
+	return models.DeleteOtherSessions(session)
+}
+
+type postgresLoginAttemptStore struct{}
+
+func (postgresLoginAttemptStore) GetLoginAttempts(user *models.User, limit int) ([]models.LoginAttempt, error) {
+	return models.GetLoginAttempts(user, limit)
+}
+
+func (postgresLoginAttemptStore) PruneLoginAttempts() error {
+	return models.PruneLoginAttempts()
+}
+
+type postgresConversationStore struct{}
+
+func (postgresConversationStore) GetUserConversations(user *models.User, cursor string,
+	limit int) (*models.ConversationPage, error) {
+	return models.GetUserConversations(user, cursor, limit)
+}
+
+func (postgresConversationStore) GetDirectConversation(sender *models.User,
+	recipient *models.User) (*models.Conversation, error) {
+	return models.GetDirectConversation(sender, recipient)
+}
+
+func (postgresConversationStore) GetUserConversation(user *models.User,
+	conversationID int) (*models.Conversation, error) {
+	return models.GetUserConversation(user, conversationID)
+}
+
+func (postgresConversationStore) CreateGroupConversation(creator *models.User, title string,
+	members []models.User) (*models.Conversation, error) {
+	return models.CreateGroupConversation(creator, title, members)
+}
+
+func (postgresConversationStore) AddMembers(conversation *models.Conversation, members []models.User) error {
+	return conversation.AddMembers(members)
+}
+
+func (postgresConversationStore) RemoveMember(conversation *models.Conversation, actor *models.User,
+	member *models.User) error {
+	return conversation.RemoveMember(actor, member)
+}
+
+type postgresMessageStore struct{}
+
+func (postgresMessageStore) CreateMessage(sender *models.User, recipient *models.User, body string,
+	options models.MessageOptions) (*models.Message, *models.Conversation, error) {
+	return models.CreateMessage(sender, recipient, body, options)
+}
+
+func (postgresMessageStore) CreateConversationMessage(sender *models.User, conversationID int, body string,
+	options models.MessageOptions) (*models.Message, *models.Conversation, error) {
+	return models.CreateConversationMessage(sender, conversationID, body, options)
+}
+
+func (postgresMessageStore) GetMessagePage(conversationID int, beforeID int, afterID int,
+	limit int) (*models.MessagePage, error) {
+	return models.GetMessagePage(conversationID, beforeID, afterID, limit)
+}
+
+func (postgresMessageStore) GetUserMessage(user *models.User,
+	messageID int) (*models.Message, *models.Conversation, error) {
+	return models.GetUserMessage(user, messageID)
+}
+
+func (postgresMessageStore) EditMessage(user *models.User, messageID int,
+	body string) (*models.Message, *models.Conversation, error) {
+	return models.EditMessage(user, messageID, body)
+}
+
+func (postgresMessageStore) DeleteMessage(user *models.User,
+	messageID int) (*models.Message, *models.Conversation, error) {
+	return models.DeleteMessage(user, messageID)
+}
+
+func (postgresMessageStore) GetMessageRevisions(user *models.User,
+	messageID int) ([]models.MessageRevision, error) {
+	return models.GetMessageRevisions(user, messageID)
+}
+
+func (postgresMessageStore) GetMessageThread(user *models.User,
+	messageID int) (*models.Message, []models.Message, error) {
+	return models.GetMessageThread(user, messageID)
+}
+
+func (postgresMessageStore) SearchMessages(user *models.User,
+	search *models.MessageSearch) ([]models.MessageSearchResult, string, error) {
+	return models.SearchMessages(user, search)
+}
+
+type postgresReadMarkerStore struct{}
+
+func (postgresReadMarkerStore) MarkRead(user *models.User, conversationID int,
+	messageID int) (*models.ReadMarker, *models.Conversation, error) {
+	return models.MarkRead(user, conversationID, messageID)
+}
+
+func (postgresReadMarkerStore) GetReadStates(user *models.User,
+	conversationIDs []int) (map[int]models.ConversationReadState, error) {
+	return models.GetReadStates(user, conversationIDs)
+}
+
+type postgresReactionStore struct{}
+
+func (postgresReactionStore) AddReaction(user *models.User, messageID int,
+	emoji string) (*models.Reaction, *models.Conversation, error) {
+	return models.AddReaction(user, messageID, emoji)
+}
+
+func (postgresReactionStore) RemoveReaction(user *models.User, messageID int,
+	emoji string) (*models.Reaction, *models.Conversation, error) {
+	return models.RemoveReaction(user, messageID, emoji)
+}
+
+func (postgresReactionStore) GetReactionCounts(user *models.User,
+	messageIDs []int) (map[int][]models.ReactionCount, error) {
+	return models.GetReactionCounts(user, messageIDs)
+}
+
+type postgresEventStore struct{}
+
+func (postgresEventStore) AppendUserEvents(userIDs []int, method string,
+	data interface{}) (map[int]int64, error) {
+	return models.AppendUserEvents(userIDs, method, data)
+}
+
+func (postgresEventStore) GetUserEventsSince(userID int, seq int64, limit int) ([]models.UserEvent, error) {
+	return models.GetUserEventsSince(userID, seq, limit)
+}
+
+func (postgresEventStore) GetUserEventSeq(userID int) (int64, error) {
+	return models.GetUserEventSeq(userID)
+}
+
+func (postgresEventStore) PruneUserEvents() error {
+	return models.PruneUserEvents()
+}
+
+type postgresWebhookStore struct{}
+
+func (postgresWebhookStore) CreateWebhook(user *models.User, webhookURL string,
+	events []string) (*models.Webhook, error) {
+	return models.CreateWebhook(user, webhookURL, events)
+}
+
+func (postgresWebhookStore) GetWebhooks(user *models.User) ([]models.Webhook, error) {
+	return models.GetWebhooks(user)
+}
+
+func (postgresWebhookStore) DeleteWebhook(user *models.User, webhookID int) error {
+	return models.DeleteWebhook(user, webhookID)
+}
+
+func (postgresWebhookStore) EnqueueWebhookEvent(event string, userIDs []int, data interface{}) error {
+	return models.EnqueueWebhookEvent(event, userIDs, data)
+}
+
+func (postgresWebhookStore) ClaimWebhookDeliveries(limit int,
+	lease time.Duration) ([]models.WebhookDelivery, error) {
+	return models.ClaimWebhookDeliveries(limit, lease)
+}
+
+func (postgresWebhookStore) RecordWebhookAttempt(delivery *models.WebhookDelivery, responseStatus int,
+	deliveryErr error) error {
+	return models.RecordWebhookAttempt(delivery, responseStatus, deliveryErr)
+}
+
+func (postgresWebhookStore) GetWebhookDeliveries(user *models.User, webhookID int, status string,
+	limit int) ([]models.WebhookDelivery, error) {
+	return models.GetWebhookDeliveries(user, webhookID, status, limit)
+}
+
+func (postgresWebhookStore) RedeliverWebhookDelivery(user *models.User, webhookID int,
+	deliveryID int64) (*models.WebhookDelivery, error) {
+	return models.RedeliverWebhookDelivery(user, webhookID, deliveryID)
+}
+
+func (postgresWebhookStore) PruneWebhookDeliveries() error {
+	return models.PruneWebhookDeliveries()
+}
+
+type postgresAttachmentStore struct{}
+
+func (postgresAttachmentStore) CreateAttachment(ctx context.Context, user *models.User, filename string,
+	file io.ReadSeeker, size int64) (*models.Attachment, error) {
+	return models.CreateAttachment(ctx, user, filename, file, size)
+}
+
+func (postgresAttachmentStore) GetUserAttachment(user *models.User, attachmentID int) (*models.Attachment, error) {
+	return models.GetUserAttachment(user, attachmentID)
+}
+
+func (postgresAttachmentStore) PruneUnattachedAttachments(ctx context.Context) error {
+	return models.PruneUnattachedAttachments(ctx)
+}
@@ -0,0 +1,143 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nrmilstein/nchat/app/models"
+)
+
+// Stores bundles the repositories that controllers, the chat hub and the
+// webhook dispatcher use to read and write the application's data. Their
+// methods return the same errors as the models functions they are named
+// after.
+type Stores struct {
+	Users         UserStore
+	Sessions      SessionStore
+	LoginAttempts LoginAttemptStore
+	Conversations ConversationStore
+	Messages      MessageStore
+	ReadMarkers   ReadMarkerStore
+	Reactions     ReactionStore
+	Events        EventStore
+	Webhooks      WebhookStore
+	Attachments   AttachmentStore
+}
+
+type UserStore interface {
+	CreateUser(username string, password string, name string) (*models.User, error)
+	GetUserByUsername(username string) (*models.User, error)
+	GetUsersByUsernames(usernames []string) ([]models.User, error)
+	SearchUsers(searcher *models.User, query string, offset int, limit int) ([]models.User, bool, error)
+	SetDiscoverable(user *models.User, discoverable bool) error
+	UpdateLastSeen(userID int, lastSeen time.Time) error
+	GetContactIDs(userID int) ([]int, error)
+}
+
+type SessionStore interface {
+	CreateSession(username string, password string, userAgent string, ipAddress string) (*models.Session, *models.User, error)
+	GetSessionFromKey(key string) (*models.Session, error)
+	TouchSession(session *models.Session) error
+	DeleteSession(session *models.Session) error
+	GetSessions(user *models.User) ([]models.Session, error)
+	DeleteUserSession(user *models.User, sessionID int) error
+	DeleteOtherSessions(session *models.Session) ([]int, error)
+}
+
+type LoginAttemptStore interface {
+	GetLoginAttempts(user *models.User, limit int) ([]models.LoginAttempt, error)
+	PruneLoginAttempts() error
+}
+
+type ConversationStore interface {
+	GetUserConversations(user *models.User, cursor string, limit int) (*models.ConversationPage, error)
+	GetDirectConversation(sender *models.User, recipient *models.User) (*models.Conversation, error)
+	GetUserConversation(user *models.User, conversationID int) (*models.Conversation, error)
+	CreateGroupConversation(creator *models.User, title string, members []models.User) (*models.Conversation, error)
+	AddMembers(conversation *models.Conversation, members []models.User) error
+	RemoveMember(conversation *models.Conversation, actor *models.User, member *models.User) error
+}
+
+type MessageStore interface {
+	CreateMessage(sender *models.User, recipient *models.User, body string,
+		options models.MessageOptions) (*models.Message, *models.Conversation, error)
+	CreateConversationMessage(sender *models.User, conversationID int, body string,
+		options models.MessageOptions) (*models.Message, *models.Conversation, error)
+	GetMessagePage(conversationID int, beforeID int, afterID int, limit int) (*models.MessagePage, error)
+	GetUserMessage(user *models.User, messageID int) (*models.Message, *models.Conversation, error)
+	EditMessage(user *models.User, messageID int, body string) (*models.Message, *models.Conversation, error)
+	DeleteMessage(user *models.User, messageID int) (*models.Message, *models.Conversation, error)
+	GetMessageRevisions(user *models.User, messageID int) ([]models.MessageRevision, error)
+	GetMessageThread(user *models.User, messageID int) (*models.Message, []models.Message, error)
+	SearchMessages(user *models.User, search *models.MessageSearch) ([]models.MessageSearchResult, string, error)
+}
+
+type ReadMarkerStore interface {
+	MarkRead(user *models.User, conversationID int, messageID int) (*models.ReadMarker, *models.Conversation, error)
+	GetReadStates(user *models.User, conversationIDs []int) (map[int]models.ConversationReadState, error)
+}
+
+type ReactionStore interface {
+	AddReaction(user *models.User, messageID int, emoji string) (*models.Reaction, *models.Conversation, error)
+	RemoveReaction(user *models.User, messageID int, emoji string) (*models.Reaction, *models.Conversation, error)
+	GetReactionCounts(user *models.User, messageIDs []int) (map[int][]models.ReactionCount, error)
+}
+
+type EventStore interface {
+	AppendUserEvents(userIDs []int, method string, data interface{}) (map[int]int64, error)
+	GetUserEventsSince(userID int, seq int64, limit int) ([]models.UserEvent, error)
+	GetUserEventSeq(userID int) (int64, error)
+	PruneUserEvents() error
+}
+
+type WebhookStore interface {
+	CreateWebhook(user *models.User, webhookURL string, events []string) (*models.Webhook, error)
+	GetWebhooks(user *models.User) ([]models.Webhook, error)
+	DeleteWebhook(user *models.User, webhookID int) error
+	EnqueueWebhookEvent(event string, userIDs []int, data interface{}) error
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(delivery *models.WebhookDelivery, responseStatus int, deliveryErr error) error
+	GetWebhookDeliveries(user *models.User, webhookID int, status string, limit int) ([]models.WebhookDelivery, error)
+	RedeliverWebhookDelivery(user *models.User, webhookID int, deliveryID int64) (*models.WebhookDelivery, error)
+	PruneWebhookDeliveries() error
+}
+
+type AttachmentStore interface {
+	CreateAttachment(ctx context.Context, user *models.User, filename string, file io.ReadSeeker,
+		size int64) (*models.Attachment, error)
+	GetUserAttachment(user *models.User, attachmentID int) (*models.Attachment, error)
+	PruneUnattachedAttachments(ctx context.Context) error
+}
+
+// sessionContextKey caches the request's session, so that middleware and
+// handlers only look it up once.
+const sessionContextKey = "session"
+
+// GetSessionFromRequest returns the session for the request's X-API-Key
+// header.
+func GetSessionFromRequest(c *gin.Context, sessions SessionStore) (*models.Session, error) {
+	if session, ok := c.Get(sessionContextKey); ok {
+		return session.(*models.Session), nil
+	}
+
+	session, err := sessions.GetSessionFromKey(c.GetHeader("X-API-Key"))
+	if err != nil {
+		return nil, err
+	}
+	c.Set(sessionContextKey, session)
+	return session, nil
+}
+
+// GetUserFromRequest returns the user that the request is authenticated as.
+func GetUserFromRequest(c *gin.Context, sessions SessionStore) (*models.User, error) {
+	session, err := GetSessionFromRequest(c, sessions)
+	if errors.Is(err, models.ErrSessionNotFound) {
+		return nil, models.ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &session.User, nil
+}
@@ -0,0 +1,125 @@
+package chatServer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Broker carries notifications between the hubs of every server instance, so
+// that a user's clients receive them no matter which instance they are
+// connected to. Each hub delivers to its own clients directly and publishes
+// to the broker for the others.
+type Broker interface {
+	Publish(payload []byte) error
+	Subscribe(handler func(payload []byte))
+	Close() error
+}
+
+// MemoryBroker is a Broker for hubs that run in the same process. A single
+// hub with a MemoryBroker behaves as if there were no broker at all.
+type MemoryBroker struct {
+	mutex    sync.RWMutex
+	handlers []func(payload []byte)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (broker *MemoryBroker) Publish(payload []byte) error {
+	broker.mutex.RLock()
+	defer broker.mutex.RUnlock()
+
+	for _, handler := range broker.handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (broker *MemoryBroker) Subscribe(handler func(payload []byte)) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	broker.handlers = append(broker.handlers, handler)
+}
+
+func (broker *MemoryBroker) Close() error {
+	return nil
+}
+
+const (
+	brokerKindNotification   = "notification"
+	brokerKindRevokeSessions = "revokeSessions"
+	brokerKindPresence       = "presence"
+	brokerKindPresenceSync   = "presenceSync"
+)
+
+// brokerMessage is what hubs publish to each other. Notifications carry a
+// per-user seq for durable events. Presence messages say which users came
+// online or went offline on the origin hub, and presence syncs list every
+// user online on it.
+type brokerMessage struct {
+	Origin     string          `json:"origin"`
+	Kind       string          `json:"kind"`
+	UserIDs    []int           `json:"userIds"`
+	Method     string          `json:"method,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Seqs       map[int]int64   `json:"seqs,omitempty"`
+	SessionIDs []int           `json:"sessionIds,omitempty"`
+	Status     string          `json:"status,omitempty"`
+	LastSeen   *time.Time      `json:"lastSeen,omitempty"`
+}
+
+func newHubID() string {
+	randBytes := make([]byte, 8)
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(randBytes)
+}
+
+func (hub *Hub) publish(message *brokerMessage) {
+	message.Origin = hub.id
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = hub.broker.Publish(payload)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// handleBrokerMessage delivers a message published by another hub to this
+// hub's clients.
+func (hub *Hub) handleBrokerMessage(payload []byte) {
+	var message brokerMessage
+	err := json.Unmarshal(payload, &message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if message.Origin == hub.id {
+		return
+	}
+
+	switch message.Kind {
+	case brokerKindNotification:
+		hub.deliver(message.UserIDs, message.Method, message.Data, message.Seqs, nil)
+	case brokerKindRevokeSessions:
+		for _, userID := range message.UserIDs {
+			hub.revokeSessions(userID, message.SessionIDs)
+		}
+	case brokerKindPresence:
+		hub.updateRemotePresence(message.Origin, message.UserIDs, message.Status, message.LastSeen, false)
+	case brokerKindPresenceSync:
+		hub.updateRemotePresence(message.Origin, message.UserIDs, "", nil, true)
+	}
+}
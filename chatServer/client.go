@@ -1,47 +1,163 @@
 package chatServer
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/utils"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
 var ErrRequestMethodNotFound = errors.New("WebSocket request method not found.")
+var ErrInvalidRequest = errors.New("Invalid WebSocket request.")
+var ErrInvalidRequestData = errors.New("Invalid WebSocket request data.")
+var ErrSessionRevoked = errors.New("Session revoked.")
+var ErrRateLimited = errors.New("Too many requests.")
+var ErrSlowConsumer = errors.New("Client is not reading notifications fast enough.")
+
+// OverflowPolicy decides what happens when a client's send queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowResync drops the notification and tells the client to refetch
+	// its state over REST once it catches up.
+	OverflowResync OverflowPolicy = iota
+	// OverflowDisconnect disconnects the client. It may reconnect and replay
+	// the events it missed.
+	OverflowDisconnect
+)
+
+// SendQueueSize is the number of notifications that may be waiting to be
+// written to a client before SendQueuePolicy applies.
+var SendQueueSize = 256
+var SendQueuePolicy = OverflowDisconnect
+
+// writeTimeout bounds how long a single write to a client may take.
+const writeTimeout = 10 * time.Second
 
 type client struct {
-	hub  *Hub
-	user *models.User
-	send chan *wsNotification
+	hub        *Hub
+	session    *models.Session
+	user       *models.User
+	send       chan *wsNotification
+	responses  chan interface{}
+	overflowed chan struct{}
+	revoked    chan struct{}
+	revokeOnce sync.Once
+	evicted    chan struct{}
+	evictOnce  sync.Once
+	goingAway  chan struct{}
+	goAwayOnce sync.Once
+	inFlight   sync.WaitGroup
+
+	resumeSeq   *int64
+	replayedSeq int64
+
+	methodLimiters map[string]*utils.TokenBucket
 }
 
-func NewClient(hub *Hub, user *models.User) *client {
+func NewClient(hub *Hub, session *models.Session) *client {
 	return &client{
-		hub:  hub,
-		user: user,
-		send: make(chan *wsNotification),
+		hub:        hub,
+		session:    session,
+		user:       &session.User,
+		send:       make(chan *wsNotification, SendQueueSize),
+		responses:  make(chan interface{}),
+		overflowed: make(chan struct{}, 1),
+		revoked:    make(chan struct{}),
+		evicted:    make(chan struct{}),
+		goingAway:  make(chan struct{}),
+
+		methodLimiters: newMethodLimiters(),
+	}
+}
+
+func (clt *client) revoke() {
+	clt.revokeOnce.Do(func() {
+		close(clt.revoked)
+	})
+}
+
+func (clt *client) evict() {
+	clt.evictOnce.Do(func() {
+		close(clt.evicted)
+	})
+}
+
+// enqueue queues a notification to be written to the client without
+// blocking. If the queue is full, SendQueuePolicy applies.
+func (clt *client) enqueue(notification *wsNotification) {
+	select {
+	case clt.send <- notification:
+		return
+	default:
+	}
+
+	switch SendQueuePolicy {
+	case OverflowResync:
+		atomic.AddInt64(&clt.hub.droppedNotifications, 1)
+		select {
+		case clt.overflowed <- struct{}{}:
+		default:
+		}
+	case OverflowDisconnect:
+		atomic.AddInt64(&clt.hub.evictedClients, 1)
+		clt.evict()
 	}
 }
 
 func (clt *client) ServeChatMessages(connection *websocket.Conn, ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if clt.resumeSeq != nil {
+		err := clt.replayEvents(ctx, connection)
+		if err != nil {
+			return err
+		}
+	}
+
 	requests := make(chan *wsRequest)
-	errs := make(chan error)
+	errs := make(chan error, 2)
 
 	go func() {
 		for ctx.Err() == nil {
-			var request wsRequest
-			err := wsjson.Read(ctx, connection, &request)
+			_, message, err := connection.Read(ctx)
 			if err != nil {
 				errs <- err
 				return
 			}
-			requests <- &request
+
+			var request wsRequest
+			err = json.Unmarshal(message, &request)
+			if err != nil {
+				errResponse := newWsErrorResponse(0, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+				clt.respond(ctx, errResponse)
+				continue
+			}
+
+			select {
+			case requests <- &request:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
+	stopWriting := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		errs <- clt.writeMessages(ctx, connection, stopWriting)
+		close(writerDone)
+	}()
+
 	for {
 		heartbeat, cancel := context.WithTimeout(ctx, time.Second*30)
 		defer cancel()
@@ -51,51 +167,121 @@ func (clt *client) ServeChatMessages(connection *websocket.Conn, ctx context.Con
 			return err
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-clt.revoked:
+			return ErrSessionRevoked
+		case <-clt.evicted:
+			return ErrSlowConsumer
+		case <-clt.goingAway:
+			return clt.drain(ctx, connection, stopWriting, writerDone)
 		case <-heartbeat.Done():
+			err := clt.hub.stores.Sessions.TouchSession(clt.session)
+			if errors.Is(err, models.ErrSessionNotFound) {
+				return ErrSessionRevoked
+			} else if err != nil {
+				return err
+			}
+
 			pingTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
 			defer cancel()
 
-			err := connection.Ping(pingTimeout)
+			err = connection.Ping(pingTimeout)
 			if err != nil {
 				return err
 			}
 		case request := <-requests:
+			clt.inFlight.Add(1)
 			go func() {
-				response, err := clt.handleWsRequest(ctx, request)
-
-				if err == nil {
-					wsjson.Write(ctx, connection, *response)
-				}
+				defer clt.inFlight.Done()
+				response := clt.handleWsRequest(ctx, request)
+				clt.respond(ctx, response)
 			}()
-		case notification := <-clt.send:
-			wsjson.Write(ctx, connection, notification)
 		}
 	}
 }
 
-func (clt *client) handleWsRequest(ctx context.Context, request *wsRequest) (*wsSuccessResponse, error) {
-	switch request.Method {
-	case "sendMessage":
-		msgRequestData := &wsMsgRequestData{
-			Username: request.Data["username"],
-			Body:     request.Data["body"],
+// respond hands a response to the writer, which writes responses ahead of
+// queued notifications.
+func (clt *client) respond(ctx context.Context, response interface{}) {
+	select {
+	case clt.responses <- response:
+	case <-ctx.Done():
+	}
+}
+
+// writeMessages is the only goroutine that writes to the connection once the
+// client is serving, so that a slow connection only holds up its own client.
+// It returns nil once stop is closed.
+func (clt *client) writeMessages(ctx context.Context, connection *websocket.Conn, stop chan struct{}) error {
+	for {
+		var message interface{}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stop:
+			return nil
+		case response := <-clt.responses:
+			message = response
+		case <-clt.overflowed:
+			err := clt.requireResync(ctx, connection)
+			if err != nil {
+				return err
+			}
+			continue
+		case notification := <-clt.send:
+			// Skip notifications that were already delivered by replay or
+			// that a resync will include.
+			if notification.Seq != 0 && notification.Seq <= clt.replayedSeq {
+				continue
+			}
+			message = notification
 		}
 
-		msgResponseData, err := clt.hub.relayMessage(clt, msgRequestData)
+		writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+		err := wsjson.Write(writeCtx, connection, message)
+		cancel()
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+}
 
-		response := &wsSuccessResponse{
-			Id:     request.Id,
-			Type:   "response",
-			Status: "success",
-			Data:   msgResponseData,
-		}
-		return response, nil
-	default:
+func (clt *client) handleWsRequest(ctx context.Context, request *wsRequest) interface{} {
+	responseData, err := clt.dispatchWsRequest(ctx, request)
+	if err != nil {
+		return newWsErrorResponse(request.Id, err)
+	}
+
+	return &wsSuccessResponse{
+		Id:     request.Id,
+		Type:   "response",
+		Status: "success",
+		Data:   responseData,
+	}
+}
+
+func (clt *client) dispatchWsRequest(ctx context.Context, request *wsRequest) (interface{}, error) {
+	if request.Type != "request" {
+		return nil, fmt.Errorf("%w: type must be \"request\"", ErrInvalidRequest)
+	}
+	if request.Method == "" {
+		return nil, fmt.Errorf("%w: missing method", ErrInvalidRequest)
+	}
+
+	handler, ok := wsRequestHandlers[request.Method]
+	if !ok {
 		return nil, ErrRequestMethodNotFound
 	}
+	err := clt.allowRequest(request.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	data := bytes.TrimSpace(request.Data)
+	if len(data) == 0 || data[0] != '{' {
+		return nil, fmt.Errorf("%w: data must be an object", ErrInvalidRequestData)
+	}
+
+	return handler(clt, data)
 }
 
 type clientGroup map[*client]bool
@@ -110,7 +296,7 @@ func (cltGroup clientGroup) removeClient(clt *client) {
 
 func (cltGroup clientGroup) broadcastNotification(notification *wsNotification) {
 	for clt := range cltGroup {
-		clt.send <- notification
+		clt.enqueue(notification)
 	}
 }
 
@@ -118,7 +304,7 @@ func (cltGroup clientGroup) broadcastNotificationExceptToSelf(
 	notification *wsNotification, self *client) {
 	for clt := range cltGroup {
 		if clt != self {
-			clt.send <- notification
+			clt.enqueue(notification)
 		}
 	}
 }
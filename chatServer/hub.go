@@ -1,81 +1,290 @@
 package chatServer
 
 import (
+	"encoding/json"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nrmilstein/nchat/app/models"
-	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/app/repositories"
 )
 
 type Hub struct {
-	clientsMutex sync.RWMutex
-	clients      map[int]clientGroup
+	// Accessed atomically, so kept first for 64-bit alignment.
+	droppedNotifications int64
+	evictedClients       int64
+
+	id     string
+	broker Broker
+	stores *repositories.Stores
+
+	clientsMutex   sync.RWMutex
+	clients        map[int]clientGroup
+	offlineTimers  map[int]*time.Timer
+	remotePresence map[string]*remotePresence
+	shuttingDown   bool
+	connected      sync.WaitGroup
+	typingMutex    sync.Mutex
+	typing         map[typingKey]*typingState
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients: make(map[int]clientGroup),
+func NewHub(broker Broker, stores *repositories.Stores) *Hub {
+	hub := &Hub{
+		id:             newHubID(),
+		broker:         broker,
+		stores:         stores,
+		clients:        make(map[int]clientGroup),
+		offlineTimers:  make(map[int]*time.Timer),
+		remotePresence: make(map[string]*remotePresence),
+		typing:         make(map[typingKey]*typingState),
 	}
+	broker.Subscribe(hub.handleBrokerMessage)
+	hub.publishPresenceSync()
+	go hub.syncPresence()
+	return hub
 }
 
 func (hub *Hub) relayMessage(clt *client, msgData *wsMsgRequestData) (*wsMsgData, error) {
-	db := db.GetDb()
-
 	sender := clt.user
 
-	var recipient models.User
-	result := db.Take(&recipient, &models.User{Username: msgData.Username})
-	if result.Error != nil {
-		return nil, result.Error
+	options := models.MessageOptions{
+		ReplyToID:     msgData.ReplyToMessageId,
+		AttachmentIDs: msgData.AttachmentIds,
 	}
 
-	newMessage, conversation, err := models.CreateMessage(sender, &recipient, msgData.Body)
+	var newMessage *models.Message
+	var conversation *models.Conversation
+	var err error
+	if msgData.ConversationId != 0 {
+		newMessage, conversation, err = hub.stores.Messages.CreateConversationMessage(sender,
+			msgData.ConversationId, msgData.Body, options)
+	} else {
+		var recipient *models.User
+		recipient, err = hub.stores.Users.GetUserByUsername(msgData.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		newMessage, conversation, err = hub.stores.Messages.CreateMessage(sender, recipient, msgData.Body, options)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	newMsgData := &wsMsgData{
-		Message: wsMsgMessage{
-			Id:             newMessage.ID,
-			ConversationId: newMessage.ConversationID,
-			SenderId:       newMessage.UserID,
-			Body:           newMessage.Body,
-			CreatedAt:      newMessage.CreatedAt,
-		},
-		Conversation: wsMsgConversation{
-			Id:        conversation.ID,
-			CreatedAt: conversation.CreatedAt,
-			ConversationPartner: wsMsgConversationPartner{
-				Id:       sender.ID,
-				Username: sender.Username,
-				Name:     sender.Name,
-			},
-		},
+		Message:      newWsMsgMessage(newMessage),
+		Conversation: newWsMsgConversation(conversation),
+	}
+
+	hub.stopUserTyping(conversation.ID, sender.ID)
+
+	hub.broadcastEvent(conversation.MemberIDs(), "newMessage", newMsgData, clt)
+
+	if conversation.Created {
+		hub.emitWebhookEvent(models.WebhookEventConversationCreated, conversation.MemberIDs(), gin.H{
+			"conversation": newMsgData.Conversation,
+		})
+	}
+	hub.emitWebhookEvent(models.WebhookEventMessageCreated, conversation.MemberIDs(), newMsgData)
+
+	return newMsgData, nil
+}
+
+func (hub *Hub) editMessage(clt *client, editData *wsMsgEditRequestData) (*wsMsgUpdateData, error) {
+	message, conversation, err := hub.stores.Messages.EditMessage(clt.user, editData.MessageId, editData.Body)
+	if err != nil {
+		return nil, err
+	}
+	return hub.broadcastMessageEdited(message, conversation, clt), nil
+}
+
+func (hub *Hub) deleteMessage(clt *client, deleteData *wsMsgDeleteRequestData) (*wsMsgUpdateData, error) {
+	message, conversation, err := hub.stores.Messages.DeleteMessage(clt.user, deleteData.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	return hub.broadcastMessageUpdate("messageDeleted", message, conversation, clt), nil
+}
+
+// NotifyMessageEdited tells every member of a conversation that one of its
+// messages has been edited.
+func (hub *Hub) NotifyMessageEdited(message *models.Message, conversation *models.Conversation) {
+	hub.broadcastMessageEdited(message, conversation, nil)
+}
+
+// NotifyMessageDeleted tells every member of a conversation that one of its
+// messages has been deleted.
+func (hub *Hub) NotifyMessageDeleted(message *models.Message, conversation *models.Conversation) {
+	hub.broadcastMessageUpdate("messageDeleted", message, conversation, nil)
+}
+
+func (hub *Hub) broadcastMessageEdited(message *models.Message, conversation *models.Conversation,
+	self *client) *wsMsgUpdateData {
+	updateData := hub.broadcastMessageUpdate("messageEdited", message, conversation, self)
+	hub.emitWebhookEvent(models.WebhookEventMessageEdited, conversation.MemberIDs(), updateData)
+	return updateData
+}
+
+func (hub *Hub) broadcastMessageUpdate(method string, message *models.Message,
+	conversation *models.Conversation, self *client) *wsMsgUpdateData {
+	updateData := &wsMsgUpdateData{
+		Message: newWsMsgMessage(message),
+	}
+
+	hub.broadcastEvent(conversation.MemberIDs(), method, updateData, self)
+
+	return updateData
+}
+
+func (hub *Hub) addReaction(clt *client, reactionData *wsReactionRequestData) (*wsReactionData, error) {
+	reaction, conversation, err := hub.stores.Reactions.AddReaction(clt.user, reactionData.MessageId, reactionData.Emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	newReactionData := &wsReactionData{
+		MessageId:      reaction.MessageID,
+		ConversationId: conversation.ID,
+		UserId:         reaction.UserID,
+		Emoji:          reaction.Emoji,
+		CreatedAt:      &reaction.CreatedAt,
+	}
+	hub.broadcastEvent(conversation.MemberIDs(), "reactionAdded", newReactionData, clt)
+
+	return newReactionData, nil
+}
+
+func (hub *Hub) removeReaction(clt *client, reactionData *wsReactionRequestData) (*wsReactionData, error) {
+	reaction, conversation, err := hub.stores.Reactions.RemoveReaction(clt.user, reactionData.MessageId, reactionData.Emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	newReactionData := &wsReactionData{
+		MessageId:      reaction.MessageID,
+		ConversationId: conversation.ID,
+		UserId:         reaction.UserID,
+		Emoji:          reaction.Emoji,
+	}
+	hub.broadcastEvent(conversation.MemberIDs(), "reactionRemoved", newReactionData, clt)
+
+	return newReactionData, nil
+}
+
+func (hub *Hub) markRead(clt *client, readData *wsReadRequestData) (*wsReadData, error) {
+	marker, conversation, err := hub.stores.ReadMarkers.MarkRead(clt.user, readData.ConversationId, readData.MessageId)
+	if err != nil {
+		return nil, err
+	}
+
+	newReadData := &wsReadData{
+		ConversationId:    marker.ConversationID,
+		UserId:            marker.UserID,
+		LastReadMessageId: marker.LastReadMessageID,
+		ReadAt:            marker.UpdatedAt,
 	}
 
+	hub.broadcastEvent(conversation.MemberIDs(), "readReceipt", newReadData, clt)
+
+	return newReadData, nil
+}
+
+// NotifyConversationUpdated tells every member of a conversation, as well as
+// any users who were just removed from it, that its details or membership
+// have changed.
+func (hub *Hub) NotifyConversationUpdated(conversation *models.Conversation, removedUserIDs ...int) {
+	updateData := gin.H{
+		"conversation": newWsMsgConversation(conversation),
+	}
+	userIDs := append(conversation.MemberIDs(), removedUserIDs...)
+	hub.broadcastEvent(userIDs, "conversationUpdated", updateData, nil)
+}
+
+// broadcastEvent records a notification in each user's event log, so that it
+// can be replayed to clients that miss it, then sends it to all of the users'
+// clients except self, which may be nil.
+func (hub *Hub) broadcastEvent(userIDs []int, method string, data interface{}, self *client) {
+	seqs, err := hub.stores.Events.AppendUserEvents(userIDs, method, data)
+	if err != nil {
+		log.Println(err)
+	}
+
+	hub.deliver(userIDs, method, data, seqs, self)
+	hub.publishNotification(userIDs, method, data, seqs)
+}
+
+// broadcastToUsers sends a notification to all clients of the given users,
+// except for the client self, which may be nil.
+func (hub *Hub) broadcastToUsers(userIDs []int, notification *wsNotification, self *client) {
+	hub.deliver(userIDs, notification.Method, notification.Data, nil, self)
+	hub.publishNotification(userIDs, notification.Method, notification.Data, nil)
+}
+
+// deliver sends a notification to the given users' clients that are
+// connected to this hub, except for self.
+func (hub *Hub) deliver(userIDs []int, method string, data interface{}, seqs map[int]int64, self *client) {
 	hub.clientsMutex.RLock()
 	defer hub.clientsMutex.RUnlock()
 
-	newMsgNotification := wsNotification{
-		Type:   "notification",
-		Method: "newMessage",
-		Data:   newMsgData,
+	for _, userID := range userIDs {
+		notification := &wsNotification{
+			Type:   "notification",
+			Method: method,
+			Seq:    seqs[userID],
+			Data:   data,
+		}
+		hub.clients[userID].broadcastNotificationExceptToSelf(notification, self)
+	}
+}
+
+func (hub *Hub) publishNotification(userIDs []int, method string, data interface{}, seqs map[int]int64) {
+	rawData, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	hub.clients[recipient.ID].broadcastNotification(&newMsgNotification)
-	hub.clients[sender.ID].broadcastNotificationExceptToSelf(&newMsgNotification, clt)
 
-	return newMsgData, nil
+	hub.publish(&brokerMessage{
+		Kind:    brokerKindNotification,
+		UserIDs: userIDs,
+		Method:  method,
+		Data:    rawData,
+		Seqs:    seqs,
+	})
+}
+
+// AddClient registers a connected client. Once the hub is shutting down,
+// ErrServerShuttingDown is returned instead.
+func (hub *Hub) AddClient(clt *client) error {
+	cameOnline, wasOnline, err := hub.addClient(clt)
+	if err != nil {
+		return err
+	}
+	if cameOnline {
+		go hub.setOnline(clt.user.ID, wasOnline)
+	}
+	return nil
 }
 
-func (hub *Hub) AddClient(clt *client) {
+// addClient reports whether the client brought its user online on this hub,
+// and whether the user was already online on another.
+func (hub *Hub) addClient(clt *client) (bool, bool, error) {
 	hub.clientsMutex.Lock()
 	defer hub.clientsMutex.Unlock()
 
+	if hub.shuttingDown {
+		return false, false, ErrServerShuttingDown
+	}
+	hub.connected.Add(1)
+
+	cameOnline := false
+	wasOnline := hub.isOnline(clt.user.ID)
 	_, keyExists := hub.clients[clt.user.ID]
 	if !keyExists {
 		hub.clients[clt.user.ID] = make(clientGroup)
+		cameOnline = !hub.cancelOffline(clt.user.ID)
 	}
 	hub.clients[clt.user.ID].addClient(clt)
 
@@ -83,15 +292,23 @@ func (hub *Hub) AddClient(clt *client) {
 		log.Println("added client")
 		log.Println(hub.clients)
 	}
+	return cameOnline, wasOnline, nil
 }
 
 func (hub *Hub) RemoveClient(clt *client) {
+	hub.removeClient(clt)
+	hub.stopClientTyping(clt)
+	hub.connected.Done()
+}
+
+func (hub *Hub) removeClient(clt *client) {
 	hub.clientsMutex.Lock()
 	defer hub.clientsMutex.Unlock()
 
 	hub.clients[clt.user.ID].removeClient(clt)
 	if len(hub.clients[clt.user.ID]) == 0 {
 		delete(hub.clients, clt.user.ID)
+		hub.scheduleOffline(clt.user.ID)
 	}
 
 	if gin.IsDebugging() {
@@ -99,3 +316,30 @@ func (hub *Hub) RemoveClient(clt *client) {
 		log.Println(hub.clients)
 	}
 }
+
+// RevokeSessions disconnects the user's clients that were authenticated with
+// any of the given sessions, on every instance.
+func (hub *Hub) RevokeSessions(userID int, sessionIDs []int) {
+	hub.revokeSessions(userID, sessionIDs)
+	hub.publish(&brokerMessage{
+		Kind:       brokerKindRevokeSessions,
+		UserIDs:    []int{userID},
+		SessionIDs: sessionIDs,
+	})
+}
+
+func (hub *Hub) revokeSessions(userID int, sessionIDs []int) {
+	hub.clientsMutex.RLock()
+	defer hub.clientsMutex.RUnlock()
+
+	revokedIDs := make(map[int]bool)
+	for _, sessionID := range sessionIDs {
+		revokedIDs[sessionID] = true
+	}
+
+	for clt := range hub.clients[userID] {
+		if revokedIDs[clt.session.ID] {
+			clt.revoke()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package chatServer
+
+import "sync/atomic"
+
+// QueueMetrics describes the send queues of the clients connected to a hub.
+type QueueMetrics struct {
+	Clients              int   `json:"clients"`
+	QueueCapacity        int   `json:"queueCapacity"`
+	QueuedNotifications  int   `json:"queuedNotifications"`
+	MaxQueueDepth        int   `json:"maxQueueDepth"`
+	DroppedNotifications int64 `json:"droppedNotifications"`
+	EvictedClients       int64 `json:"evictedClients"`
+}
+
+func (hub *Hub) QueueMetrics() QueueMetrics {
+	hub.clientsMutex.RLock()
+	defer hub.clientsMutex.RUnlock()
+
+	metrics := QueueMetrics{
+		QueueCapacity:        SendQueueSize,
+		DroppedNotifications: atomic.LoadInt64(&hub.droppedNotifications),
+		EvictedClients:       atomic.LoadInt64(&hub.evictedClients),
+	}
+	for _, cltGroup := range hub.clients {
+		for clt := range cltGroup {
+			depth := len(clt.send)
+			metrics.Clients++
+			metrics.QueuedNotifications += depth
+			if depth > metrics.MaxQueueDepth {
+				metrics.MaxQueueDepth = depth
+			}
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,146 @@
+package chatServer
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+const postgresBrokerChannel = "nchat_hub"
+
+// maxNotifyPayload keeps payloads under Postgres's 8000 byte NOTIFY limit.
+// Larger payloads are stored in a table and only their ID is sent.
+const maxNotifyPayload = 7900
+
+// brokerPayloadTTL is how long stored payloads are kept for listeners to
+// fetch them.
+const brokerPayloadTTL = 5 * time.Minute
+
+type brokerPayload struct {
+	ID        int64     `gorm:"primaryKey"`
+	Payload   []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// PostgresBroker is a Broker that uses Postgres LISTEN/NOTIFY, so that hubs
+// on every instance sharing a database receive each other's notifications.
+type PostgresBroker struct {
+	db       *gorm.DB
+	listener *pq.Listener
+
+	handlersMutex sync.RWMutex
+	handlers      []func(payload []byte)
+
+	done chan struct{}
+}
+
+func NewPostgresBroker(connectionStr string, db *gorm.DB) (*PostgresBroker, error) {
+	listener := pq.NewListener(connectionStr, time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Println("broker:", err)
+			}
+		})
+	err := listener.Listen(postgresBrokerChannel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	broker := &PostgresBroker{
+		db:       db,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	go broker.listen()
+	return broker, nil
+}
+
+// Publish sends a payload to every subscribed hub, including this instance's.
+func (broker *PostgresBroker) Publish(payload []byte) error {
+	notifyPayload := string(payload)
+	if len(payload) > maxNotifyPayload {
+		stored := &brokerPayload{Payload: payload}
+		result := broker.db.Create(stored)
+		if result.Error != nil {
+			return result.Error
+		}
+		notifyPayload = strconv.FormatInt(stored.ID, 10)
+	}
+
+	return broker.db.Exec("SELECT pg_notify(?, ?)", postgresBrokerChannel, notifyPayload).Error
+}
+
+func (broker *PostgresBroker) Subscribe(handler func(payload []byte)) {
+	broker.handlersMutex.Lock()
+	defer broker.handlersMutex.Unlock()
+
+	broker.handlers = append(broker.handlers, handler)
+}
+
+func (broker *PostgresBroker) Close() error {
+	close(broker.done)
+	return broker.listener.Close()
+}
+
+func (broker *PostgresBroker) listen() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-broker.done:
+			return
+		case notification := <-broker.listener.Notify:
+			// A nil notification means the connection was re-established, and
+			// anything sent in the meantime was lost. Clients recover missed
+			// events when they reconnect.
+			if notification == nil {
+				log.Println("broker: reconnected to database")
+				continue
+			}
+			broker.dispatch(notification.Extra)
+		case <-ticker.C:
+			go broker.listener.Ping()
+			broker.pruneStoredPayloads()
+		}
+	}
+}
+
+func (broker *PostgresBroker) dispatch(notifyPayload string) {
+	payload := []byte(notifyPayload)
+	if !bytes.HasPrefix(payload, []byte("{")) {
+		id, err := strconv.ParseInt(notifyPayload, 10, 64)
+		if err != nil {
+			log.Println("broker: invalid payload:", err)
+			return
+		}
+
+		var stored brokerPayload
+		result := broker.db.Take(&stored, id)
+		if result.Error != nil {
+			log.Println("broker:", result.Error)
+			return
+		}
+		payload = stored.Payload
+	}
+
+	broker.handlersMutex.RLock()
+	defer broker.handlersMutex.RUnlock()
+
+	for _, handler := range broker.handlers {
+		handler(payload)
+	}
+}
+
+func (broker *PostgresBroker) pruneStoredPayloads() {
+	result := broker.db.Where("created_at < ?", time.Now().Add(-brokerPayloadTTL)).Delete(&brokerPayload{})
+	if result.Error != nil {
+		log.Println("broker:", result.Error)
+	}
+}
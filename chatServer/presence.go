@@ -0,0 +1,298 @@
+package chatServer
+
+import (
+	"log"
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+)
+
+// presenceGracePeriod is how long a user stays online after their last client
+// disconnects, so that page reloads and brief network drops don't cause
+// presence to flicker.
+const presenceGracePeriod = 15 * time.Second
+
+// Each hub publishes the users online on it whenever one comes or goes, and
+// the full list every presenceSyncInterval, which corrects any updates that
+// crossed in flight. A hub that hasn't been heard from for presenceExpiry is
+// assumed to have gone away, taking its users with it.
+const presenceSyncInterval = 30 * time.Second
+const presenceExpiry = 3 * presenceSyncInterval
+
+const PresenceOnline = "online"
+const PresenceOffline = "offline"
+
+// remotePresence is the set of users online on another hub.
+type remotePresence struct {
+	userIDs map[int]bool
+	seenAt  time.Time
+}
+
+// presenceChange is a change in whether a user is online on any hub.
+type presenceChange struct {
+	userID   int
+	status   string
+	lastSeen *time.Time
+}
+
+// IsOnline reports whether the user has a client connected to any instance,
+// or had one within the grace period.
+func (hub *Hub) IsOnline(userID int) bool {
+	hub.clientsMutex.RLock()
+	defer hub.clientsMutex.RUnlock()
+
+	return hub.isOnline(userID)
+}
+
+// isOnline is like IsOnline, but must be called with clientsMutex held.
+func (hub *Hub) isOnline(userID int) bool {
+	if hub.isLocallyOnline(userID) {
+		return true
+	}
+	for _, remote := range hub.remotePresence {
+		if remote.userIDs[userID] {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocallyOnline reports whether the user is online on this hub. It must be
+// called with clientsMutex held.
+func (hub *Hub) isLocallyOnline(userID int) bool {
+	_, hasClients := hub.clients[userID]
+	_, isPendingOffline := hub.offlineTimers[userID]
+	return hasClients || isPendingOffline
+}
+
+// Presence returns the user's presence status, along with when they were last
+// seen if they are offline.
+func (hub *Hub) Presence(user *models.User) (string, *time.Time) {
+	if hub.IsOnline(user.ID) {
+		return PresenceOnline, nil
+	}
+	return PresenceOffline, user.LastSeenAt
+}
+
+// scheduleOffline marks the user offline after the grace period unless they
+// reconnect first. It must be called with clientsMutex held.
+func (hub *Hub) scheduleOffline(userID int) {
+	var timer *time.Timer
+	timer = time.AfterFunc(presenceGracePeriod, func() {
+		hub.clientsMutex.Lock()
+		isCurrent := hub.offlineTimers[userID] == timer
+		if isCurrent {
+			delete(hub.offlineTimers, userID)
+		}
+		hub.clientsMutex.Unlock()
+
+		if isCurrent {
+			hub.setOffline(userID)
+		}
+	})
+	hub.offlineTimers[userID] = timer
+}
+
+// cancelOffline cancels a pending offline transition, and reports whether
+// there was one. It must be called with clientsMutex held.
+func (hub *Hub) cancelOffline(userID int) bool {
+	timer, isPendingOffline := hub.offlineTimers[userID]
+	if isPendingOffline {
+		timer.Stop()
+		delete(hub.offlineTimers, userID)
+	}
+	return isPendingOffline
+}
+
+// setOnline tells the other hubs that the user came online on this one, and
+// the user's contacts if the user wasn't already online elsewhere.
+func (hub *Hub) setOnline(userID int, wasOnline bool) {
+	hub.publish(&brokerMessage{
+		Kind:    brokerKindPresence,
+		UserIDs: []int{userID},
+		Status:  PresenceOnline,
+	})
+	if !wasOnline {
+		hub.deliverPresence(presenceChange{userID: userID, status: PresenceOnline})
+	}
+}
+
+// setOffline records when the user was last seen on this hub and tells the
+// other hubs, then tells the user's contacts if the user isn't online
+// elsewhere.
+func (hub *Hub) setOffline(userID int) {
+	lastSeen := time.Now()
+	err := hub.stores.Users.UpdateLastSeen(userID, lastSeen)
+	if err != nil {
+		log.Println(err)
+	}
+
+	hub.publish(&brokerMessage{
+		Kind:     brokerKindPresence,
+		UserIDs:  []int{userID},
+		Status:   PresenceOffline,
+		LastSeen: &lastSeen,
+	})
+	if !hub.IsOnline(userID) {
+		hub.deliverPresence(presenceChange{userID: userID, status: PresenceOffline, lastSeen: &lastSeen})
+	}
+}
+
+// localPresenceUserIDs returns the users online on this hub.
+func (hub *Hub) localPresenceUserIDs() []int {
+	hub.clientsMutex.RLock()
+	defer hub.clientsMutex.RUnlock()
+
+	userIDs := []int{}
+	for userID := range hub.clients {
+		userIDs = append(userIDs, userID)
+	}
+	for userID := range hub.offlineTimers {
+		if _, hasClients := hub.clients[userID]; !hasClients {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+func (hub *Hub) publishPresenceSync() {
+	hub.publish(&brokerMessage{
+		Kind:    brokerKindPresenceSync,
+		UserIDs: hub.localPresenceUserIDs(),
+	})
+}
+
+// syncPresence periodically publishes the users online on this hub, and
+// forgets hubs that have stopped publishing theirs.
+func (hub *Hub) syncPresence() {
+	for range time.Tick(presenceSyncInterval) {
+		hub.publishPresenceSync()
+		hub.expireRemotePresence()
+	}
+}
+
+// updateRemotePresence applies a change to the users online on another hub.
+// If snapshot is set, userIDs replaces that hub's users; otherwise they are
+// set to status.
+func (hub *Hub) updateRemotePresence(origin string, userIDs []int, status string, lastSeen *time.Time,
+	snapshot bool) {
+	hub.clientsMutex.Lock()
+	remote, isKnown := hub.remotePresence[origin]
+	if !isKnown {
+		remote = &remotePresence{userIDs: make(map[int]bool)}
+		hub.remotePresence[origin] = remote
+	}
+	remote.seenAt = time.Now()
+
+	var changes []presenceChange
+	if snapshot {
+		newUserIDs := make(map[int]bool)
+		for _, userID := range userIDs {
+			newUserIDs[userID] = true
+		}
+		affectedUserIDs := []int{}
+		for userID := range remote.userIDs {
+			if !newUserIDs[userID] {
+				affectedUserIDs = append(affectedUserIDs, userID)
+			}
+		}
+		for userID := range newUserIDs {
+			if !remote.userIDs[userID] {
+				affectedUserIDs = append(affectedUserIDs, userID)
+			}
+		}
+		changes = hub.changePresence(affectedUserIDs, func() {
+			remote.userIDs = newUserIDs
+		})
+	} else {
+		changes = hub.changePresence(userIDs, func() {
+			for _, userID := range userIDs {
+				if status == PresenceOnline {
+					remote.userIDs[userID] = true
+				} else {
+					delete(remote.userIDs, userID)
+				}
+			}
+		})
+	}
+	hub.clientsMutex.Unlock()
+
+	for _, change := range changes {
+		if change.status == PresenceOffline && lastSeen != nil {
+			change.lastSeen = lastSeen
+		}
+		hub.deliverPresence(change)
+	}
+
+	// Let a hub that just started learn who is online here without waiting
+	// for the next sync.
+	if !isKnown {
+		hub.publishPresenceSync()
+	}
+}
+
+// expireRemotePresence forgets the hubs that haven't published their users
+// within presenceExpiry.
+func (hub *Hub) expireRemotePresence() {
+	hub.clientsMutex.Lock()
+	expiredOrigins := []string{}
+	affectedUserIDs := []int{}
+	for origin, remote := range hub.remotePresence {
+		if time.Since(remote.seenAt) > presenceExpiry {
+			expiredOrigins = append(expiredOrigins, origin)
+			for userID := range remote.userIDs {
+				affectedUserIDs = append(affectedUserIDs, userID)
+			}
+		}
+	}
+	changes := hub.changePresence(affectedUserIDs, func() {
+		for _, origin := range expiredOrigins {
+			delete(hub.remotePresence, origin)
+		}
+	})
+	hub.clientsMutex.Unlock()
+
+	for _, change := range changes {
+		hub.deliverPresence(change)
+	}
+}
+
+// changePresence applies change and returns which of the given users it
+// brought online or took offline. It must be called with clientsMutex held.
+func (hub *Hub) changePresence(userIDs []int, change func()) []presenceChange {
+	wasOnline := make(map[int]bool)
+	for _, userID := range userIDs {
+		wasOnline[userID] = hub.isOnline(userID)
+	}
+	change()
+
+	now := time.Now()
+	changes := []presenceChange{}
+	for userID, was := range wasOnline {
+		isOnline := hub.isOnline(userID)
+		if isOnline && !was {
+			changes = append(changes, presenceChange{userID: userID, status: PresenceOnline})
+		} else if !isOnline && was {
+			changes = append(changes, presenceChange{userID: userID, status: PresenceOffline, lastSeen: &now})
+		}
+	}
+	return changes
+}
+
+// deliverPresence notifies everyone connected to this hub who shares a
+// conversation with the user of a change in the user's presence. Every hub
+// sees the change for itself, so it isn't published.
+func (hub *Hub) deliverPresence(change presenceChange) {
+	contactIDs, err := hub.stores.Users.GetContactIDs(change.userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	presenceData := &wsPresenceData{
+		UserId:   change.userID,
+		Status:   change.status,
+		LastSeen: change.lastSeen,
+	}
+	hub.deliver(contactIDs, "presence", presenceData, nil, nil)
+}
@@ -0,0 +1,56 @@
+package chatServer
+
+import (
+	"time"
+
+	"github.com/nrmilstein/nchat/utils"
+)
+
+// WsMethodLimits limits how often each client may call each WebSocket
+// method. Methods that aren't listed use DefaultWsMethodLimit.
+var WsMethodLimits = map[string]utils.RateLimit{
+	"sendMessage":   {Rate: 5, Burst: 10},
+	"typingStarted": {Rate: 2, Burst: 5},
+	"typingStopped": {Rate: 2, Burst: 5},
+	"loadHistory":   {Rate: 2, Burst: 10},
+}
+var DefaultWsMethodLimit = utils.RateLimit{Rate: 10, Burst: 20}
+
+// rateLimitError is returned for throttled requests, and tells the client
+// how long to wait before retrying.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (err *rateLimitError) Error() string {
+	return ErrRateLimited.Error()
+}
+
+func (err *rateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+type wsRateLimitData struct {
+	RetryAfter int64 `json:"retryAfter"`
+}
+
+func newMethodLimiters() map[string]*utils.TokenBucket {
+	limiters := make(map[string]*utils.TokenBucket)
+	for method := range wsRequestHandlers {
+		limit, ok := WsMethodLimits[method]
+		if !ok {
+			limit = DefaultWsMethodLimit
+		}
+		limiters[method] = limit.NewTokenBucket()
+	}
+	return limiters
+}
+
+// allowRequest takes a token from the client's limiter for the method.
+func (clt *client) allowRequest(method string) error {
+	limiter := clt.methodLimiters[method]
+	if limiter == nil || limiter.Allow() {
+		return nil
+	}
+	return &rateLimitError{retryAfter: limiter.RetryAfter()}
+}
@@ -0,0 +1,97 @@
+package chatServer
+
+import (
+	"context"
+	"encoding/json"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const replayBatchSize = 100
+
+// maxReplayEvents caps how many missed events are replayed to a reconnecting
+// client. Clients that missed more than this are told to resync over REST
+// instead.
+const maxReplayEvents = 1000
+
+// ResumeFrom makes the client replay the user's events after lastSeq when it
+// starts serving, before any live notifications are delivered.
+func (clt *client) ResumeFrom(lastSeq int64) {
+	clt.resumeSeq = &lastSeq
+}
+
+func (clt *client) replayEvents(ctx context.Context, connection *websocket.Conn) error {
+	seq := *clt.resumeSeq
+	replayed := 0
+
+	for {
+		events, err := clt.hub.stores.Events.GetUserEventsSince(clt.user.ID, seq, replayBatchSize)
+		if err != nil {
+			return err
+		}
+
+		// A gap means the events were pruned, so they can't be replayed. If
+		// every event after seq was pruned there are none to show the gap, so
+		// compare against the user's latest seq instead.
+		if len(events) > 0 && events[0].Seq != seq+1 {
+			return clt.requireResync(ctx, connection)
+		}
+		if len(events) == 0 {
+			currentSeq, err := clt.hub.stores.Events.GetUserEventSeq(clt.user.ID)
+			if err != nil {
+				return err
+			}
+			if currentSeq > seq {
+				return clt.requireResync(ctx, connection)
+			}
+		}
+
+		for _, event := range events {
+			notification := &wsNotification{
+				Type:   "notification",
+				Method: event.Method,
+				Seq:    event.Seq,
+				Data:   json.RawMessage(event.Data),
+			}
+			err := wsjson.Write(ctx, connection, notification)
+			if err != nil {
+				return err
+			}
+			seq = event.Seq
+		}
+
+		replayed += len(events)
+		if len(events) < replayBatchSize {
+			break
+		}
+		if replayed >= maxReplayEvents {
+			return clt.requireResync(ctx, connection)
+		}
+	}
+
+	clt.replayedSeq = seq
+	return nil
+}
+
+// requireResync tells the client that it must refetch its state over REST,
+// and skips live notifications that the refetch will already include.
+func (clt *client) requireResync(ctx context.Context, connection *websocket.Conn) error {
+	seq, err := clt.hub.stores.Events.GetUserEventSeq(clt.user.ID)
+	if err != nil {
+		return err
+	}
+
+	notification := &wsNotification{
+		Type:   "notification",
+		Method: "resyncRequired",
+		Data:   WsAuthResponseData{LastSeq: seq},
+	}
+	err = wsjson.Write(ctx, connection, notification)
+	if err != nil {
+		return err
+	}
+
+	clt.replayedSeq = seq
+	return nil
+}
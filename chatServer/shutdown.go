@@ -0,0 +1,105 @@
+package chatServer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+var ErrServerShuttingDown = errors.New("Server is shutting down.")
+
+// Clients are told to wait a random time in this range before reconnecting,
+// so that they don't all reconnect to the remaining instances at once.
+const minReconnectDelay = time.Second
+const maxReconnectDelay = 5 * time.Second
+
+type wsGoingAwayData struct {
+	ReconnectIn int64 `json:"reconnectIn"`
+}
+
+// IsShuttingDown reports whether the hub has stopped accepting clients.
+func (hub *Hub) IsShuttingDown() bool {
+	hub.clientsMutex.RLock()
+	defer hub.clientsMutex.RUnlock()
+
+	return hub.shuttingDown
+}
+
+// Shutdown stops the hub from accepting new clients and tells every connected
+// client to go away once its in-flight requests are finished. It returns when
+// every client has disconnected, or when ctx is done.
+func (hub *Hub) Shutdown(ctx context.Context) error {
+	hub.clientsMutex.Lock()
+	hub.shuttingDown = true
+	for _, cltGroup := range hub.clients {
+		for clt := range cltGroup {
+			clt.goAway()
+		}
+	}
+	hub.clientsMutex.Unlock()
+
+	disconnected := make(chan struct{})
+	go func() {
+		hub.connected.Wait()
+		close(disconnected)
+	}()
+
+	select {
+	case <-disconnected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (clt *client) goAway() {
+	clt.goAwayOnce.Do(func() {
+		close(clt.goingAway)
+	})
+}
+
+// drain waits for the client's in-flight requests to be answered, then tells
+// the client when to reconnect.
+func (clt *client) drain(ctx context.Context, connection *websocket.Conn,
+	stopWriting chan struct{}, writerDone chan struct{}) error {
+	requestsDone := make(chan struct{})
+	go func() {
+		clt.inFlight.Wait()
+		close(requestsDone)
+	}()
+
+	select {
+	case <-requestsDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	close(stopWriting)
+	select {
+	case <-writerDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	reconnectDelay := minReconnectDelay +
+		time.Duration(rand.Int63n(int64(maxReconnectDelay-minReconnectDelay)))
+	notification := &wsNotification{
+		Type:   "notification",
+		Method: "goingAway",
+		Data: &wsGoingAwayData{
+			ReconnectIn: reconnectDelay.Milliseconds(),
+		},
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	err := wsjson.Write(writeCtx, connection, notification)
+	if err != nil {
+		return err
+	}
+	return ErrServerShuttingDown
+}
@@ -0,0 +1,153 @@
+package chatServer
+
+import (
+	"time"
+)
+
+// typingTimeout is how long a user is shown as typing after their last
+// typingStarted request. Clients should repeat typingStarted more often than
+// this while the user is still typing.
+const typingTimeout = 6 * time.Second
+
+type typingKey struct {
+	conversationID int
+	userID         int
+}
+
+type typingState struct {
+	clt       *client
+	memberIDs []int
+	timer     *time.Timer
+}
+
+func (hub *Hub) startTyping(clt *client, typingData *wsTypingRequestData) (*wsTypingData, error) {
+	key := typingKey{conversationID: typingData.ConversationId, userID: clt.user.ID}
+
+	hub.typingMutex.Lock()
+	state, isTyping := hub.typing[key]
+	if isTyping {
+		state.clt = clt
+		state.timer.Reset(typingTimeout)
+	}
+	hub.typingMutex.Unlock()
+
+	newTypingData := &wsTypingData{
+		ConversationId: key.conversationID,
+		UserId:         key.userID,
+		IsTyping:       true,
+	}
+	if isTyping {
+		return newTypingData, nil
+	}
+
+	conversation, err := hub.stores.Conversations.GetUserConversation(clt.user, typingData.ConversationId)
+	if err != nil {
+		return nil, err
+	}
+
+	state = &typingState{
+		clt:       clt,
+		memberIDs: conversation.MemberIDs(),
+	}
+
+	hub.typingMutex.Lock()
+	_, isTyping = hub.typing[key]
+	if !isTyping {
+		hub.typing[key] = state
+		state.timer = time.AfterFunc(typingTimeout, func() {
+			hub.stopTypingState(key, state)
+		})
+	}
+	hub.typingMutex.Unlock()
+
+	if isTyping {
+		return newTypingData, nil
+	}
+
+	hub.broadcastTyping(state, newTypingData)
+	return newTypingData, nil
+}
+
+func (hub *Hub) stopTyping(clt *client, typingData *wsTypingRequestData) (*wsTypingData, error) {
+	key := typingKey{conversationID: typingData.ConversationId, userID: clt.user.ID}
+
+	hub.typingMutex.Lock()
+	state := hub.typing[key]
+	hub.typingMutex.Unlock()
+
+	if state != nil {
+		hub.stopTypingState(key, state)
+	}
+
+	return &wsTypingData{
+		ConversationId: key.conversationID,
+		UserId:         key.userID,
+		IsTyping:       false,
+	}, nil
+}
+
+// stopTypingState clears the given typing state and notifies the
+// conversation, unless the state has already been cleared.
+func (hub *Hub) stopTypingState(key typingKey, state *typingState) {
+	hub.typingMutex.Lock()
+	if hub.typing[key] != state {
+		hub.typingMutex.Unlock()
+		return
+	}
+	delete(hub.typing, key)
+	state.timer.Stop()
+	hub.typingMutex.Unlock()
+
+	hub.broadcastTyping(state, &wsTypingData{
+		ConversationId: key.conversationID,
+		UserId:         key.userID,
+		IsTyping:       false,
+	})
+}
+
+// stopClientTyping clears every typing state started by clt, such as when it
+// disconnects.
+func (hub *Hub) stopClientTyping(clt *client) {
+	hub.typingMutex.Lock()
+	states := make(map[typingKey]*typingState)
+	for key, state := range hub.typing {
+		if state.clt == clt {
+			states[key] = state
+		}
+	}
+	hub.typingMutex.Unlock()
+
+	for key, state := range states {
+		hub.stopTypingState(key, state)
+	}
+}
+
+// stopUserTyping clears a user's typing state in a conversation, such as when
+// they send a message.
+func (hub *Hub) stopUserTyping(conversationID int, userID int) {
+	key := typingKey{conversationID: conversationID, userID: userID}
+
+	hub.typingMutex.Lock()
+	state := hub.typing[key]
+	hub.typingMutex.Unlock()
+
+	if state != nil {
+		hub.stopTypingState(key, state)
+	}
+}
+
+func (hub *Hub) broadcastTyping(state *typingState, typingData *wsTypingData) {
+	typingNotification := wsNotification{
+		Type:   "notification",
+		Method: "typing",
+		Data:   typingData,
+	}
+
+	otherMemberIDs := []int{}
+	for _, memberID := range state.memberIDs {
+		if memberID != typingData.UserId {
+			otherMemberIDs = append(otherMemberIDs, memberID)
+		}
+	}
+	hub.broadcastToUsers(otherMemberIDs, &typingNotification, nil)
+}
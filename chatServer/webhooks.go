@@ -0,0 +1,37 @@
+package chatServer
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nrmilstein/nchat/app/models"
+)
+
+// NotifyConversationCreated tells the members of a new conversation about it.
+func (hub *Hub) NotifyConversationCreated(conversation *models.Conversation) {
+	hub.NotifyConversationUpdated(conversation)
+	hub.emitWebhookEvent(models.WebhookEventConversationCreated, conversation.MemberIDs(), gin.H{
+		"conversation": newWsMsgConversation(conversation),
+	})
+}
+
+// NotifyUserRegistered sends a new user to the admins' webhooks.
+func (hub *Hub) NotifyUserRegistered(user *models.User) {
+	hub.emitWebhookEvent(models.WebhookEventUserRegistered, nil, gin.H{
+		"user": gin.H{
+			"id":       user.ID,
+			"username": user.Username,
+			"name":     user.Name,
+		},
+	})
+}
+
+// emitWebhookEvent queues an event for the given users' webhooks. Webhooks
+// are sent in the background, so failing to queue one doesn't fail the
+// request that caused it.
+func (hub *Hub) emitWebhookEvent(event string, userIDs []int, data interface{}) {
+	err := hub.stores.Webhooks.EnqueueWebhookEvent(event, userIDs, data)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -1,10 +1,12 @@
 package chatServer
 
+import "encoding/json"
+
 type wsRequest struct {
-	Id     int               `json:"id"`
-	Type   string            `json:"type"`
-	Method string            `json:"method"`
-	Data   map[string]string `json:"data"`
+	Id     int             `json:"id"`
+	Type   string          `json:"type"`
+	Method string          `json:"method"`
+	Data   json.RawMessage `json:"data"`
 }
 
 type wsSuccessResponse struct {
@@ -26,5 +28,6 @@ type wsErrorResponse struct {
 type wsNotification struct {
 	Type   string      `json:"type"`
 	Method string      `json:"method"`
+	Seq    int64       `json:"seq,omitempty"`
 	Data   interface{} `json:"data"`
 }
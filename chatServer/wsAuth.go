@@ -9,10 +9,16 @@ type WsAuthRequest struct {
 
 type wsAuthRequestData struct {
 	AuthKey string `json:"authKey"`
+	LastSeq *int64 `json:"lastSeq"`
 }
 
 type WsAuthSuccessResponse struct {
-	Id     int    `json:"id"`
-	Type   string `json:"type"`
-	Status string `json:"status"`
+	Id     int                `json:"id"`
+	Type   string             `json:"type"`
+	Status string             `json:"status"`
+	Data   WsAuthResponseData `json:"data"`
+}
+
+type WsAuthResponseData struct {
+	LastSeq int64 `json:"lastSeq"`
 }
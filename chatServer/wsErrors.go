@@ -0,0 +1,87 @@
+package chatServer
+
+import (
+	"errors"
+	"log"
+
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/utils"
+	"gorm.io/gorm"
+)
+
+// WebSocket error codes are part of the protocol, so existing codes must never
+// be renumbered.
+const (
+	wsErrCodeInternal             = 1
+	wsErrCodeInvalidRequest       = 2
+	wsErrCodeMethodNotFound       = 3
+	wsErrCodeInvalidRequestData   = 4
+	wsErrCodeRateLimited          = 5
+	wsErrCodeNotFound             = 6
+	wsErrCodeUserNotFound         = 10
+	wsErrCodeSameUser             = 11
+	wsErrCodeConversationNotFound = 13
+	wsErrCodeNotGroupConversation = 14
+	wsErrCodeMessageNotFound      = 20
+	wsErrCodeInvalidPageCursor    = 21
+	wsErrCodeNotMessageSender     = 22
+	wsErrCodeMessageDeleted       = 23
+	wsErrCodeEmptyMessageBody     = 24
+	wsErrCodeInvalidReply         = 25
+	wsErrCodeAttachmentNotFound   = 30
+	wsErrCodeInvalidEmoji         = 40
+	wsErrCodeDuplicateReaction    = 41
+	wsErrCodeReactionNotFound     = 42
+)
+
+var wsErrorCodes = []struct {
+	err  error
+	code int
+}{
+	{ErrInvalidRequest, wsErrCodeInvalidRequest},
+	{ErrRequestMethodNotFound, wsErrCodeMethodNotFound},
+	{ErrInvalidRequestData, wsErrCodeInvalidRequestData},
+	{ErrRateLimited, wsErrCodeRateLimited},
+	{models.ErrUserNotFound, wsErrCodeUserNotFound},
+	{models.ErrSameUser, wsErrCodeSameUser},
+	{models.ErrConversationNotFound, wsErrCodeConversationNotFound},
+	{models.ErrNotGroupConversation, wsErrCodeNotGroupConversation},
+	{models.ErrMessageNotFound, wsErrCodeMessageNotFound},
+	{models.ErrInvalidPageCursor, wsErrCodeInvalidPageCursor},
+	{models.ErrNotMessageSender, wsErrCodeNotMessageSender},
+	{models.ErrMessageDeleted, wsErrCodeMessageDeleted},
+	{models.ErrEmptyMessageBody, wsErrCodeEmptyMessageBody},
+	{models.ErrInvalidReply, wsErrCodeInvalidReply},
+	{models.ErrAttachmentNotFound, wsErrCodeAttachmentNotFound},
+	{models.ErrInvalidEmoji, wsErrCodeInvalidEmoji},
+	{models.ErrDuplicateReaction, wsErrCodeDuplicateReaction},
+	{models.ErrReactionNotFound, wsErrCodeReactionNotFound},
+	{gorm.ErrRecordNotFound, wsErrCodeNotFound},
+}
+
+func newWsErrorResponse(requestId int, err error) *wsErrorResponse {
+	response := &wsErrorResponse{
+		Id:     requestId,
+		Type:   "response",
+		Status: "error",
+	}
+
+	for _, errorCode := range wsErrorCodes {
+		if errors.Is(err, errorCode.err) {
+			response.Code = errorCode.code
+			response.Message = err.Error()
+
+			var rateLimitErr *rateLimitError
+			if errors.As(err, &rateLimitErr) {
+				response.Data = &wsRateLimitData{RetryAfter: rateLimitErr.retryAfter.Milliseconds()}
+			}
+			return response
+		}
+	}
+
+	// Don't leak database or other internal details to the client.
+	log.Println(err)
+	response.Code = wsErrCodeInternal
+	response.Message = utils.ErrInternalServer.Message
+	return response
+}
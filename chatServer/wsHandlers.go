@@ -0,0 +1,139 @@
+package chatServer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type wsRequestHandler func(clt *client, data json.RawMessage) (interface{}, error)
+
+var wsRequestHandlers = map[string]wsRequestHandler{
+	"sendMessage":    handleSendMessage,
+	"editMessage":    handleEditMessage,
+	"deleteMessage":  handleDeleteMessage,
+	"markRead":       handleMarkRead,
+	"typingStarted":  handleTypingStarted,
+	"typingStopped":  handleTypingStopped,
+	"loadHistory":    handleLoadHistory,
+	"addReaction":    handleAddReaction,
+	"removeReaction": handleRemoveReaction,
+}
+
+func decodeWsRequestData(data json.RawMessage, requestData interface{}) error {
+	err := json.Unmarshal(data, requestData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequestData, err)
+	}
+	return nil
+}
+
+func handleSendMessage(clt *client, data json.RawMessage) (interface{}, error) {
+	msgRequestData := &wsMsgRequestData{}
+	err := decodeWsRequestData(data, msgRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.relayMessage(clt, msgRequestData)
+}
+
+func handleEditMessage(clt *client, data json.RawMessage) (interface{}, error) {
+	editRequestData := &wsMsgEditRequestData{}
+	err := decodeWsRequestData(data, editRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.editMessage(clt, editRequestData)
+}
+
+func handleDeleteMessage(clt *client, data json.RawMessage) (interface{}, error) {
+	deleteRequestData := &wsMsgDeleteRequestData{}
+	err := decodeWsRequestData(data, deleteRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.deleteMessage(clt, deleteRequestData)
+}
+
+func handleMarkRead(clt *client, data json.RawMessage) (interface{}, error) {
+	readRequestData := &wsReadRequestData{}
+	err := decodeWsRequestData(data, readRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.markRead(clt, readRequestData)
+}
+
+func handleTypingStarted(clt *client, data json.RawMessage) (interface{}, error) {
+	typingRequestData := &wsTypingRequestData{}
+	err := decodeWsRequestData(data, typingRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.startTyping(clt, typingRequestData)
+}
+
+func handleTypingStopped(clt *client, data json.RawMessage) (interface{}, error) {
+	typingRequestData := &wsTypingRequestData{}
+	err := decodeWsRequestData(data, typingRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.stopTyping(clt, typingRequestData)
+}
+
+func handleAddReaction(clt *client, data json.RawMessage) (interface{}, error) {
+	reactionRequestData := &wsReactionRequestData{}
+	err := decodeWsRequestData(data, reactionRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.addReaction(clt, reactionRequestData)
+}
+
+func handleRemoveReaction(clt *client, data json.RawMessage) (interface{}, error) {
+	reactionRequestData := &wsReactionRequestData{}
+	err := decodeWsRequestData(data, reactionRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return clt.hub.removeReaction(clt, reactionRequestData)
+}
+
+func handleLoadHistory(clt *client, data json.RawMessage) (interface{}, error) {
+	historyRequestData := &wsHistoryRequestData{}
+	err := decodeWsRequestData(data, historyRequestData)
+	if err != nil {
+		return nil, err
+	}
+	return loadHistory(clt, historyRequestData)
+}
+
+func loadHistory(clt *client, historyData *wsHistoryRequestData) (*wsHistoryData, error) {
+	conversation, err := clt.hub.stores.Conversations.GetUserConversation(clt.user, historyData.ConversationId)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := clt.hub.stores.Messages.GetMessagePage(conversation.ID,
+		historyData.Before, historyData.After, historyData.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []wsMsgMessage{}
+	for _, message := range page.Messages {
+		messages = append(messages, newWsMsgMessage(&message))
+	}
+
+	newHistoryData := &wsHistoryData{
+		ConversationId: conversation.ID,
+		Messages:       messages,
+	}
+	if page.PrevCursor != 0 {
+		newHistoryData.PrevCursor = &page.PrevCursor
+	}
+	if page.NextCursor != 0 {
+		newHistoryData.NextCursor = &page.NextCursor
+	}
+	return newHistoryData, nil
+}
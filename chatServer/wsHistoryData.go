@@ -0,0 +1,15 @@
+package chatServer
+
+type wsHistoryRequestData struct {
+	ConversationId int `json:"conversationId"`
+	Before         int `json:"before"`
+	After          int `json:"after"`
+	Limit          int `json:"limit"`
+}
+
+type wsHistoryData struct {
+	ConversationId int            `json:"conversationId"`
+	Messages       []wsMsgMessage `json:"messages"`
+	PrevCursor     *int           `json:"prevCursor"`
+	NextCursor     *int           `json:"nextCursor"`
+}
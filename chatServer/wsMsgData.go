@@ -1,10 +1,17 @@
 package chatServer
 
-import "time"
+import (
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+)
 
 type wsMsgRequestData struct {
-	Username string `json:"username"`
-	Body     string `json:"body"`
+	ConversationId   int    `json:"conversationId"`
+	Username         string `json:"username"`
+	Body             string `json:"body"`
+	ReplyToMessageId int    `json:"replyToMessageId"`
+	AttachmentIds    []int  `json:"attachmentIds"`
 }
 
 type wsMsgData struct {
@@ -12,21 +19,123 @@ type wsMsgData struct {
 	Conversation wsMsgConversation `json:"conversation"`
 }
 type wsMsgMessage struct {
-	Id             int       `json:"id"`
-	ConversationId int       `json:"conversationId"`
-	SenderId       int       `json:"senderId"`
-	Body           string    `json:"body"`
-	CreatedAt      time.Time `json:"sent"`
+	Id             int               `json:"id"`
+	ConversationId int               `json:"conversationId"`
+	SenderId       int               `json:"senderId"`
+	Body           string            `json:"body"`
+	CreatedAt      time.Time         `json:"sent"`
+	EditedAt       *time.Time        `json:"edited"`
+	DeletedAt      *time.Time        `json:"deleted"`
+	ReplyToId      *int              `json:"replyToMessageId"`
+	ReplyTo        *wsMsgReplyTo     `json:"replyTo"`
+	Attachments    []wsMsgAttachment `json:"attachments"`
+}
+
+// wsMsgReplyTo is a quoted preview of the message that a message replies to.
+type wsMsgReplyTo struct {
+	Id        int        `json:"id"`
+	SenderId  int        `json:"senderId"`
+	Body      string     `json:"body"`
+	DeletedAt *time.Time `json:"deleted"`
+}
+
+type wsMsgAttachment struct {
+	Id           int    `json:"id"`
+	Filename     string `json:"filename"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	Url          string `json:"url"`
+	ThumbnailUrl string `json:"thumbnailUrl,omitempty"`
+}
+
+type wsMsgEditRequestData struct {
+	MessageId int    `json:"messageId"`
+	Body      string `json:"body"`
+}
+
+type wsMsgDeleteRequestData struct {
+	MessageId int `json:"messageId"`
+}
+
+type wsMsgUpdateData struct {
+	Message wsMsgMessage `json:"message"`
 }
 
 type wsMsgConversation struct {
-	Id                  int                      `json:"id"`
-	CreatedAt           time.Time                `json:"created"`
-	ConversationPartner wsMsgConversationPartner `json:"conversationPartner"`
+	Id           int         `json:"id"`
+	Type         string      `json:"type"`
+	Title        string      `json:"title"`
+	CreatedAt    time.Time   `json:"created"`
+	Participants []wsMsgUser `json:"participants"`
 }
 
-type wsMsgConversationPartner struct {
+type wsMsgUser struct {
 	Id       int    `json:"id"`
 	Username string `json:"username"`
 	Name     string `json:"name"`
 }
+
+func newWsMsgMessage(message *models.Message) wsMsgMessage {
+	attachments := []wsMsgAttachment{}
+	for _, attachment := range message.Attachments {
+		attachments = append(attachments, wsMsgAttachment{
+			Id:           attachment.ID,
+			Filename:     attachment.Filename,
+			ContentType:  attachment.ContentType,
+			Size:         attachment.Size,
+			Width:        attachment.Width,
+			Height:       attachment.Height,
+			Url:          attachment.Url(),
+			ThumbnailUrl: attachment.ThumbnailUrl(),
+		})
+	}
+
+	var replyTo *wsMsgReplyTo
+	if message.ReplyTo != nil {
+		replyTo = &wsMsgReplyTo{
+			Id:        message.ReplyTo.ID,
+			SenderId:  message.ReplyTo.UserID,
+			Body:      message.ReplyTo.Preview(),
+			DeletedAt: message.ReplyTo.DeletedAt,
+		}
+	}
+
+	return wsMsgMessage{
+		Id:             message.ID,
+		ConversationId: message.ConversationID,
+		SenderId:       message.UserID,
+		Body:           message.Body,
+		CreatedAt:      message.CreatedAt,
+		EditedAt:       message.EditedAt,
+		DeletedAt:      message.DeletedAt,
+		ReplyToId:      message.ReplyToID,
+		ReplyTo:        replyTo,
+		Attachments:    attachments,
+	}
+}
+
+func newWsMsgConversation(conversation *models.Conversation) wsMsgConversation {
+	conversationType := "direct"
+	if conversation.IsGroup {
+		conversationType = "group"
+	}
+
+	participants := []wsMsgUser{}
+	for _, user := range conversation.Users {
+		participants = append(participants, wsMsgUser{
+			Id:       user.ID,
+			Username: user.Username,
+			Name:     user.Name,
+		})
+	}
+
+	return wsMsgConversation{
+		Id:           conversation.ID,
+		Type:         conversationType,
+		Title:        conversation.Title,
+		CreatedAt:    conversation.CreatedAt,
+		Participants: participants,
+	}
+}
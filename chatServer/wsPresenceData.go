@@ -0,0 +1,9 @@
+package chatServer
+
+import "time"
+
+type wsPresenceData struct {
+	UserId   int        `json:"userId"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen"`
+}
@@ -0,0 +1,16 @@
+package chatServer
+
+import "time"
+
+type wsReactionRequestData struct {
+	MessageId int    `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+type wsReactionData struct {
+	MessageId      int        `json:"messageId"`
+	ConversationId int        `json:"conversationId"`
+	UserId         int        `json:"userId"`
+	Emoji          string     `json:"emoji"`
+	CreatedAt      *time.Time `json:"created,omitempty"`
+}
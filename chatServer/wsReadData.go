@@ -0,0 +1,15 @@
+package chatServer
+
+import "time"
+
+type wsReadRequestData struct {
+	ConversationId int `json:"conversationId"`
+	MessageId      int `json:"messageId"`
+}
+
+type wsReadData struct {
+	ConversationId    int       `json:"conversationId"`
+	UserId            int       `json:"userId"`
+	LastReadMessageId int       `json:"lastReadMessageId"`
+	ReadAt            time.Time `json:"readAt"`
+}
@@ -0,0 +1,11 @@
+package chatServer
+
+type wsTypingRequestData struct {
+	ConversationId int `json:"conversationId"`
+}
+
+type wsTypingData struct {
+	ConversationId int  `json:"conversationId"`
+	UserId         int  `json:"userId"`
+	IsTyping       bool `json:"isTyping"`
+}
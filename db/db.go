@@ -31,6 +31,15 @@ func InitDb(connectionStr string) {
 	utils.Check(err)
 }
 
+// CloseDb closes the connection pool once in-flight queries have finished.
+func CloseDb() error {
+	sqlDb, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.Close()
+}
+
 func InitDbStruct(pi PsqlInfo) {
 	connectionStr := fmt.Sprintf("host=%s port=%d user=%s password=%s "+
 		"dbname=%s sslmode=disable",
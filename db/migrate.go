@@ -0,0 +1,287 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migrations are SQL files in the migrations directory named
+// NNNN_name.up.sql and NNNN_name.down.sql, applied in order of NNNN. They are
+// embedded in the binary, and the applied versions are recorded in the
+// schema_migrations table.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLockID is the key of the Postgres advisory lock held while
+// migrating, so that instances starting at the same time take turns.
+const migrationLockID = 4328701
+
+var ErrInvalidMigration = errors.New("Invalid migration file.")
+var ErrUnknownMigration = errors.New("Database has a migration that isn't embedded in this binary.")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes a migration and whether it has been applied.
+// AppliedAt is nil for pending migrations.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// GetMigrations returns the embedded migrations, oldest first.
+func GetMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrationsByVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMigration, entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		name, direction := match[2], match[3]
+
+		contents, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := migrationsByVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			migrationsByVersion[version] = migration
+		} else if migration.Name != name {
+			return nil, fmt.Errorf("%w: version %d has two names", ErrInvalidMigration, version)
+		}
+		if direction == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, migration := range migrationsByVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("%w: %04d_%s needs both up and down files",
+				ErrInvalidMigration, migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// MigrateUp applies every pending migration and returns the ones applied.
+func MigrateUp() ([]Migration, error) {
+	migrations, err := GetMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	err = withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		appliedAt, err := getAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if _, ok := appliedAt[migration.Version]; ok {
+				continue
+			}
+			err := runMigration(ctx, conn, migration, migration.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+				migration.Version, migration.Name)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown rolls back the most recently applied migrations, up to steps of
+// them, and returns the ones rolled back.
+func MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := GetMigrations()
+	if err != nil {
+		return nil, err
+	}
+	migrationsByVersion := map[int]Migration{}
+	for _, migration := range migrations {
+		migrationsByVersion[migration.Version] = migration
+	}
+
+	rolledBack := []Migration{}
+	err = withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		appliedAt, err := getAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		versions := []int{}
+		for version := range appliedAt {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		if len(versions) > steps {
+			versions = versions[:steps]
+		}
+
+		for _, version := range versions {
+			migration, ok := migrationsByVersion[version]
+			if !ok {
+				return fmt.Errorf("%w: version %d", ErrUnknownMigration, version)
+			}
+			err := runMigration(ctx, conn, migration, migration.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+			if err != nil {
+				return err
+			}
+			rolledBack = append(rolledBack, migration)
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// GetMigrationStatus lists every embedded migration, and any applied
+// migration that isn't embedded, oldest first.
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := GetMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	err = withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		appliedAt, err := getAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if applied, ok := appliedAt[migration.Version]; ok {
+				status.AppliedAt = &applied.AppliedAt
+				delete(appliedAt, migration.Version)
+			}
+			statuses = append(statuses, status)
+		}
+		for version, applied := range appliedAt {
+			appliedAt := applied.AppliedAt
+			statuses = append(statuses, MigrationStatus{Version: version, Name: applied.Name, AppliedAt: &appliedAt})
+		}
+		return nil
+	})
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, err
+}
+
+// withMigrationLock runs f on a single connection while holding the
+// migration lock. Advisory locks belong to a connection, so the whole
+// migration must use the same one.
+func withMigrationLock(f func(ctx context.Context, conn *sql.Conn) error) error {
+	sqlDb, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := sqlDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	return f(ctx, conn)
+}
+
+type appliedMigration struct {
+	Name      string
+	AppliedAt time.Time
+}
+
+func getAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var version int
+		var migration appliedMigration
+		err := rows.Scan(&version, &migration.Name, &migration.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = migration
+	}
+	return applied, rows.Err()
+}
+
+// runMigration runs a migration's SQL and records the change to
+// schema_migrations in one transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, migration Migration, migrationSql string,
+	recordSql string, recordArgs ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, migrationSql)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, recordSql, recordArgs...)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("Error running migration %04d_%s: %w", migration.Version, migration.Name, err)
+	}
+	return nil
+}
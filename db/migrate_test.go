@@ -0,0 +1,119 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The models as they were when AutoMigrate created the schema, before
+// migrations replaced it.
+type baselineUser struct {
+	ID            int                    `gorm:"primaryKey,not null"`
+	Username      string                 `gorm:"not null"`
+	Password      string                 `gorm:"not null"`
+	Name          string                 `gorm:"not null"`
+	Conversations []baselineConversation `gorm:"many2many:conversation_users;joinForeignKey:UserID;joinReferences:ConversationID"`
+	Messages      []baselineMessage      `gorm:"foreignKey:UserID"`
+	CreatedAt     time.Time              `gorm:"not null"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineSession struct {
+	ID        int    `gorm:"primaryKey"`
+	Key       string `gorm:"not null"`
+	User      baselineUser
+	UserID    int       `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+func (baselineSession) TableName() string { return "sessions" }
+
+type baselineConversation struct {
+	ID        int               `gorm:"primaryKey,not null"`
+	Users     []baselineUser    `gorm:"many2many:conversation_users;joinForeignKey:ConversationID;joinReferences:UserID"`
+	Messages  []baselineMessage `gorm:"foreignKey:ConversationID"`
+	CreatedAt time.Time         `gorm:"not null"`
+}
+
+func (baselineConversation) TableName() string { return "conversations" }
+
+type baselineMessage struct {
+	ID             int       `gorm:"primaryKey,not null"`
+	UserID         int       `gorm:"not null"`
+	ConversationID int       `gorm:"not null"`
+	Body           string    `gorm:"not null"`
+	CreatedAt      time.Time `gorm:"not null"`
+}
+
+func (baselineMessage) TableName() string { return "messages" }
+
+// withSearchPath returns the connection string with the schema search path
+// set, for both URL and key=value connection strings.
+func withSearchPath(connectionStr string, schema string) string {
+	if !strings.Contains(connectionStr, "://") {
+		return connectionStr + " search_path=" + schema
+	} else if strings.Contains(connectionStr, "?") {
+		return connectionStr + "&search_path=" + schema
+	}
+	return connectionStr + "?search_path=" + schema
+}
+
+func TestMigrateUpFromAutoMigrate(t *testing.T) {
+	databaseUrl := os.Getenv("TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("TEST_DATABASE_URL is not set.")
+	}
+
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	InitDb(databaseUrl)
+	err := db.Exec("CREATE SCHEMA " + schema).Error
+	CloseDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	InitDb(withSearchPath(databaseUrl, schema))
+	defer CloseDb()
+	defer db.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	err = db.AutoMigrate(&baselineSession{}, &baselineConversation{}, &baselineMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`INSERT INTO users (username, password, name, created_at)
+		VALUES ('alice', 'password', 'Alice', now()), ('alice', 'password', 'Alice', now())`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var aliceCount int64
+	err = db.Table("users").Where("username = ?", "alice").Count(&aliceCount).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceCount != 1 {
+		t.Errorf("got %d users named alice, want 1", aliceCount)
+	}
+
+	err = db.Exec(`INSERT INTO users (username, password, name, created_at)
+		VALUES ('alice', 'password', 'Alice', now())`).Error
+	if err == nil {
+		t.Error("created a second user named alice")
+	}
+
+	var searchable int64
+	err = db.Table("messages").Where("search_vector @@ plainto_tsquery('english', ?)", "hello").
+		Where("reply_to_id IS NULL").Count(&searchable).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
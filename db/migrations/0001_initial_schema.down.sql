@@ -0,0 +1,15 @@
+-- The pg_trgm extension is left installed, since other database objects may
+-- depend on it.
+
+DROP TABLE IF EXISTS broker_payloads;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS reactions;
+DROP TABLE IF EXISTS attachments;
+DROP TABLE IF EXISTS user_events;
+DROP TABLE IF EXISTS read_markers;
+DROP TABLE IF EXISTS message_revisions;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS conversation_users;
+DROP TABLE IF EXISTS conversations;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,150 @@
+-- The schema as it was created by AutoMigrate. The tables AutoMigrate
+-- created (users, sessions, conversations, conversation_users and messages)
+-- are only created if they don't exist, with the columns they had then, and
+-- the columns added since are added afterwards if they're missing. That way
+-- databases that were set up by AutoMigrate end up with the same schema as
+-- new ones.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE TABLE IF NOT EXISTS users (
+	id bigserial PRIMARY KEY,
+	username text NOT NULL,
+	password text NOT NULL,
+	name text NOT NULL,
+	created_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id bigserial PRIMARY KEY,
+	key text NOT NULL,
+	user_id bigint NOT NULL,
+	created_at timestamptz NOT NULL,
+	CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS conversations (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS conversation_users (
+	conversation_id bigint,
+	user_id bigint,
+	PRIMARY KEY (conversation_id, user_id),
+	CONSTRAINT fk_conversation_users_conversation FOREIGN KEY (conversation_id) REFERENCES conversations (id),
+	CONSTRAINT fk_conversation_users_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	conversation_id bigint NOT NULL,
+	body text NOT NULL,
+	created_at timestamptz NOT NULL,
+	CONSTRAINT fk_users_messages FOREIGN KEY (user_id) REFERENCES users (id),
+	CONSTRAINT fk_conversations_messages FOREIGN KEY (conversation_id) REFERENCES conversations (id)
+);
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS last_seen_at timestamptz,
+	ADD COLUMN IF NOT EXISTS event_seq bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS discoverable boolean NOT NULL DEFAULT true;
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING GIN (username gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING GIN (lower(name) gin_trgm_ops);
+
+ALTER TABLE sessions
+	ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS ip_address text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS accessed_at timestamptz NOT NULL DEFAULT now();
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_key ON sessions (key);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+ALTER TABLE conversations
+	ADD COLUMN IF NOT EXISTS title text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS is_group boolean NOT NULL DEFAULT false,
+	ADD COLUMN IF NOT EXISTS creator_id bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE messages
+	ADD COLUMN IF NOT EXISTS edited_at timestamptz,
+	ADD COLUMN IF NOT EXISTS deleted_at timestamptz,
+	ADD COLUMN IF NOT EXISTS reply_to_id bigint
+		CONSTRAINT fk_messages_reply_to REFERENCES messages (id),
+	ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('english', body)) STORED;
+CREATE INDEX IF NOT EXISTS idx_messages_history ON messages (conversation_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to_id ON messages (reply_to_id);
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search_vector);
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+	id bigserial PRIMARY KEY,
+	message_id bigint NOT NULL,
+	body text NOT NULL,
+	created_at timestamptz NOT NULL,
+	CONSTRAINT fk_messages_revisions FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message_id ON message_revisions (message_id);
+
+CREATE TABLE IF NOT EXISTS read_markers (
+	user_id bigint,
+	conversation_id bigint,
+	last_read_message_id bigint NOT NULL,
+	updated_at timestamptz NOT NULL,
+	PRIMARY KEY (user_id, conversation_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_events (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	seq bigint NOT NULL,
+	method text NOT NULL,
+	data jsonb NOT NULL,
+	created_at timestamptz NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_events_seq ON user_events (user_id, seq);
+CREATE INDEX IF NOT EXISTS idx_user_events_created_at ON user_events (created_at);
+
+CREATE TABLE IF NOT EXISTS attachments (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	message_id bigint,
+	key text NOT NULL,
+	thumbnail_key text NOT NULL DEFAULT '',
+	filename text NOT NULL,
+	content_type text NOT NULL,
+	size bigint NOT NULL,
+	width bigint NOT NULL DEFAULT 0,
+	height bigint NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL,
+	CONSTRAINT fk_messages_attachments FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_user_id ON attachments (user_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id);
+
+CREATE TABLE IF NOT EXISTS reactions (
+	message_id bigint,
+	user_id bigint,
+	emoji text,
+	created_at timestamptz NOT NULL,
+	PRIMARY KEY (message_id, user_id, emoji)
+);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id bigserial PRIMARY KEY,
+	username text NOT NULL,
+	user_id bigint,
+	ip_address text NOT NULL DEFAULT '',
+	user_agent text NOT NULL DEFAULT '',
+	success boolean NOT NULL,
+	created_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_username ON login_attempts (username, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip_address ON login_attempts (ip_address, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_user_id ON login_attempts (user_id);
+
+CREATE TABLE IF NOT EXISTS broker_payloads (
+	id bigserial PRIMARY KEY,
+	payload bytea NOT NULL,
+	created_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_broker_payloads_created_at ON broker_payloads (created_at);
@@ -0,0 +1,7 @@
+-- Conversations merged by the up migration are not split apart again.
+
+DROP INDEX IF EXISTS idx_conversations_direct;
+
+ALTER TABLE conversations
+	DROP COLUMN IF EXISTS low_user_id,
+	DROP COLUMN IF EXISTS high_user_id;
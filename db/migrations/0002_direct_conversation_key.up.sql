@@ -0,0 +1,57 @@
+-- Direct conversations are keyed by their two members, lowest ID first, so
+-- that concurrent first messages can't create two conversations between the
+-- same users. Any duplicates that already exist are merged into the oldest.
+
+ALTER TABLE conversations
+	ADD COLUMN low_user_id bigint,
+	ADD COLUMN high_user_id bigint;
+
+CREATE TEMPORARY TABLE direct_conversations ON COMMIT DROP AS
+SELECT conversation_id, low_user_id, high_user_id,
+	MIN(conversation_id) OVER (PARTITION BY low_user_id, high_user_id) AS canonical_id
+FROM (
+	SELECT conversation_users.conversation_id,
+		MIN(conversation_users.user_id) AS low_user_id,
+		MAX(conversation_users.user_id) AS high_user_id
+	FROM conversation_users
+	JOIN conversations ON conversations.id = conversation_users.conversation_id
+	WHERE NOT conversations.is_group
+	GROUP BY conversation_users.conversation_id
+	HAVING COUNT(*) = 2
+) AS pairs;
+
+UPDATE messages SET conversation_id = direct_conversations.canonical_id
+FROM direct_conversations
+WHERE messages.conversation_id = direct_conversations.conversation_id
+	AND direct_conversations.conversation_id <> direct_conversations.canonical_id;
+
+INSERT INTO read_markers (user_id, conversation_id, last_read_message_id, updated_at)
+SELECT read_markers.user_id, direct_conversations.canonical_id,
+	MAX(read_markers.last_read_message_id), MAX(read_markers.updated_at)
+FROM read_markers
+JOIN direct_conversations ON direct_conversations.conversation_id = read_markers.conversation_id
+WHERE direct_conversations.conversation_id <> direct_conversations.canonical_id
+GROUP BY read_markers.user_id, direct_conversations.canonical_id
+ON CONFLICT (user_id, conversation_id) DO UPDATE SET
+	last_read_message_id = GREATEST(read_markers.last_read_message_id, EXCLUDED.last_read_message_id),
+	updated_at = GREATEST(read_markers.updated_at, EXCLUDED.updated_at);
+
+DELETE FROM read_markers USING direct_conversations
+WHERE read_markers.conversation_id = direct_conversations.conversation_id
+	AND direct_conversations.conversation_id <> direct_conversations.canonical_id;
+
+DELETE FROM conversation_users USING direct_conversations
+WHERE conversation_users.conversation_id = direct_conversations.conversation_id
+	AND direct_conversations.conversation_id <> direct_conversations.canonical_id;
+
+DELETE FROM conversations USING direct_conversations
+WHERE conversations.id = direct_conversations.conversation_id
+	AND direct_conversations.conversation_id <> direct_conversations.canonical_id;
+
+UPDATE conversations SET
+	low_user_id = direct_conversations.low_user_id,
+	high_user_id = direct_conversations.high_user_id
+FROM direct_conversations
+WHERE conversations.id = direct_conversations.conversation_id;
+
+CREATE UNIQUE INDEX idx_conversations_direct ON conversations (low_user_id, high_user_id);
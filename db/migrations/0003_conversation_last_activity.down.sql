@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_conversations_last_activity;
+
+ALTER TABLE conversations
+	DROP CONSTRAINT IF EXISTS fk_conversations_last_message,
+	DROP COLUMN IF EXISTS last_message_id,
+	DROP COLUMN IF EXISTS last_activity_at;
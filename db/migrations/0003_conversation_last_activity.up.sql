@@ -0,0 +1,24 @@
+-- Each conversation keeps its most recent message and when it was last
+-- active, so that conversation lists can be paginated without scanning
+-- messages.
+
+ALTER TABLE conversations
+	ADD COLUMN last_message_id bigint,
+	ADD COLUMN last_activity_at timestamptz NOT NULL DEFAULT now();
+
+UPDATE conversations SET last_activity_at = created_at;
+
+UPDATE conversations SET
+	last_message_id = latest.id,
+	last_activity_at = latest.created_at
+FROM (
+	SELECT DISTINCT ON (conversation_id) id, conversation_id, created_at
+	FROM messages
+	ORDER BY conversation_id, created_at DESC, id DESC
+) AS latest
+WHERE conversations.id = latest.conversation_id;
+
+ALTER TABLE conversations ADD CONSTRAINT fk_conversations_last_message
+	FOREIGN KEY (last_message_id) REFERENCES messages (id);
+
+CREATE INDEX idx_conversations_last_activity ON conversations (last_activity_at DESC, id DESC);
@@ -0,0 +1,29 @@
+-- Webhooks are sent the events they subscribe to. Each event is queued as a
+-- delivery, which is retried until it succeeds or runs out of attempts.
+
+CREATE TABLE webhooks (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	url text NOT NULL,
+	secret text NOT NULL,
+	events text[] NOT NULL,
+	created_at timestamptz NOT NULL
+);
+CREATE INDEX idx_webhooks_user_id ON webhooks (user_id);
+
+CREATE TABLE webhook_deliveries (
+	id bigserial PRIMARY KEY,
+	webhook_id bigint NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+	event text NOT NULL,
+	payload text NOT NULL,
+	status text NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamptz NOT NULL,
+	last_attempt_at timestamptz,
+	response_status integer NOT NULL DEFAULT 0,
+	last_error text NOT NULL DEFAULT '',
+	created_at timestamptz NOT NULL
+);
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, created_at DESC);
+CREATE INDEX idx_webhook_deliveries_pending ON webhook_deliveries (next_attempt_at)
+	WHERE status = 'pending';
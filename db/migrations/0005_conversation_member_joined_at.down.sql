@@ -0,0 +1 @@
+ALTER TABLE conversation_users DROP COLUMN IF EXISTS joined_at;
@@ -0,0 +1,5 @@
+-- Members are ordered by when they joined, so that the longest-standing
+-- member can take over a group when its creator leaves. Existing members are
+-- ordered by user ID.
+
+ALTER TABLE conversation_users ADD COLUMN joined_at timestamptz NOT NULL DEFAULT now();
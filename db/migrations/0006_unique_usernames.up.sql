@@ -0,0 +1,11 @@
+-- Usernames are unique, so that two signups racing for the same username
+-- can't both succeed. Any duplicates that already exist keep the username on
+-- the oldest account, and the others are renamed to username_id.
+
+UPDATE users SET username = users.username || '_' || users.id
+FROM (
+	SELECT username, MIN(id) AS id FROM users GROUP BY username HAVING COUNT(*) > 1
+) AS oldest
+WHERE users.username = oldest.username AND users.id <> oldest.id;
+
+CREATE UNIQUE INDEX idx_users_username ON users (username);
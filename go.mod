@@ -1,7 +1,7 @@
 module github.com/nrmilstein/nchat
 
-// +heroku goVersion go1.15
-go 1.14
+// +heroku goVersion go1.16
+go 1.16
 
 require (
 	github.com/gin-contrib/static v0.0.0-20200916080430-d45d9a37d28e
@@ -10,6 +10,7 @@ require (
 	github.com/heroku/x v0.0.24
 	github.com/lib/pq v1.7.0
 	github.com/unrolled/secure v1.0.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gorm.io/driver/postgres v1.0.6
 	gorm.io/gorm v1.20.9
 	nhooyr.io/websocket v1.8.6
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/nrmilstein/nchat/db"
+)
+
+// runMigrateCommand handles "nchat migrate up|down [steps]|status".
+func runMigrateCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: nchat migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp()
+		printMigrations("Applied", applied)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date.")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				log.Fatalf("Error: invalid number of steps %q.", args[1])
+			}
+		}
+		rolledBack, err := db.MigrateDown(steps)
+		printMigrations("Rolled back", rolledBack)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(rolledBack) == 0 {
+			fmt.Println("No migrations to roll back.")
+		}
+	case "status":
+		statuses, err := db.GetMigrationStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d_%-40s %s\n", status.Version, status.Name, appliedAt)
+		}
+	default:
+		log.Fatalf("Error: unknown migrate command %q.", args[0])
+	}
+}
+
+func printMigrations(verb string, migrations []db.Migration) {
+	for _, migration := range migrations {
+		fmt.Printf("%s %04d_%s\n", verb, migration.Version, migration.Name)
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/heroku/x/hmetrics/onload"
@@ -11,9 +19,12 @@ import (
 	"github.com/nrmilstein/nchat/app/controllers"
 	"github.com/nrmilstein/nchat/app/middlewares"
 	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
 	"github.com/nrmilstein/nchat/chatServer"
 	"github.com/nrmilstein/nchat/db"
+	"github.com/nrmilstein/nchat/storage"
 	"github.com/nrmilstein/nchat/utils"
+	"github.com/nrmilstein/nchat/webhooks"
 )
 
 func main() {
@@ -24,41 +35,177 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// STORE selects where data is kept: "postgres" (the default), or "memory"
+	// to run a single instance without a database. Nothing kept in memory
+	// survives a restart, although attachment files stay in the blob store.
+	storeDriver := os.Getenv("STORE")
+	switch storeDriver {
+	case "", "postgres", "memory":
+	default:
+		log.Fatalf("Error: unknown STORE %q.", storeDriver)
+	}
+	isMigrateCommand := len(os.Args) > 1 && os.Args[1] == "migrate"
+	usePostgres := storeDriver != "memory" || isMigrateCommand
+
 	databaseUrl := os.Getenv("DATABASE_URL")
-	if databaseUrl == "" {
-		log.Fatal("Error: no environment variale DATABASE_URL found.")
+	if usePostgres {
+		if databaseUrl == "" {
+			log.Fatal("Error: no environment variale DATABASE_URL found.")
+		}
+		db.InitDb(databaseUrl)
+	}
+
+	if isMigrateCommand {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
+	if sessionTTL := os.Getenv("SESSION_TTL"); sessionTTL != "" {
+		models.SessionTTL = parseDurationEnv("SESSION_TTL", sessionTTL)
+	}
+	if sessionIdleTTL := os.Getenv("SESSION_IDLE_TTL"); sessionIdleTTL != "" {
+		models.SessionIdleTTL = parseDurationEnv("SESSION_IDLE_TTL", sessionIdleTTL)
+	}
+
+	var stores *repositories.Stores
+	if usePostgres {
+		applied, err := db.MigrateUp()
+		utils.Check(err)
+		for _, migration := range applied {
+			log.Printf("Applied migration %04d_%s.", migration.Version, migration.Name)
+		}
+		stores = repositories.NewPostgresStores()
+	} else {
+		stores = repositories.NewMemoryStores()
+	}
+
+	if webhookAdmins := os.Getenv("WEBHOOK_ADMINS"); webhookAdmins != "" {
+		for _, username := range strings.Split(webhookAdmins, ",") {
+			models.WebhookAdminUsernames = append(models.WebhookAdminUsernames,
+				strings.ToLower(strings.TrimSpace(username)))
+		}
 	}
-	db.InitDb(databaseUrl)
 
-	err := db.GetDb().AutoMigrate(
-		&models.Session{},
-		&models.Conversation{},
-		&models.Message{},
-		&models.User{},
-	)
-	utils.Check(err)
+	initBlobStore()
+	if maxAttachmentSize := os.Getenv("ATTACHMENT_MAX_BYTES"); maxAttachmentSize != "" {
+		size, err := strconv.ParseInt(maxAttachmentSize, 10, 64)
+		if err != nil {
+			log.Fatalf("Error: invalid integer in environment variable ATTACHMENT_MAX_BYTES: %v", err)
+		}
+		models.MaxAttachmentSize = size
+	}
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			err := stores.Events.PruneUserEvents()
+			if err != nil {
+				log.Println(err)
+			}
+			err = stores.Attachments.PruneUnattachedAttachments(context.Background())
+			if err != nil {
+				log.Println(err)
+			}
+			err = stores.LoginAttempts.PruneLoginAttempts()
+			if err != nil {
+				log.Println(err)
+			}
+			err = stores.Webhooks.PruneWebhookDeliveries()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	// Heroku's router is the only proxy in front of the app, so behind it the
+	// client is the last hop it appends to X-Forwarded-For. Gin's ClientIP
+	// trusts the first, which clients control.
+	utils.TrustProxy = dynoEnv != ""
 
 	router := gin.New()
+	router.ForwardedByClientIP = false
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
 	allowedHosts := []string{"nchat-app.herokuapp.com"}
 	router.Use(middlewares.Secure(allowedHosts, gin.IsDebugging()))
 
-	chatServerHub := chatServer.NewHub()
+	if sendQueueSize := os.Getenv("SEND_QUEUE_SIZE"); sendQueueSize != "" {
+		size, err := strconv.Atoi(sendQueueSize)
+		if err != nil || size <= 0 {
+			log.Fatalf("Error: invalid size in environment variable SEND_QUEUE_SIZE: %q", sendQueueSize)
+		}
+		chatServer.SendQueueSize = size
+	}
+	switch sendQueuePolicy := os.Getenv("SEND_QUEUE_POLICY"); sendQueuePolicy {
+	case "", "disconnect":
+		chatServer.SendQueuePolicy = chatServer.OverflowDisconnect
+	case "resync":
+		chatServer.SendQueuePolicy = chatServer.OverflowResync
+	default:
+		log.Fatalf("Error: unknown SEND_QUEUE_POLICY %q.", sendQueuePolicy)
+	}
+
+	if wsRateLimits := os.Getenv("WS_RATE_LIMITS"); wsRateLimits != "" {
+		for _, methodLimit := range strings.Split(wsRateLimits, ",") {
+			parts := strings.SplitN(strings.TrimSpace(methodLimit), "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Error: invalid method limit in environment variable WS_RATE_LIMITS: %q", methodLimit)
+			}
+			chatServer.WsMethodLimits[parts[0]] = parseRateLimitEnv("WS_RATE_LIMITS", parts[1])
+		}
+	}
+	authLimiter := utils.NewRateLimiter(rateLimitEnv("RATE_LIMIT_AUTH", "10/1m"))
+	signupLimiter := utils.NewRateLimiter(rateLimitEnv("RATE_LIMIT_SIGNUP", "10/1h"))
+	apiLimiter := utils.NewRateLimiter(rateLimitEnv("RATE_LIMIT_API", "300/1m"))
+
+	broker := newBroker(databaseUrl, usePostgres)
+	chatServerHub := chatServer.NewHub(broker, stores)
+	controller := controllers.NewController(stores, chatServerHub)
+	webhookDispatcher := webhooks.NewDispatcher(stores.Webhooks)
+
+	expvar.Publish("chatSendQueues", expvar.Func(func() interface{} {
+		return chatServerHub.QueueMetrics()
+	}))
+	if os.Getenv("METRICS_ENABLED") == "true" {
+		router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	}
 
 	api := router.Group("/api/v1")
 	{
 		api.Use(middlewares.JSONContentType())
 		api.Use(middlewares.ErrorHandler())
-		api.POST("/users", controllers.PostUsers)
-		api.POST("/demoUsers", controllers.PostDemoUsers)
-		api.GET("/users/:username", controllers.GetUser)
-		api.POST("/authenticate", controllers.PostAuthenticate)
-		api.GET("/authenticate", controllers.GetAuthenticate)
-		api.GET("/conversations", controllers.GetConversations)
-		api.GET("/conversations/:id", controllers.GetConversation)
-		api.GET("/chat", controllers.GetChat(chatServerHub))
+		api.Use(middlewares.RateLimitByUser(apiLimiter, stores.Sessions))
+		api.POST("/users", middlewares.RateLimitByIP(signupLimiter), controller.PostUsers)
+		api.POST("/demoUsers", middlewares.RateLimitByIP(signupLimiter), controller.PostDemoUsers)
+		api.GET("/users", controller.GetUsers)
+		api.GET("/users/:username", controller.GetUser)
+		api.PATCH("/users/:username", controller.PatchUser)
+		api.POST("/authenticate", middlewares.RateLimitByIP(authLimiter), controller.PostAuthenticate)
+		api.GET("/authenticate", controller.GetAuthenticate)
+		api.DELETE("/authenticate", controller.DeleteAuthenticate)
+		api.GET("/sessions", controller.GetSessions)
+		api.GET("/loginAttempts", controller.GetLoginAttempts)
+		api.DELETE("/sessions", controller.DeleteSessions)
+		api.DELETE("/sessions/:id", controller.DeleteSession)
+		api.GET("/conversations", controller.GetConversations)
+		api.POST("/conversations", controller.PostConversations)
+		api.GET("/conversations/:id", controller.GetConversation)
+		api.POST("/conversations/:id/members", controller.PostConversationMembers)
+		api.DELETE("/conversations/:id/members/:username", controller.DeleteConversationMember)
+		api.PATCH("/messages/:id", controller.PatchMessage)
+		api.DELETE("/messages/:id", controller.DeleteMessage)
+		api.GET("/messages/:id/revisions", controller.GetMessageRevisions)
+		api.GET("/messages/:id/thread", controller.GetMessageThread)
+		api.GET("/search", controller.GetSearch)
+		api.POST("/attachments", controller.PostAttachments)
+		api.GET("/attachments/:id", controller.GetAttachment)
+		api.GET("/attachments/:id/thumbnail", controller.GetAttachmentThumbnail)
+		api.POST("/webhooks", controller.PostWebhooks)
+		api.GET("/webhooks", controller.GetWebhooks)
+		api.DELETE("/webhooks/:id", controller.DeleteWebhook)
+		api.GET("/webhooks/:id/deliveries", controller.GetWebhookDeliveries)
+		api.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", controller.PostWebhookRedelivery)
+		api.GET("/chat", controller.GetChat)
 	}
 
 	router.Use(static.Serve("/", static.LocalFile("./nchat-web", true)))
@@ -71,5 +218,129 @@ func main() {
 	if port == "" {
 		port = "5000"
 	}
-	router.Run(":" + port)
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("shutting down")
+
+	// Heroku kills a dyno 30 seconds after sending SIGTERM.
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	err := chatServerHub.Shutdown(ctx)
+	if err != nil {
+		log.Println("Error: not every chat client disconnected:", err)
+	}
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Println("Error: not every request finished:", err)
+	}
+	err = webhookDispatcher.Close(ctx)
+	if err != nil {
+		log.Println("Error: not every webhook delivery finished:", err)
+	}
+	err = broker.Close()
+	if err != nil {
+		log.Println(err)
+	}
+	if usePostgres {
+		err = db.CloseDb()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func parseDurationEnv(name string, value string) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Error: invalid duration in environment variable %s: %v", name, err)
+	}
+	return duration
+}
+
+// rateLimitEnv reads a rate limit like "10/1m" from the environment, or uses
+// defaultValue if it isn't set.
+func rateLimitEnv(name string, defaultValue string) utils.RateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		value = defaultValue
+	}
+	return parseRateLimitEnv(name, value)
+}
+
+func parseRateLimitEnv(name string, value string) utils.RateLimit {
+	limit, err := utils.ParseRateLimit(value)
+	if err != nil {
+		log.Fatalf("Error: invalid rate limit in environment variable %s: %v", name, err)
+	}
+	return limit
+}
+
+// initBlobStore configures where attachments are stored. BLOB_STORE selects
+// the driver: "local" (the default) stores files under BLOB_STORE_DIR, and
+// "s3" uses an S3-compatible object store.
+func initBlobStore() {
+	switch blobStore := os.Getenv("BLOB_STORE"); blobStore {
+	case "", "local":
+		dir := os.Getenv("BLOB_STORE_DIR")
+		if dir == "" {
+			dir = "./blobs"
+		}
+		localStore, err := storage.NewLocalStore(dir)
+		utils.Check(err)
+		storage.InitStore(localStore)
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		s3Store, err := storage.NewS3Store(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_BUCKET"),
+			region,
+			os.Getenv("S3_ACCESS_KEY_ID"),
+			os.Getenv("S3_SECRET_ACCESS_KEY"),
+		)
+		if err != nil {
+			log.Fatalf("Error: invalid S3 configuration: %v", err)
+		}
+		storage.InitStore(s3Store)
+	default:
+		log.Fatalf("Error: unknown BLOB_STORE %q.", blobStore)
+	}
+}
+
+// newBroker returns the backplane that connects the chat hubs of every
+// instance. BROKER selects the driver: "memory" (the default) for a single
+// instance, or "postgres" to use LISTEN/NOTIFY on the application database.
+func newBroker(databaseUrl string, usePostgres bool) chatServer.Broker {
+	switch broker := os.Getenv("BROKER"); broker {
+	case "", "memory":
+		return chatServer.NewMemoryBroker()
+	case "postgres":
+		if !usePostgres {
+			log.Fatal("Error: BROKER=postgres needs STORE=postgres.")
+		}
+		postgresBroker, err := chatServer.NewPostgresBroker(databaseUrl, db.GetDb())
+		if err != nil {
+			log.Fatalf("Error: could not start Postgres broker: %v", err)
+		}
+		return postgresBroker
+	default:
+		log.Fatalf("Error: unknown BROKER %q.", broker)
+		return nil
+	}
 }
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrBlobNotFound = errors.New("Blob not found.")
+
+// BlobStore stores opaque blobs under string keys.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var store BlobStore
+
+func GetStore() BlobStore {
+	return store
+}
+
+func InitStore(blobStore BlobStore) {
+	store = blobStore
+}
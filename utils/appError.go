@@ -2,6 +2,7 @@ package utils
 
 var ErrForbidden = AppError{"Forbidden", -403, nil}
 var ErrInternalServer = AppError{"Internal server error", -500, nil}
+var ErrTooManyRequests = AppError{"Too many requests", -429, nil}
 
 type AppError struct {
 	Message string
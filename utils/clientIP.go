@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrustProxy is whether requests arrive through a proxy, like the Heroku
+// router, that appends the address it received the request from to
+// X-Forwarded-For.
+var TrustProxy = false
+
+// ClientIP returns the address of the client that made the request. Only the
+// right-most X-Forwarded-For entry, the one appended by the trusted proxy, is
+// used: clients can put anything they like to the left of it.
+func ClientIP(c *gin.Context) string {
+	if TrustProxy {
+		forwardedFor := c.Request.Header.Values("X-Forwarded-For")
+		if len(forwardedFor) > 0 {
+			hops := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+			hop := strings.TrimSpace(hops[len(hops)-1])
+			if net.ParseIP(hop) != nil {
+				return hop
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
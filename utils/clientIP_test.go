@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(trustProxy bool) { TrustProxy = trustProxy }(TrustProxy)
+
+	tests := []struct {
+		trustProxy   bool
+		forwardedFor []string
+		want         string
+	}{
+		{false, nil, "10.0.0.1"},
+		{false, []string{"1.2.3.4"}, "10.0.0.1"},
+		{true, nil, "10.0.0.1"},
+		{true, []string{"1.2.3.4"}, "1.2.3.4"},
+		{true, []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{true, []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{true, []string{"6.6.6.6, garbage"}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		TrustProxy = test.trustProxy
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.RemoteAddr = "10.0.0.1:5000"
+		for _, value := range test.forwardedFor {
+			c.Request.Header.Add("X-Forwarded-For", value)
+		}
+
+		got := ClientIP(c)
+		if got != test.want {
+			t.Errorf("ClientIP with TrustProxy %v and X-Forwarded-For %q = %q, want %q",
+				test.trustProxy, test.forwardedFor, got, test.want)
+		}
+	}
+}
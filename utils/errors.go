@@ -15,6 +15,10 @@ func AbortErrForbidden(c *gin.Context) {
 	c.AbortWithError(http.StatusForbidden, ErrForbidden)
 }
 
+func AbortErrTooManyRequests(c *gin.Context) {
+	c.AbortWithError(http.StatusTooManyRequests, ErrTooManyRequests)
+}
+
 //type FailResponse struct {
 //HttpStatus int
 //Data interface{}
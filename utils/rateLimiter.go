@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidRateLimit = errors.New("Rate limit must be of the form <count>/<duration>, like 10/1m.")
+
+// RateLimit allows Burst events at once, refilling at Rate events per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses a limit like "10/1m", which allows 10 events per
+// minute, all of which may happen at once.
+func ParseRateLimit(value string) (RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, ErrInvalidRateLimit
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return RateLimit{}, ErrInvalidRateLimit
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return RateLimit{}, ErrInvalidRateLimit
+	}
+	return RateLimit{Rate: float64(count) / period.Seconds(), Burst: count}, nil
+}
+
+func (limit RateLimit) NewTokenBucket() *TokenBucket {
+	return NewTokenBucket(limit.Rate, limit.Burst)
+}
+
+// rateLimiterSweepInterval is how often buckets that have refilled completely
+// are discarded, since they behave the same as new ones.
+const rateLimiterSweepInterval = time.Minute
+
+// RateLimiter keeps a separate token bucket for each key, such as an IP
+// address or user ID.
+type RateLimiter struct {
+	limit     RateLimit
+	mutex     sync.Mutex
+	buckets   map[string]*TokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:     limit,
+		buckets:   make(map[string]*TokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the key's bucket if one is available. If not, it
+// also returns how long until one will be.
+func (limiter *RateLimiter) Allow(key string) (bool, time.Duration) {
+	bucket := limiter.bucket(key)
+	if bucket.Allow() {
+		return true, 0
+	}
+	return false, bucket.RetryAfter()
+}
+
+func (limiter *RateLimiter) bucket(key string) *TokenBucket {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.lastSweep) > rateLimiterSweepInterval {
+		for bucketKey, bucket := range limiter.buckets {
+			if bucket.isFull(now) {
+				delete(limiter.buckets, bucketKey)
+			}
+		}
+		limiter.lastSweep = now
+	}
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = limiter.limit.NewTokenBucket()
+		limiter.buckets[key] = bucket
+	}
+	return bucket
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is a token bucket rate limiter. It holds up to burst tokens and
+// refills at rate tokens per second.
+type TokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket if one is available.
+func (bucket *TokenBucket) Allow() bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(time.Now())
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RetryAfter returns how long until a token will be available.
+func (bucket *TokenBucket) RetryAfter() time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(time.Now())
+	if bucket.tokens >= 1 || bucket.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+// isFull reports whether the bucket has refilled completely, in which case
+// it behaves the same as a new bucket.
+func (bucket *TokenBucket) isFull(now time.Time) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(now)
+	return bucket.tokens >= bucket.burst
+}
+
+func (bucket *TokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
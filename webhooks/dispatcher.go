@@ -0,0 +1,238 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+)
+
+// PollInterval is how often the dispatcher looks for deliveries that are due,
+// and BatchSize is how many it sends at once.
+var PollInterval = 5 * time.Second
+var BatchSize = 20
+
+const requestTimeout = 10 * time.Second
+
+// Delivery errors are shown to the webhook's owner, so they don't include
+// details of the network the dispatcher runs on.
+var ErrAddressNotAllowed = errors.New("Webhook address is not allowed.")
+var ErrRequestTimedOut = errors.New("Webhook request timed out.")
+var ErrRequestFailed = errors.New("Could not connect to webhook.")
+
+// blockedNetworks are the private and shared address ranges that webhooks
+// may not be sent to, besides loopback, link-local, multicast and
+// unspecified addresses.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+// deliveryLease is how long a claimed delivery is left to the instance that
+// claimed it. It must be longer than a batch of requests can take.
+const deliveryLease = 2 * time.Minute
+
+// Dispatcher sends queued webhook deliveries in the background. Every instance
+// can run one; each delivery is claimed by one instance at a time.
+type Dispatcher struct {
+	store  repositories.WebhookStore
+	client *http.Client
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+func NewDispatcher(store repositories.WebhookStore) *Dispatcher {
+	dispatcher := &Dispatcher{
+		store:  store,
+		client: newWebhookClient(checkWebhookAddress),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go dispatcher.run()
+	return dispatcher
+}
+
+// newWebhookClient returns a client that doesn't follow redirects, and that
+// checks the address of every connection it makes with control, after the
+// webhook's host has been resolved. Checking there rather than when the
+// webhook is created means that DNS can't be changed to point at an internal
+// address later.
+func newWebhookClient(control func(network string, address string, conn syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+		Control: control,
+	}
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: requestTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkWebhookAddress refuses connections to the dispatcher's own host and
+// network, such as the cloud metadata service.
+func checkWebhookAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ErrAddressNotAllowed
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return ErrAddressNotAllowed
+	}
+	for _, blocked := range blockedNetworks {
+		if blocked.Contains(ip) {
+			return ErrAddressNotAllowed
+		}
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Close stops the dispatcher once the deliveries being sent have finished, or
+// when ctx is done.
+func (dispatcher *Dispatcher) Close(ctx context.Context) error {
+	close(dispatcher.quit)
+	select {
+	case <-dispatcher.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (dispatcher *Dispatcher) run() {
+	defer close(dispatcher.done)
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dispatcher.quit:
+			return
+		case <-ticker.C:
+		}
+
+		// Keep going while there is a backlog, rather than sending one batch
+		// per tick.
+		for {
+			sent, err := dispatcher.sendDue()
+			if err != nil {
+				log.Println(err)
+			}
+			if sent < BatchSize {
+				break
+			}
+			select {
+			case <-dispatcher.quit:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (dispatcher *Dispatcher) sendDue() (int, error) {
+	deliveries, err := dispatcher.store.ClaimWebhookDeliveries(BatchSize, deliveryLease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range deliveries {
+		wg.Add(1)
+		go func(delivery *models.WebhookDelivery) {
+			defer wg.Done()
+			responseStatus, err := dispatcher.send(delivery)
+			err = dispatcher.store.RecordWebhookAttempt(delivery, responseStatus, err)
+			if err != nil {
+				log.Println(err)
+			}
+		}(&deliveries[i])
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// send posts a delivery's payload to its webhook and returns the response
+// status. Redirects aren't followed, so they count as failures.
+func (dispatcher *Dispatcher) send(delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequest(http.MethodPost, delivery.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error sending webhook delivery %d: %v", delivery.ID, err)
+		return 0, ErrRequestFailed
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "nchat-webhooks")
+	request.Header.Set("X-Nchat-Event", delivery.Event)
+	request.Header.Set("X-Nchat-Delivery", strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set("X-Nchat-Timestamp", timestamp)
+	request.Header.Set("X-Nchat-Signature", Sign(delivery.Webhook.Secret, timestamp, body))
+
+	response, err := dispatcher.client.Do(request)
+	var netErr net.Error
+	if errors.Is(err, ErrAddressNotAllowed) {
+		return 0, ErrAddressNotAllowed
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0, ErrRequestTimedOut
+	} else if err != nil {
+		log.Printf("Error sending webhook delivery %d: %v", delivery.ID, err)
+		return 0, ErrRequestFailed
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+
+	return response.StatusCode, nil
+}
+
+// Sign returns the X-Nchat-Signature header for a payload: the hex HMAC-SHA256
+// of the timestamp, a period and the body, keyed with the webhook's secret.
+// Receivers should compute the same and compare, and reject old timestamps.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
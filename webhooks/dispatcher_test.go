@@ -0,0 +1,270 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrmilstein/nchat/app/models"
+	"github.com/nrmilstein/nchat/app/repositories"
+)
+
+// receiver is a webhook endpoint that verifies signatures the way the
+// documentation tells receivers to, independently of Sign.
+type receiver struct {
+	secret string
+	status int
+
+	mutex    sync.Mutex
+	requests int
+	verified int
+	bodies   []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	timestamp := request.Header.Get("X-Nchat-Timestamp")
+
+	mac := hmac.New(sha256.New, []byte(r.secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	isRecent := err == nil && time.Since(time.Unix(sentAt, 0)) < 5*time.Minute
+
+	r.mutex.Lock()
+	r.requests++
+	if isRecent && hmac.Equal([]byte(expected), []byte(request.Header.Get("X-Nchat-Signature"))) {
+		r.verified++
+		r.bodies = append(r.bodies, string(body))
+	}
+	r.mutex.Unlock()
+
+	w.WriteHeader(r.status)
+}
+
+type dispatcherTest struct {
+	stores     *repositories.Stores
+	user       *models.User
+	webhook    *models.Webhook
+	dispatcher *Dispatcher
+}
+
+// newDispatcherTest registers a webhook pointing at a receiver that responds
+// with status, and returns a dispatcher that may connect to it even though it
+// listens on loopback.
+func newDispatcherTest(t *testing.T, status int) (*dispatcherTest, *receiver) {
+	stores := repositories.NewMemoryStores()
+	user, err := stores.Users.CreateUser("alice", "password", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &receiver{status: status}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	webhook, err := stores.Webhooks.CreateWebhook(user, server.URL, []string{models.WebhookEventMessageCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.secret = webhook.Secret
+
+	dispatcher := &Dispatcher{
+		store:  stores.Webhooks,
+		client: newWebhookClient(nil),
+	}
+	return &dispatcherTest{stores, user, webhook, dispatcher}, r
+}
+
+func (test *dispatcherTest) enqueue(t *testing.T) {
+	err := test.stores.Webhooks.EnqueueWebhookEvent(models.WebhookEventMessageCreated,
+		[]int{test.user.ID}, map[string]string{"body": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (test *dispatcherTest) deliveries(t *testing.T) []models.WebhookDelivery {
+	deliveries, err := test.stores.Webhooks.GetWebhookDeliveries(test.user, test.webhook.ID, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestSignatureVerifiesAtReceiver(t *testing.T) {
+	test, r := newDispatcherTest(t, http.StatusNoContent)
+	test.enqueue(t)
+
+	sent, err := test.dispatcher.sendDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || r.requests != 1 || r.verified != 1 {
+		t.Fatalf("Sent %d, receiver got %d requests and verified %d, want 1 of each", sent, r.requests, r.verified)
+	}
+
+	deliveries := test.deliveries(t)
+	if deliveries[0].Status != models.WebhookDeliverySucceeded || deliveries[0].Payload != r.bodies[0] {
+		t.Errorf("Delivery = %+v, want succeeded with the body the receiver got", deliveries[0])
+	}
+}
+
+func TestSignWrongSecretDoesNotVerify(t *testing.T) {
+	body := []byte(`{"event":"message.created"}`)
+	if Sign("secret", "1600000000", body) == Sign("other", "1600000000", body) {
+		t.Error("Signatures with different secrets are equal.")
+	}
+	if Sign("secret", "1600000000", body) == Sign("secret", "1600000001", body) {
+		t.Error("Signatures with different timestamps are equal.")
+	}
+}
+
+func TestDeliveryDiesAfterMaxAttempts(t *testing.T) {
+	defer func(maxAttempts int, retryDelay time.Duration) {
+		models.MaxWebhookAttempts = maxAttempts
+		models.WebhookRetryDelay = retryDelay
+	}(models.MaxWebhookAttempts, models.WebhookRetryDelay)
+	models.MaxWebhookAttempts = 3
+	models.WebhookRetryDelay = 0
+
+	test, r := newDispatcherTest(t, http.StatusInternalServerError)
+	test.enqueue(t)
+
+	for i := 1; i <= 4; i++ {
+		_, err := test.dispatcher.sendDue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delivery := test.deliveries(t)[0]
+		wantStatus := models.WebhookDeliveryPending
+		if i >= models.MaxWebhookAttempts {
+			wantStatus = models.WebhookDeliveryDead
+		}
+		if delivery.Status != wantStatus {
+			t.Errorf("After send %d, status = %q, want %q", i, delivery.Status, wantStatus)
+		}
+		if delivery.LastError != "Webhook responded with status 500." {
+			t.Errorf("After send %d, lastError = %q", i, delivery.LastError)
+		}
+	}
+	if r.requests != models.MaxWebhookAttempts {
+		t.Errorf("Receiver got %d requests, want %d", r.requests, models.MaxWebhookAttempts)
+	}
+}
+
+func TestClaimLease(t *testing.T) {
+	test, _ := newDispatcherTest(t, http.StatusOK)
+	test.enqueue(t)
+
+	lease := 50 * time.Millisecond
+	claimed, err := test.stores.Webhooks.ClaimWebhookDeliveries(BatchSize, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("Claimed %d deliveries, want 1", len(claimed))
+	}
+
+	claimedAgain, err := test.stores.Webhooks.ClaimWebhookDeliveries(BatchSize, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimedAgain) != 0 {
+		t.Errorf("Claimed %d deliveries during the lease, want 0", len(claimedAgain))
+	}
+
+	// An instance that claimed a delivery and died leaves it to be claimed
+	// again once the lease is over.
+	time.Sleep(2 * lease)
+	claimedAgain, err = test.stores.Webhooks.ClaimWebhookDeliveries(BatchSize, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimedAgain) != 1 || claimedAgain[0].ID != claimed[0].ID {
+		t.Errorf("Claimed %+v after the lease, want the expired delivery", claimedAgain)
+	}
+}
+
+func TestRedirectsAreNotFollowed(t *testing.T) {
+	target := &receiver{status: http.StatusOK}
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+
+	test, _ := newDispatcherTest(t, http.StatusOK)
+	redirectServer := httptest.NewServer(http.RedirectHandler(targetServer.URL, http.StatusFound))
+	defer redirectServer.Close()
+	webhook, err := test.stores.Webhooks.CreateWebhook(test.user, redirectServer.URL,
+		[]string{models.WebhookEventMessageCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.webhook = webhook
+	test.enqueue(t)
+
+	_, err = test.dispatcher.sendDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.requests != 0 {
+		t.Error("The redirect was followed.")
+	}
+	delivery := test.deliveries(t)[0]
+	if delivery.Status != models.WebhookDeliveryPending || delivery.ResponseStatus != http.StatusFound {
+		t.Errorf("Delivery = %+v, want a failed attempt with status 302", delivery)
+	}
+}
+
+func TestPrivateAddressesAreRefused(t *testing.T) {
+	test, r := newDispatcherTest(t, http.StatusOK)
+	test.dispatcher.client = newWebhookClient(checkWebhookAddress)
+	test.enqueue(t)
+
+	_, err := test.dispatcher.sendDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.requests != 0 {
+		t.Error("The receiver on loopback was sent the delivery.")
+	}
+	delivery := test.deliveries(t)[0]
+	if delivery.LastError != ErrAddressNotAllowed.Error() {
+		t.Errorf("lastError = %q, want %q", delivery.LastError, ErrAddressNotAllowed.Error())
+	}
+}
+
+func TestCheckWebhookAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"127.0.0.1:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:443", false},
+		{"192.168.1.1:80", false},
+		{"100.64.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::1]:443", true},
+	}
+	for _, test := range tests {
+		err := checkWebhookAddress("tcp", test.address, nil)
+		if (err == nil) != test.allowed {
+			t.Errorf("checkWebhookAddress(%q) = %v, want allowed %v", test.address, err, test.allowed)
+		}
+	}
+}